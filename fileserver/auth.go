@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tokens file lists who may use the server, one user per line:
+//
+//	# username sha256-of-token [admin]
+//	alice 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+//	bob   fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9 admin
+//
+// Only hashes are stored, so the file doesn't give tokens away. The worker reads the
+// same format, so a line issued here can be copied to it as is.
+const _defaultTokensFile = "tokens"
+
+// _tokenPrefix makes tokens easy to recognize, e.g. in leaked logs.
+const _tokenPrefix = "sway_"
+
+// user is who sent a request.
+type user struct {
+	Name  string `json:"username"`
+	Admin bool   `json:"admin"`
+}
+
+// tokenStore checks API tokens against the tokens file. The file is read again when
+// it changes, so users can be added or revoked without a restart.
+type tokenStore struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]user // token hash to its user
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	t := &tokenStore{path: path}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// reload reads the tokens file if it changed since it was last read. Callers must
+// hold t.mu or own t.
+func (t *tokenStore) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(t.modTime) && t.users != nil {
+		return nil
+	}
+	users, err := readTokens(t.path)
+	if err != nil {
+		return err
+	}
+	t.users = users
+	t.modTime = info.ModTime()
+	return nil
+}
+
+// readTokens parses the tokens file at path. The worker has the same function; both
+// are tested against testdata/tokens, so they agree on which tokens are valid.
+func readTokens(path string) (map[string]user, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]user{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "admin") {
+			return nil, fmt.Errorf("%s:%d: want \"username sha256 [admin]\"", path, n)
+		}
+		users[strings.ToLower(fields[1])] = user{Name: fields[0], Admin: len(fields) == 3}
+	}
+	return users, scanner.Err()
+}
+
+// lookup returns the user token belongs to.
+func (t *tokenStore) lookup(token string) (user, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.reload(); err != nil {
+		// keep serving with the tokens we have
+		log.Printf("reloading %s: %v", t.path, err)
+	}
+	u, ok := t.users[hashToken(token)]
+	return u, ok
+}
+
+// issueToken makes a new token for username and appends its line to the tokens file
+// at path. It returns the token and the line.
+func issueToken(path, username string, admin bool) (string, string, error) {
+	if username == "" || strings.ContainsAny(username, " \t\n#") {
+		return "", "", fmt.Errorf("invalid username %q", username)
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := _tokenPrefix + hex.EncodeToString(secret)
+	line := username + " " + hashToken(token)
+	if admin {
+		line += " admin"
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return "", "", err
+	}
+	return token, line, nil
+}
+
+type userKey struct{}
+
+// requireToken lets requests through to next only with a valid
+// "Authorization: Bearer <token>" header, and tells next who sent them.
+func (t *tokenStore) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sway"`)
+			http.Error(w, "missing API token", http.StatusUnauthorized)
+			return
+		}
+		u, ok := t.lookup(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sway"`)
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// requestUser returns who sent r. Without authentication everyone is an admin, as
+// before tokens existed.
+func requestUser(r *http.Request) user {
+	if u, ok := r.Context().Value(userKey{}).(user); ok {
+		return u
+	}
+	return user{Admin: true}
+}
+
+// handleWhoami tells a client who its token belongs to.
+func handleWhoami(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requestUser(r))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// _blobsDir holds blob content as raw bytes, named by the SHA1 of the content.
+const _blobsDir = "blobs"
+
+var hashRegex = regexp.MustCompile(`^[a-f0-9]{40}$`)
+
+func (s *server) blobPath(hash string) string {
+	return filepath.Join(s.dirName, _blobsDir, hash)
+}
+
+// writeBlob streams r into the blob store and checks that its SHA1 matches hash.
+// The content goes through a temp file so readers never see a partial blob.
+func (s *server) writeBlob(hash string, r io.Reader) error {
+	dir := filepath.Join(s.dirName, _blobsDir)
+	tmp, err := os.CreateTemp(dir, hash+".tmp-*")
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != hash {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("%w: got %s", errHashMismatch, got)
+	}
+	if err := os.Rename(tmp.Name(), s.blobPath(hash)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+var errHashMismatch = errors.New("content does not match hash")
+
+// migrateJSONBlob converts a blob written by older servers, a JSON-encoded KeyValue
+// named by its hash in the top-level directory, into a raw blob in blobs/. The JSON
+// file is removed only once the raw blob is written, so an interrupted migration is
+// simply redone on the next start.
+func (s *server) migrateJSONBlob(hash string) error {
+	path := filepath.Join(s.dirName, hash)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entry KeyValue
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return fmt.Errorf("bad JSON: %w", err)
+	}
+	if !entry.IsDir {
+		if err := os.WriteFile(s.blobPath(hash), entry.Value, 0644); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// handleBlob serves /blobs/<hash>.
+//
+//	GET /blobs/<hash>  returns the raw content. Range headers are honoured, so the
+//	                   worker can fetch only the chunks of a file a program reads.
+//	PUT /blobs/<hash>  streams raw content into the store. The body must hash to <hash>.
+//	GET /blobs/<hash>/refs  lists the image keys that reference the blob, for admins.
+func (s *server) handleBlob(w http.ResponseWriter, r *http.Request) {
+	hash, isRefs := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/blobs/"), "/refs")
+	if !hashRegex.MatchString(hash) {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+	if isRefs {
+		s.handleBlobRefs(w, r, hash)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.mu.RLock()
+		known := s.hasBlob(hash)
+		s.mu.RUnlock()
+		if !known {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		f, err := os.Open(s.blobPath(hash))
+		if err != nil {
+			http.Error(w, "Error opening blob", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, hash, time.Time{}, f)
+
+	case http.MethodPut:
+		s.mu.RLock()
+		known := s.hasBlob(hash)
+		s.mu.RUnlock()
+		if known {
+			s.touchBlob(hash)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		err := s.writeBlob(hash, r.Body)
+		if errors.Is(err, errHashMismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to write blob %s: %v", hash, err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) handleBlobRefs(w http.ResponseWriter, r *http.Request, hash string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requestUser(r).Admin {
+		http.Error(w, "only admins can list references", http.StatusForbidden)
+		return
+	}
+	s.mu.RLock()
+	known := s.hasBlob(hash)
+	refs := s.blobRefs(hash)
+	s.mu.RUnlock()
+	if !known {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(refs)
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -17,26 +21,26 @@ import (
 const defaultDirName = "fileserverfiles"
 
 type server struct {
-	keydir           map[string]string // file path to content hash
-	mu               sync.RWMutex
-	dirName          string
-	knownDirectories map[string]map[string]struct{} // directory path to set of child hashes
+	mu      sync.RWMutex
+	dirName string
+	images  map[string]*image // image reference to its key index; defaultImage is the shared tree
+	refs    imageRefs
 }
 
-func NewServer() server {
+func NewServer() *server {
 	return NewServerWithDir(defaultDirName)
 }
 
-func NewServerWithDir(dirName string) server {
+func NewServerWithDir(dirName string) *server {
 	err := os.MkdirAll(dirName, os.ModePerm)
 	if err != nil {
 		panic(err)
 	}
 
-	s := server{
-		keydir:           map[string]string{},
-		dirName:          dirName,
-		knownDirectories: map[string]map[string]struct{}{},
+	s := &server{
+		dirName: dirName,
+		images:  map[string]*image{},
+		refs:    imageRefs{Tags: map[string]string{}, Committed: map[string]bool{}, Configs: map[string]json.RawMessage{}, Owners: map[string]string{}},
 	}
 	if err := s.buildIndex(); err != nil {
 		log.Printf("buildIndex: %v", err)
@@ -44,13 +48,71 @@ func NewServerWithDir(dirName string) server {
 	return s
 }
 
-// buildIndex scans all blob files in s.dirName and reconstructs keydir and knownDirectories.
-// Each blob file is a JSON-encoded KeyValue whose filename is the content hash.
+// buildIndex migrates blobs written by older servers and lists the images. Neither
+// the blob store nor the image logs are read: blobs are looked up on disk, and each
+// image is loaded when it is first used.
+//
+// Older servers stored each blob as a JSON-encoded KeyValue named by its hash in the
+// top-level directory. Stores from before images existed also have no images/
+// directory; their metadata is first written out as the default image. Then every
+// JSON blob is converted to a raw blob in blobs/.
 func (s *server) buildIndex() error {
 	entries, err := os.ReadDir(s.dirName)
 	if err != nil {
 		return fmt.Errorf("reading dir %s: %w", s.dirName, err)
 	}
+	blobsDir := filepath.Join(s.dirName, _blobsDir)
+	if err := os.MkdirAll(blobsDir, os.ModePerm); err != nil {
+		return fmt.Errorf("creating %s: %w", blobsDir, err)
+	}
+	imagesDir := filepath.Join(s.dirName, _imagesDir)
+	if _, err := os.Stat(imagesDir); os.IsNotExist(err) {
+		if err := s.migrateLegacyIndex(entries); err != nil {
+			return fmt.Errorf("migrating legacy index: %w", err)
+		}
+	}
+
+	migrated := 0
+	for _, de := range entries {
+		if de.IsDir() {
+			continue
+		}
+		if err := s.migrateJSONBlob(de.Name()); err != nil {
+			log.Printf("buildIndex: skipping %s: %v", de.Name(), err)
+			continue
+		}
+		migrated++
+	}
+	if migrated > 0 {
+		log.Printf("buildIndex: converted %d JSON blobs to raw blobs", migrated)
+	}
+
+	if err := s.loadImages(); err != nil {
+		return err
+	}
+	log.Printf("buildIndex: found %d images in %s", len(s.images), s.dirName)
+	return nil
+}
+
+// migrateLegacyIndex writes the metadata of every JSON blob out as the default image.
+// The index is built in a temp directory and renamed into place, so an interrupted
+// migration never leaves a partial images/ directory behind.
+func (s *server) migrateLegacyIndex(entries []os.DirEntry) error {
+	imagesDir := filepath.Join(s.dirName, _imagesDir)
+	tmpDir := imagesDir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(tmpDir, "default.log"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	count := 0
 	for _, de := range entries {
 		if de.IsDir() {
 			continue
@@ -66,20 +128,40 @@ func (s *server) buildIndex() error {
 			log.Printf("buildIndex: skipping %s (bad JSON): %v", hash, err)
 			continue
 		}
-		s.keydir[entry.Key] = hash
-		if entry.Parent != "" {
-			if _, ok := s.knownDirectories[entry.Parent]; !ok {
-				s.knownDirectories[entry.Parent] = map[string]struct{}{}
-			}
-			s.knownDirectories[entry.Parent][hash] = struct{}{}
+		entry.Value = nil
+		entry.HashValue = hash
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
 		}
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
 	}
-	log.Printf("buildIndex: loaded %d entries from %s", len(s.keydir), s.dirName)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, imagesDir); err != nil {
+		return err
+	}
+	log.Printf("buildIndex: migrated %d legacy entries into the default image", count)
 	return nil
 }
 
+// hasBlob reports whether the content with hash is stored.
+func (s *server) hasBlob(hash string) bool {
+	if !hashRegex.MatchString(hash) {
+		return false
+	}
+	info, err := os.Stat(s.blobPath(hash))
+	return err == nil && info.Mode().IsRegular()
+}
+
 func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("filepath")
+	ref := r.URL.Query().Get("image")
 
 	if key == "" {
 		http.Error(w, "filepath is required", http.StatusBadRequest)
@@ -98,10 +180,15 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 		log.Printf("received get for directory %s", dir)
 
 		s.mu.RLock()
-		hashes, ok := s.knownDirectories[dir]
-		hashSlice := make([]string, 0, len(hashes))
-		for h := range hashes {
-			hashSlice = append(hashSlice, h)
+		img, imgOk := s.loadedImage(ref)
+		var children map[string]struct{}
+		ok := false
+		if imgOk {
+			children, ok = img.knownDirectories[dir]
+		}
+		entries := make([]KeyValue, 0, len(children))
+		for child := range children {
+			entries = append(entries, img.keydir[child])
 		}
 		s.mu.RUnlock()
 
@@ -110,30 +197,20 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		entries := []KeyValue{}
-		for _, hash := range hashSlice {
-			content, err := os.ReadFile(filepath.Join(s.dirName, hash))
-			if err != nil {
-				continue
-			}
-			var entry KeyValue
-			if err := json.Unmarshal(content, &entry); err != nil {
-				continue
-			}
-			entry.HashValue = hash
-			entry.Value = nil
-			entries = append(entries, entry)
-		}
-
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(entries)
 		return
 	}
 
-	log.Printf("received get for file %s", key)
+	log.Printf("received get for file %s in image %q", key, ref)
 	s.mu.RLock()
-	hash, ok := s.keydir[key]
+	var meta KeyValue
+	img, ok := s.loadedImage(ref)
+	if ok {
+		meta, ok = img.keydir[key]
+	}
 	s.mu.RUnlock()
+	hash := meta.HashValue
 	log.Printf("key=%s hash=%s ok=%v", key, hash, ok)
 
 	if !ok {
@@ -141,46 +218,53 @@ func (s *server) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := os.Open(filepath.Join(s.dirName, hash))
-	if err != nil {
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
-		return
-	}
-
-	filecontent, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Error reading file", http.StatusInternalServerError)
-		return
-	}
-
-	var entry KeyValue
-	if err := json.Unmarshal(filecontent, &entry); err != nil {
-		log.Printf("corrupt file for hash %s: %v", hash, err)
-		http.Error(w, "corrupt file", http.StatusInternalServerError)
-		return
-	}
-
-	entry.HashValue = hash
+	// metadata only; content is fetched separately from /blobs/<hash>
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(entry)
+	json.NewEncoder(w).Encode(meta)
 }
 
 // KeyValue represents the JSON structure for set requests
 type KeyValue struct {
-	Key       string `json:"key"`
-	Value     []byte `json:"value"`      // Base64 encoded binary data
-	HashValue string `json:"hash_value"` // Content hash for caching
-	Parent    string `json:"parent"`
-	Name      string `json:"name"`
-	IsDir     bool   `json:"is_dir"`
-	Size      int64  `json:"size"`
-	Mode      int64  `json:"mode"`
-	ModTime   int64  `json:"mod_time"`
-	Uid       int    `json:"uid"`
-	Gid       int    `json:"gid"`
+	Key        string `json:"key"`
+	Value      []byte `json:"value,omitempty"`       // only sent inline by older clients; content lives in /blobs
+	HashValue  string `json:"hash_value"`            // Content hash, the name of the blob in /blobs
+	LinkTarget string `json:"link_target,omitempty"` // set for symlinks, which have no content
+	HardLink   string `json:"hard_link,omitempty"`   // key shared by every path of a hard-link group
+	Nlink      int    `json:"nlink,omitempty"`       // number of paths in the hard-link group
+	Parent     string `json:"parent"`
+	Name       string `json:"name"`
+	IsDir      bool   `json:"is_dir"`
+	Size       int64  `json:"size"`
+	Mode       int64  `json:"mode"`
+	ModTime    int64  `json:"mod_time"`
+	Uid        int    `json:"uid"`
+	Gid        int    `json:"gid"`
 }
 
+// handleSetBatch stores the metadata of a batch of entries into the image named by the
+// "image" query parameter. File content must already have been uploaded with
+// PUT /blobs/<hash>, and HashValue set to that hash. Content sent inline in Value by
+// older clients is still accepted and written to the blob store.
 func (s *server) handleSetBatch(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("image")
+	if !validImageRef(ref) {
+		http.Error(w, "invalid image reference", http.StatusBadRequest)
+		return
+	}
+	u := requestUser(r)
+	s.mu.RLock()
+	sealed := s.refs.Committed[ref]
+	allowed := s.canWrite(u, ref)
+	s.mu.RUnlock()
+	if !allowed {
+		http.Error(w, "image "+imageName(ref)+" belongs to another user", http.StatusForbidden)
+		return
+	}
+	if sealed {
+		http.Error(w, "image "+ref+" is committed and cannot be changed", http.StatusConflict)
+		return
+	}
+
 	var entries []KeyValue
 	err := json.NewDecoder(r.Body).Decode(&entries)
 	if err != nil {
@@ -188,44 +272,74 @@ func (s *server) handleSetBatch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	fmt.Fprintf(w, "Received request %d files\n", len(entries))
 
-	stored := 0
+	stored := make([]KeyValue, 0, len(entries))
 	for _, entry := range entries {
-		h := sha1.New()
-		if entry.IsDir {
+		switch {
+		case entry.IsDir:
+			h := sha1.New()
 			h.Write([]byte(entry.Key)) // Include key so directories get unique hashes
-		}
-		h.Write(entry.Value)
-		encoded := hex.EncodeToString(h.Sum(nil))
-
-		marshalledEntry, err := json.Marshal(entry)
-		if err != nil {
-			log.Printf("failed to marshal entry for key=%s: %v", entry.Key, err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
-		}
-		if err := os.WriteFile(filepath.Join(s.dirName, encoded), marshalledEntry, os.ModePerm); err != nil {
-			log.Printf("failed to write file for key=%s: %v", entry.Key, err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
-		}
-
-		s.mu.Lock()
-		s.keydir[entry.Key] = encoded
-		// Add to parent's directory listing
-		if entry.Parent != "" {
-			if _, ok := s.knownDirectories[entry.Parent]; !ok {
-				s.knownDirectories[entry.Parent] = map[string]struct{}{}
+			entry.HashValue = hex.EncodeToString(h.Sum(nil))
+		case entry.LinkTarget != "":
+			h := sha1.New()
+			h.Write([]byte(entry.Key + "->" + entry.LinkTarget)) // symlinks have no blob
+			entry.HashValue = hex.EncodeToString(h.Sum(nil))
+		case len(entry.Value) > 0 || entry.HashValue == "":
+			h := sha1.New()
+			h.Write(entry.Value)
+			entry.HashValue = hex.EncodeToString(h.Sum(nil))
+			if err := s.writeBlob(entry.HashValue, bytes.NewReader(entry.Value)); err != nil {
+				log.Printf("failed to write blob for key=%s: %v", entry.Key, err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			s.mu.RLock()
+			known := s.hasBlob(entry.HashValue)
+			s.mu.RUnlock()
+			if !known {
+				http.Error(w, "missing content for "+entry.Key, http.StatusBadRequest)
+				return
 			}
-			s.knownDirectories[entry.Parent][encoded] = struct{}{}
 		}
-		s.mu.Unlock()
+		entry.Value = nil
+		stored = append(stored, entry)
+	}
 
-		stored++
+	s.mu.Lock()
+	if !s.canWrite(u, ref) {
+		// someone else claimed the name in the meantime
+		s.mu.Unlock()
+		http.Error(w, "image "+imageName(ref)+" belongs to another user", http.StatusForbidden)
+		return
+	}
+	if s.refs.Committed[ref] {
+		// committed while the batch was read
+		s.mu.Unlock()
+		http.Error(w, "image "+ref+" is committed and cannot be changed", http.StatusConflict)
+		return
+	}
+	img, err := s.image(ref)
+	if err == nil {
+		err = s.claim(u, ref)
+	}
+	if err == nil {
+		err = s.appendImageLog(ref, stored)
+	}
+	if err == nil {
+		for _, entry := range stored {
+			img.add(entry)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("failed to persist index for image %q: %v", ref, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
 
-	fmt.Fprintf(w, "Stored %d files\n", stored)
+	fmt.Fprintf(w, "Received request %d files\n", len(entries))
+	fmt.Fprintf(w, "Stored %d files\n", len(stored))
 }
 
 // SyncEntry is metadata sent by client for sync comparison
@@ -235,10 +349,20 @@ type SyncEntry struct {
 }
 
 type SyncResponse struct {
-	NeedUpload []string `json:"need_upload"`
+	NeedUpload   []string `json:"need_upload"`   // content is not on the server
+	NeedMetadata []string `json:"need_metadata"` // content is stored, but the image lacks this key
 }
 
+// handleSync compares client hashes against the image named by the "image" query
+// parameter. Content is shared between images, so a key missing from a new image
+// only needs its metadata uploaded if another image already stored the same bytes.
 func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("image")
+	if !validImageRef(ref) {
+		http.Error(w, "invalid image reference", http.StatusBadRequest)
+		return
+	}
+
 	var entries []SyncEntry
 	err := json.NewDecoder(r.Body).Decode(&entries)
 	if err != nil {
@@ -250,32 +374,100 @@ func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	img, _ := s.loadedImage(ref)
 	needUpload := []string{}
+	needMetadata := []string{}
 	for _, entry := range entries {
-		existingHash, exists := s.keydir[entry.Key]
-		if !exists || existingHash != entry.Hash {
+		if img != nil {
+			if existing, exists := img.keydir[entry.Key]; exists && existing.HashValue == entry.Hash {
+				continue
+			}
+		}
+		if s.hasBlob(entry.Hash) {
+			// the client is about to reference it, so keep it from being collected
+			s.touchBlob(entry.Hash)
+			needMetadata = append(needMetadata, entry.Key)
+		} else {
 			needUpload = append(needUpload, entry.Key)
 		}
 	}
 
-	log.Printf("sync: %d files need upload", len(needUpload))
+	log.Printf("sync: image %q: %d files need upload, %d need metadata", ref, len(needUpload), len(needMetadata))
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(SyncResponse{NeedUpload: needUpload})
+	json.NewEncoder(w).Encode(SyncResponse{NeedUpload: needUpload, NeedMetadata: needMetadata})
 }
 
 func main() {
+	tokensFile := flag.String("tokens", _defaultTokensFile, "file of API tokens allowed to use the server")
+	noAuth := flag.Bool("no-auth", false, "let anyone use the server without a token, as an admin")
+	issue := flag.String("issue-token", "", "issue a new API token for this user, add it to the tokens file and exit")
+	admin := flag.Bool("admin", false, "with -issue-token, let the user change any image, including the default one")
+	certFile := flag.String("cert", "server.crt", "TLS certificate, with any intermediates after it")
+	keyFile := flag.String("key", "server.key", "private key of the TLS certificate")
+	reindexFlag := flag.Bool("reindex", false, "rebuild a corrupt index from what can still be read before starting")
+	flag.Parse()
+
+	if *issue != "" {
+		token, line, err := issueToken(*tokensFile, *issue, *admin)
+		if err != nil {
+			log.Fatalf("issue token: %v", err)
+		}
+		fmt.Printf("Token for %s: %s\n\n", *issue, token)
+		fmt.Printf("Added to %s. Add the same line to the worker's tokens file:\n\n  %s\n\n", *tokensFile, line)
+		fmt.Printf("Then on the user's machine: sway login %s\n", token)
+		return
+	}
+
+	if *reindexFlag {
+		report, err := reindex(defaultDirName)
+		if err != nil {
+			log.Fatalf("reindex: %v", err)
+		}
+		log.Printf("reindex: kept %d entries in %d images; skipped %d unreadable records and %d entries whose content is gone",
+			report.Entries, report.Images, report.BadRecords, report.MissingBlobs)
+	}
+
 	mux := http.NewServeMux()
 	s := NewServer()
 	mux.HandleFunc("/fetch", s.handleGet)
 	mux.HandleFunc("/batch-upload", s.handleSetBatch)
 	mux.HandleFunc("/sync", s.handleSync)
+	mux.HandleFunc("/images", s.handleImages)
+	mux.HandleFunc("/blobs/", s.handleBlob)
+	mux.HandleFunc("/whoami", handleWhoami)
+	mux.HandleFunc("/gc", s.handleGC)
+
+	var handler http.Handler = mux
+	if *noAuth {
+		log.Println("Warning: authentication is off, anyone who can reach the server can change any image")
+	} else {
+		tokens, err := newTokenStore(*tokensFile)
+		if err != nil {
+			log.Fatalf("loading API tokens: %v\nIssue one with -issue-token <user>, or start with -no-auth", err)
+		}
+		handler = tokens.requireToken(mux)
+	}
 
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("loading TLS certificate: %v\nMake one with sway tls init, or pass -cert and -key", err)
+	}
 	server := &http.Server{
-		Addr:    ":8443",
-		Handler: mux,
+		Addr:      ":8443",
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
 	}
 
+	// clients that pin the certificate instead of trusting a CA need this
+	log.Printf("Certificate fingerprint: %s", certFingerprint(cert))
 	log.Println("Starting server on https://localhost:8443")
-	log.Fatal(server.ListenAndServeTLS("server.crt", "server.key"))
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+// certFingerprint is the SHA-256 of the leaf certificate of cert, in the form sway and
+// the worker accept to pin it.
+func certFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return "sha256:" + hex.EncodeToString(sum[:])
 }
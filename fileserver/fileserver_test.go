@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -52,15 +59,11 @@ func TestHandleGet(t *testing.T) {
 		testDir := t.TempDir()
 		s := NewServerWithDir(testDir)
 
-		testHash := "abc123def456"
-		entry := KeyValue{
-			Key:   "/usr/bin/python",
-			Value: []byte("hello world"),
-			Name:  "python",
-		}
-		marshalledEntry, _ := json.Marshal(entry)
-		require.NoError(t, os.WriteFile(testDir+"/"+testHash, marshalledEntry, 0644))
-		s.keydir["/usr/bin/python"] = testHash
+		testHash := sha1Hex([]byte("hello world"))
+		require.NoError(t, s.writeBlob(testHash, strings.NewReader("hello world")))
+		img, err := s.image(defaultImage)
+		require.NoError(t, err)
+		img.add(KeyValue{Key: "/usr/bin/python", Name: "python", HashValue: testHash})
 
 		req := httptest.NewRequest(http.MethodGet, "/fetch?filepath=/usr/bin/python", nil)
 		rec := httptest.NewRecorder()
@@ -72,7 +75,7 @@ func TestHandleGet(t *testing.T) {
 		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
 		assert.Equal(t, "/usr/bin/python", response.Key)
 		assert.Equal(t, "python", response.Name)
-		assert.Equal(t, []byte("hello world"), response.Value)
+		assert.Empty(t, response.Value, "content is served from /blobs, not /fetch")
 		assert.Equal(t, testHash, response.HashValue)
 	})
 }
@@ -99,19 +102,16 @@ func TestHandleSetBatch(t *testing.T) {
 		assert.Contains(t, rec.Body.String(), "Stored 3 files")
 
 		for _, entry := range entries {
-			hash, ok := s.keydir[entry.Key]
+			meta, ok := s.images[defaultImage].keydir[entry.Key]
 			require.True(t, ok, "expected keydir to contain %q", entry.Key)
+			hash := meta.HashValue
 
-			content, err := os.ReadFile(testDir + "/" + hash)
+			content, err := os.ReadFile(testDir + "/blobs/" + hash)
 			require.NoError(t, err)
-
-			var stored KeyValue
-			require.NoError(t, json.Unmarshal(content, &stored))
-			assert.Equal(t, entry.Key, stored.Key)
-			assert.Equal(t, entry.Value, stored.Value)
-			assert.Equal(t, entry.Name, stored.Name)
-			assert.Equal(t, entry.Parent, stored.Parent)
-			assert.Equal(t, entry.Mode, stored.Mode)
+			assert.Equal(t, entry.Value, content)
+			assert.Equal(t, entry.Name, meta.Name)
+			assert.Equal(t, entry.Parent, meta.Parent)
+			assert.Equal(t, entry.Mode, meta.Mode)
 		}
 	})
 
@@ -141,6 +141,25 @@ func TestHandleSetBatch(t *testing.T) {
 		assert.Contains(t, rec.Body.String(), "Stored 0 files")
 	})
 
+	t.Run("stores symlinks without content", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+
+		body, _ := json.Marshal([]KeyValue{{Key: "/usr/bin/python3", LinkTarget: "python3.10", Name: "python3", Parent: "/usr/bin"}})
+		rec := httptest.NewRecorder()
+		s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = httptest.NewRecorder()
+		s.handleGet(rec, httptest.NewRequest(http.MethodGet, "/fetch?filepath=/usr/bin/python3", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var got KeyValue
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, "python3.10", got.LinkTarget)
+		blobs, err := os.ReadDir(filepath.Join(s.dirName, _blobsDir))
+		require.NoError(t, err)
+		assert.Empty(t, blobs)
+	})
+
 	t.Run("files can be fetched after batch upload", func(t *testing.T) {
 		testDir := t.TempDir()
 		s := NewServerWithDir(testDir)
@@ -162,3 +181,662 @@ func TestHandleSetBatch(t *testing.T) {
 		assert.Contains(t, rec.Body.String(), "/test/hello.py")
 	})
 }
+
+func TestImages(t *testing.T) {
+	upload := func(t *testing.T, s *server, ref string, entries []KeyValue) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(entries)
+		req := httptest.NewRequest(http.MethodPut, "/batch-upload?image="+ref, bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handleSetBatch(rec, req)
+		return rec
+	}
+	fetch := func(s *server, ref, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/fetch?image="+ref+"&filepath="+key, nil)
+		rec := httptest.NewRecorder()
+		s.handleGet(rec, req)
+		return rec
+	}
+
+	t.Run("images do not overwrite each other", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-b@bbbb", []KeyValue{{Key: "app/main.py", Value: []byte("b"), Name: "main.py", Parent: "app"}}).Code)
+
+		var a, b KeyValue
+		require.NoError(t, json.Unmarshal(fetch(s, "sway-a@aaaa", "app/main.py").Body.Bytes(), &a))
+		require.NoError(t, json.Unmarshal(fetch(s, "sway-b@bbbb", "app/main.py").Body.Bytes(), &b))
+		assert.Equal(t, sha1Hex([]byte("a")), a.HashValue)
+		assert.Equal(t, sha1Hex([]byte("b")), b.HashValue)
+		assert.Equal(t, http.StatusNotFound, fetch(s, "", "app/main.py").Code)
+	})
+
+	t.Run("sync reports metadata-only keys when content is already stored", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/lib.so", Value: []byte("lib"), Name: "lib.so", Parent: "app"}}).Code)
+		hash := s.images["sway-a@aaaa"].keydir["app/lib.so"].HashValue
+
+		body, _ := json.Marshal([]SyncEntry{{Key: "app/lib.so", Hash: hash}, {Key: "app/new.py", Hash: "ffff"}})
+		req := httptest.NewRequest(http.MethodPost, "/sync?image=sway-b@bbbb", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		s.handleSync(rec, req)
+
+		var resp SyncResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, []string{"app/new.py"}, resp.NeedUpload)
+		assert.Equal(t, []string{"app/lib.so"}, resp.NeedMetadata)
+
+		rec = upload(t, s, "sway-b@bbbb", []KeyValue{{Key: "app/lib.so", HashValue: hash, Name: "lib.so", Parent: "app"}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		var got KeyValue
+		require.NoError(t, json.Unmarshal(fetch(s, "sway-b@bbbb", "app/lib.so").Body.Bytes(), &got))
+		assert.Equal(t, hash, got.HashValue)
+	})
+
+	t.Run("metadata-only upload of unknown content is rejected", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		rec := upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/lib.so", HashValue: "ffff", Name: "lib.so", Parent: "app"}})
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("committed images resolve by name and are immutable", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodGet, "/images?name=sway-a", nil))
+		var info ImageInfo
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+		assert.Equal(t, "sway-a@aaaa", info.Ref)
+
+		assert.Equal(t, http.StatusConflict, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/x.py", Value: []byte("x")}}).Code)
+	})
+
+	t.Run("a batch read while the image is committed is refused", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+
+		// the batch passes the first check, then waits for its body
+		body, bodyWriter := io.Pipe()
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload?image=sway-a@aaaa", body))
+			close(done)
+		}()
+		data, err := json.Marshal([]KeyValue{{Key: "app/x.py", Value: []byte("x"), Name: "x.py", Parent: "app"}})
+		require.NoError(t, err)
+		_, err = bodyWriter.Write(data[:1])
+		require.NoError(t, err)
+
+		commit := httptest.NewRecorder()
+		s.handleImages(commit, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", nil))
+		require.Equal(t, http.StatusOK, commit.Code)
+		bodyWriter.Write(data[1:])
+		bodyWriter.Close()
+		<-done
+
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, http.StatusNotFound, fetch(s, "sway-a@aaaa", "app/x.py").Code)
+	})
+
+	t.Run("commit stores the image config", func(t *testing.T) {
+		testDir := t.TempDir()
+		s := NewServerWithDir(testDir)
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+
+		config := `{"Env":["PATH=/opt/venv/bin:/usr/bin"],"WorkingDir":"/app","User":"1000"}`
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", strings.NewReader(config)))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		restarted := NewServerWithDir(testDir)
+		rec = httptest.NewRecorder()
+		restarted.handleImages(rec, httptest.NewRequest(http.MethodGet, "/images?ref=sway-a@aaaa", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var info ImageInfo
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+		assert.Equal(t, "sway-a", info.Name)
+		assert.JSONEq(t, config, string(info.Config))
+
+		rec = httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodGet, "/images?ref=sway-b@bbbb", nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("rejects an invalid image config", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", strings.NewReader("{")))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.False(t, s.refs.Committed["sway-a@aaaa"])
+	})
+
+	t.Run("rejects invalid image references", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		assert.Equal(t, http.StatusBadRequest, upload(t, s, "../etc", []KeyValue{}).Code)
+	})
+
+	t.Run("index survives a restart", func(t *testing.T) {
+		testDir := t.TempDir()
+		s := NewServerWithDir(testDir)
+		require.Equal(t, http.StatusOK, upload(t, s, "sway-a@aaaa", []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}).Code)
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		restarted := NewServerWithDir(testDir)
+		assert.Equal(t, http.StatusOK, fetch(restarted, "sway-a@aaaa", "app/main.py").Code)
+		assert.True(t, restarted.refs.Committed["sway-a@aaaa"])
+	})
+
+	t.Run("legacy blobs are migrated into the default image", func(t *testing.T) {
+		testDir := t.TempDir()
+		hash := sha1Hex([]byte("old"))
+		marshalled, _ := json.Marshal(KeyValue{Key: "app/old.py", Value: []byte("old"), Name: "old.py", Parent: "app"})
+		require.NoError(t, os.WriteFile(testDir+"/"+hash, marshalled, 0644))
+
+		s := NewServerWithDir(testDir)
+		rec := fetch(s, "", "app/old.py")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var got KeyValue
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, hash, got.HashValue)
+
+		content, err := os.ReadFile(testDir + "/blobs/" + hash)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("old"), content)
+		assert.NoFileExists(t, testDir+"/"+hash)
+
+		restarted := NewServerWithDir(testDir)
+		assert.Equal(t, http.StatusOK, fetch(restarted, "", "app/old.py").Code)
+	})
+}
+
+func TestHandleBlob(t *testing.T) {
+	upload := func(t *testing.T, s *server, content []byte) string {
+		body, _ := json.Marshal([]KeyValue{{Key: "app/lib.so", Value: content, Name: "lib.so", Parent: "app"}})
+		rec := httptest.NewRecorder()
+		s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return s.images[defaultImage].keydir["app/lib.so"].HashValue
+	}
+
+	t.Run("serves the requested byte range", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		hash := upload(t, s, []byte("0123456789"))
+
+		req := httptest.NewRequest(http.MethodGet, "/blobs/"+hash, nil)
+		req.Header.Set("Range", "bytes=2-5")
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, req)
+
+		assert.Equal(t, http.StatusPartialContent, rec.Code)
+		assert.Equal(t, "2345", rec.Body.String())
+	})
+
+	t.Run("serves the whole blob without a range", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		hash := upload(t, s, []byte("0123456789"))
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodGet, "/blobs/"+hash, nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+		assert.Equal(t, "0123456789", rec.Body.String())
+	})
+
+	t.Run("returns 404 for unknown hash", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodGet, "/blobs/"+strings.Repeat("a", 40), nil))
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("returns 400 for invalid hash", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodGet, "/blobs/..%2fimages", nil))
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("stores uploaded content", func(t *testing.T) {
+		testDir := t.TempDir()
+		s := NewServerWithDir(testDir)
+		hash := sha1Hex([]byte("raw bytes"))
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodPut, "/blobs/"+hash, strings.NewReader("raw bytes")))
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		content, err := os.ReadFile(testDir + "/blobs/" + hash)
+		require.NoError(t, err)
+		assert.Equal(t, "raw bytes", string(content))
+
+		rec = httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodPut, "/blobs/"+hash, strings.NewReader("raw bytes")))
+		assert.Equal(t, http.StatusOK, rec.Code, "re-uploading known content is a no-op")
+	})
+
+	t.Run("rejects content that does not match the hash", func(t *testing.T) {
+		testDir := t.TempDir()
+		s := NewServerWithDir(testDir)
+		hash := sha1Hex([]byte("expected"))
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodPut, "/blobs/"+hash, strings.NewReader("something else")))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.NoFileExists(t, testDir+"/blobs/"+hash)
+		assert.False(t, s.hasBlob(hash))
+	})
+
+	t.Run("metadata can reference an uploaded blob", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		hash := sha1Hex([]byte("lib"))
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodPut, "/blobs/"+hash, strings.NewReader("lib")))
+		require.Equal(t, http.StatusCreated, rec.Code)
+
+		body, _ := json.Marshal([]KeyValue{{Key: "app/lib.so", HashValue: hash, Name: "lib.so", Parent: "app", Size: 3}})
+		rec = httptest.NewRecorder()
+		s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, hash, s.images[defaultImage].keydir["app/lib.so"].HashValue)
+	})
+}
+
+func sha1Hex(b []byte) string {
+	h := sha1.Sum(b)
+	return hex.EncodeToString(h[:])
+}
+
+func TestAuth(t *testing.T) {
+	tokensFile := filepath.Join(t.TempDir(), "tokens")
+	aliceToken, _, err := issueToken(tokensFile, "alice", false)
+	require.NoError(t, err)
+	bobToken, _, err := issueToken(tokensFile, "bob", false)
+	require.NoError(t, err)
+	adminToken, line, err := issueToken(tokensFile, "root", true)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(line, " admin"))
+	assert.NotContains(t, line, adminToken, "only the hash is stored")
+
+	tokens, err := newTokenStore(tokensFile)
+	require.NoError(t, err)
+	s := NewServerWithDir(t.TempDir())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/batch-upload", s.handleSetBatch)
+	mux.HandleFunc("/images", s.handleImages)
+	mux.HandleFunc("/whoami", handleWhoami)
+	handler := tokens.requireToken(mux)
+
+	do := func(token, method, target string, body any) *httptest.ResponseRecorder {
+		var data []byte
+		if body != nil {
+			data, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+		req := httptest.NewRequest(method, target, bytes.NewReader(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	files := []KeyValue{{Key: "app/main.py", Value: []byte("a"), Name: "main.py", Parent: "app"}}
+
+	t.Run("requests without a valid token are rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do("", http.MethodGet, "/whoami", nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, do("sway_nope", http.MethodGet, "/whoami", nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, do("", http.MethodPut, "/batch-upload?image=sway-a@aaaa", files).Code)
+	})
+
+	t.Run("whoami names the token's user", func(t *testing.T) {
+		rec := do(aliceToken, http.MethodGet, "/whoami", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var u user
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &u))
+		assert.Equal(t, user{Name: "alice"}, u)
+	})
+
+	t.Run("images belong to the first user who uploads to them", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(aliceToken, http.MethodPut, "/batch-upload?image=sway-a@aaaa", files).Code)
+
+		assert.Equal(t, http.StatusForbidden, do(bobToken, http.MethodPut, "/batch-upload?image=sway-a@bbbb", files).Code)
+		assert.Equal(t, http.StatusForbidden, do(bobToken, http.MethodPost, "/images?ref=sway-a@aaaa", nil).Code)
+		assert.Equal(t, http.StatusOK, do(aliceToken, http.MethodPut, "/batch-upload?image=sway-a@bbbb", files).Code)
+		assert.Equal(t, http.StatusOK, do(adminToken, http.MethodPost, "/images?ref=sway-a@aaaa", nil).Code)
+		assert.Equal(t, http.StatusOK, do(bobToken, http.MethodPut, "/batch-upload?image=sway-b@aaaa", files).Code)
+	})
+
+	t.Run("only admins can change the default image", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, do(aliceToken, http.MethodPut, "/batch-upload", files).Code)
+		assert.Equal(t, http.StatusOK, do(adminToken, http.MethodPut, "/batch-upload", files).Code)
+	})
+
+	t.Run("revoked tokens stop working without a restart", func(t *testing.T) {
+		content, err := os.ReadFile(tokensFile)
+		require.NoError(t, err)
+		kept := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if !strings.HasPrefix(line, "bob ") {
+				kept = append(kept, line)
+			}
+		}
+		require.NoError(t, os.WriteFile(tokensFile, []byte(strings.Join(kept, "\n")+"\n"), 0600))
+		// make sure the change is seen even on filesystems with coarse mtimes
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(tokensFile, later, later))
+
+		assert.Equal(t, http.StatusUnauthorized, do(bobToken, http.MethodGet, "/whoami", nil).Code)
+		assert.Equal(t, http.StatusOK, do(aliceToken, http.MethodGet, "/whoami", nil).Code)
+	})
+
+	t.Run("malformed tokens files are rejected", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "tokens")
+		require.NoError(t, os.WriteFile(bad, []byte("alice\n"), 0600))
+		_, err := newTokenStore(bad)
+		assert.Error(t, err)
+	})
+}
+
+// The worker runs the same test: both read the tokens file format from the
+// repository's testdata, so they can't disagree on which tokens are valid.
+func TestTokensFileFormat(t *testing.T) {
+	data, err := os.ReadFile("../testdata/tokens/valid.json")
+	require.NoError(t, err)
+	var want struct {
+		Tokens map[string]struct {
+			Name  string `json:"name"`
+			Admin bool   `json:"admin"`
+		} `json:"tokens"`
+		Unknown []string `json:"unknown"`
+	}
+	require.NoError(t, json.Unmarshal(data, &want))
+	require.NotEmpty(t, want.Tokens)
+
+	tokens, err := newTokenStore("../testdata/tokens/valid")
+	require.NoError(t, err)
+	assert.Len(t, tokens.users, len(want.Tokens))
+	for token, w := range want.Tokens {
+		u, ok := tokens.lookup(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, user{Name: w.Name, Admin: w.Admin}, u, token)
+	}
+	for _, token := range want.Unknown {
+		_, ok := tokens.lookup(token)
+		assert.False(t, ok, token)
+	}
+
+	invalid, err := filepath.Glob("../testdata/tokens/invalid-*")
+	require.NoError(t, err)
+	require.NotEmpty(t, invalid)
+	for _, path := range invalid {
+		_, err := readTokens(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestGC(t *testing.T) {
+	upload := func(t *testing.T, s *server, ref string, entries []KeyValue) {
+		t.Helper()
+		body, _ := json.Marshal(entries)
+		rec := httptest.NewRecorder()
+		s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload?image="+ref, bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	commit := func(t *testing.T, s *server, ref string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref="+ref, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	gc := func(t *testing.T, s *server, query string) GCReport {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.handleGC(rec, httptest.NewRequest(http.MethodPost, "/gc?"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var report GCReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		return report
+	}
+	// age makes files look like they were written before the grace period
+	age := func(t *testing.T, paths ...string) {
+		t.Helper()
+		old := time.Now().Add(-2 * _gcGrace)
+		for _, path := range paths {
+			require.NoError(t, os.Chtimes(path, old, old))
+		}
+	}
+	file := func(content string) KeyValue {
+		return KeyValue{Key: "app/" + content + ".py", Value: []byte(content), Name: content + ".py", Parent: "app"}
+	}
+
+	t.Run("only unreferenced blobs older than the grace period are swept", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", []KeyValue{file("kept")})
+		orphan, recent := sha1Hex([]byte("orphan")), sha1Hex([]byte("recent"))
+		require.NoError(t, s.writeBlob(orphan, strings.NewReader("orphan")))
+		require.NoError(t, s.writeBlob(recent, strings.NewReader("recent")))
+		age(t, s.blobPath(orphan), s.blobPath(sha1Hex([]byte("kept"))))
+
+		report := gc(t, s, "dry_run=true")
+		assert.Equal(t, GCReport{DryRun: true, LiveBlobs: 1, SweptBlobs: 1, ReclaimedBytes: 6, RecentBlobs: 1}, report)
+		assert.FileExists(t, s.blobPath(orphan), "a dry run removes nothing")
+
+		report = gc(t, s, "")
+		assert.Equal(t, GCReport{LiveBlobs: 1, SweptBlobs: 1, ReclaimedBytes: 6, RecentBlobs: 1}, report)
+		assert.NoFileExists(t, s.blobPath(orphan))
+		assert.False(t, s.hasBlob(orphan))
+		assert.FileExists(t, s.blobPath(recent))
+		assert.FileExists(t, s.blobPath(sha1Hex([]byte("kept"))))
+	})
+
+	t.Run("prune drops superseded images so their blobs can be swept", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@1111", []KeyValue{file("shared"), file("old")})
+		commit(t, s, "sway-a@1111")
+		upload(t, s, "sway-a@2222", []KeyValue{file("shared"), file("new")})
+		commit(t, s, "sway-a@2222")
+		upload(t, s, "sway-b@3333", []KeyValue{file("abandoned")})
+		upload(t, s, "sway-c@4444", []KeyValue{file("uploading")})
+		for _, content := range []string{"shared", "old", "new", "abandoned", "uploading"} {
+			age(t, s.blobPath(sha1Hex([]byte(content))))
+		}
+		age(t, s.imageLogPath("sway-a@1111"), s.imageLogPath("sway-a@2222"), s.imageLogPath("sway-b@3333"))
+
+		assert.Equal(t, 0, gc(t, s, "").SweptBlobs, "without prune every image is kept")
+
+		report := gc(t, s, "prune=true")
+		assert.Equal(t, []string{"sway-a@1111", "sway-b@3333"}, report.PrunedImages)
+		assert.Equal(t, 2, report.SweptBlobs)
+		assert.Equal(t, 3, report.LiveBlobs)
+		assert.NotContains(t, s.images, "sway-a@1111")
+		assert.NoFileExists(t, s.imageLogPath("sway-a@1111"))
+		assert.False(t, s.hasBlob(sha1Hex([]byte("old"))))
+		assert.True(t, s.hasBlob(sha1Hex([]byte("shared"))))
+		assert.True(t, s.hasBlob(sha1Hex([]byte("uploading"))))
+
+		restarted := NewServerWithDir(s.dirName)
+		assert.NotContains(t, restarted.images, "sway-a@1111")
+		assert.False(t, restarted.refs.Committed["sway-a@1111"])
+		assert.Equal(t, "sway-a@2222", restarted.refs.Tags["sway-a"])
+	})
+
+	t.Run("sync keeps blobs it offers for reuse", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		hash := sha1Hex([]byte("reused"))
+		require.NoError(t, s.writeBlob(hash, strings.NewReader("reused")))
+		age(t, s.blobPath(hash))
+
+		body, _ := json.Marshal([]SyncEntry{{Key: "app/reused.py", Hash: hash}})
+		s.handleSync(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/sync?image=sway-a@aaaa", bytes.NewReader(body)))
+
+		assert.Equal(t, 1, gc(t, s, "").RecentBlobs)
+		assert.True(t, s.hasBlob(hash))
+	})
+
+	t.Run("references of a blob", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", []KeyValue{file("lib")})
+		upload(t, s, "sway-b@bbbb", []KeyValue{file("lib")})
+
+		rec := httptest.NewRecorder()
+		s.handleBlob(rec, httptest.NewRequest(http.MethodGet, "/blobs/"+sha1Hex([]byte("lib"))+"/refs", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var refs []BlobRef
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &refs))
+		assert.Equal(t, []BlobRef{{Image: "sway-a@aaaa", Key: "app/lib.py"}, {Image: "sway-b@bbbb", Key: "app/lib.py"}}, refs)
+	})
+
+	t.Run("only admins can collect garbage", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		req := httptest.NewRequest(http.MethodPost, "/gc", nil)
+		req = req.WithContext(context.WithValue(req.Context(), userKey{}, user{Name: "alice"}))
+		rec := httptest.NewRecorder()
+		s.handleGC(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		rec = httptest.NewRecorder()
+		s.handleGC(rec, httptest.NewRequest(http.MethodPost, "/gc?grace=soon", nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestIndex(t *testing.T) {
+	upload := func(t *testing.T, s *server, ref string, entries ...KeyValue) {
+		t.Helper()
+		body, _ := json.Marshal(entries)
+		rec := httptest.NewRecorder()
+		s.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload?image="+ref, bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	file := func(content string) KeyValue {
+		return KeyValue{Key: "app/" + content + ".py", Value: []byte(content), Name: content + ".py", Parent: "app"}
+	}
+	keydir := func(t *testing.T, s *server, ref string) map[string]KeyValue {
+		t.Helper()
+		img, ok := s.loadedImage(ref)
+		require.True(t, ok, "image %q loads", ref)
+		return img.keydir
+	}
+	appendTo := func(t *testing.T, path, data string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		require.NoError(t, err)
+		_, err = f.WriteString(data)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	t.Run("each batch is one record of the log", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", file("a"), file("b"))
+		upload(t, s, "sway-a@aaaa", file("c"))
+
+		content, err := os.ReadFile(s.imageLogPath("sway-a@aaaa"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, bytes.Count(content, []byte("\n")))
+	})
+
+	t.Run("images are loaded when first used", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", file("a"))
+		upload(t, s, "sway-b@bbbb", file("b"))
+		appendTo(t, s.imageLogPath("sway-b@bbbb"), "garbage\n")
+		upload(t, s, "sway-b@bbbb", file("c"))
+
+		restarted := NewServerWithDir(s.dirName)
+		require.Contains(t, restarted.images, "sway-a@aaaa")
+		assert.Empty(t, restarted.images["sway-a@aaaa"].keydir, "startup doesn't read the logs")
+		rec := httptest.NewRecorder()
+		restarted.handleGet(rec, httptest.NewRequest(http.MethodGet, "/fetch?filepath=app/a.py&image=sway-a@aaaa", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		// a broken log only fails its own image, and can't be added to
+		_, ok := restarted.loadedImage("sway-b@bbbb")
+		assert.False(t, ok)
+		body, _ := json.Marshal([]KeyValue{file("d")})
+		rec = httptest.NewRecorder()
+		restarted.handleSetBatch(rec, httptest.NewRequest(http.MethodPut, "/batch-upload?image=sway-b@bbbb", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		_, err := restarted.collectGarbage(gcOptions{})
+		assert.Error(t, err, "nothing is swept while an image can't be marked")
+	})
+
+	t.Run("a batch a crash cut off is dropped when the image is loaded", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", file("a"))
+		path := s.imageLogPath("sway-a@aaaa")
+		before, err := os.ReadFile(path)
+		require.NoError(t, err)
+		appendTo(t, path, `[{"key":"app/b.py","hash_va`)
+
+		restarted := NewServerWithDir(s.dirName)
+		assert.Contains(t, keydir(t, restarted, "sway-a@aaaa"), "app/a.py")
+		assert.NotContains(t, keydir(t, restarted, "sway-a@aaaa"), "app/b.py")
+		after, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, before, after, "the cut-off record is removed so later appends start on a new line")
+
+		upload(t, restarted, "sway-a@aaaa", file("c"))
+		assert.Contains(t, keydir(t, NewServerWithDir(s.dirName), "sway-a@aaaa"), "app/c.py")
+	})
+
+	t.Run("logs of older servers, one entry per line, still load", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", file("a"))
+		entry, _ := json.Marshal(KeyValue{Key: "app/old.py", HashValue: sha1Hex([]byte("a")), Name: "old.py", Parent: "app"})
+		appendTo(t, s.imageLogPath("sway-a@aaaa"), string(entry)+"\n")
+
+		assert.Contains(t, keydir(t, NewServerWithDir(s.dirName), "sway-a@aaaa"), "app/old.py")
+	})
+
+	t.Run("reindex recovers a corrupt log and refs", func(t *testing.T) {
+		s := NewServerWithDir(t.TempDir())
+		upload(t, s, "sway-a@aaaa", file("a"))
+		upload(t, s, "sway-a@aaaa", file("a"), file("gone"))
+		upload(t, s, "sway-b@bbbb", file("b"))
+		require.NoError(t, os.Remove(s.blobPath(sha1Hex([]byte("gone")))))
+		appendTo(t, s.imageLogPath("sway-a@aaaa"), "garbage\n")
+		upload(t, s, "sway-a@aaaa", file("late"))
+		rec := httptest.NewRecorder()
+		s.handleImages(rec, httptest.NewRequest(http.MethodPost, "/images?ref=sway-a@aaaa", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(s.imageLogPath("sway-b@bbbb"), old, old))
+		require.NoError(t, os.WriteFile(filepath.Join(s.dirName, _imagesDir, _refsFile), []byte("{"), 0644))
+
+		broken := NewServerWithDir(s.dirName)
+		_, ok := broken.loadedImage("sway-a@aaaa")
+		assert.False(t, ok, "a broken record in the middle fails the image")
+
+		report, err := reindex(s.dirName)
+		require.NoError(t, err)
+		assert.Equal(t, reindexReport{Images: 3, Entries: 3, BadRecords: 1, MissingBlobs: 1, RebuiltRefs: true}, report)
+
+		recovered := NewServerWithDir(s.dirName)
+		keys := keydir(t, recovered, "sway-a@aaaa")
+		assert.Contains(t, keys, "app/a.py")
+		assert.Contains(t, keys, "app/late.py")
+		assert.NotContains(t, keys, "app/gone.py")
+		assert.True(t, recovered.refs.Committed["sway-a@aaaa"])
+		assert.True(t, recovered.refs.Committed["sway-b@bbbb"])
+		assert.FileExists(t, filepath.Join(s.dirName, _imagesDir, _refsFile+".corrupt"))
+		info, err := os.Stat(s.imageLogPath("sway-b@bbbb"))
+		require.NoError(t, err)
+		assert.WithinDuration(t, old, info.ModTime(), time.Second, "rewriting a log keeps its time")
+	})
+}
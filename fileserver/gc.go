@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// _gcGrace is how old an unreferenced blob or an image that is no longer the latest
+// has to be before garbage collection removes it. Clients upload blobs before the
+// metadata that references them, and runs may be queued against an older image, so
+// anything newer could still be about to be used.
+const _gcGrace = time.Hour
+
+// BlobRef is a key of an image that references a blob.
+type BlobRef struct {
+	Image string `json:"image"`
+	Key   string `json:"key"`
+}
+
+// blobRefs returns every key of every image with content hash. Images are loaded to
+// look through them. Callers must hold s.mu.
+func (s *server) blobRefs(hash string) []BlobRef {
+	refs := []BlobRef{}
+	for ref := range s.images {
+		img, ok := s.loadedImage(ref)
+		if !ok {
+			continue
+		}
+		for key, entry := range img.keydir {
+			if entry.HashValue == hash {
+				refs = append(refs, BlobRef{Image: ref, Key: key})
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Image != refs[j].Image {
+			return refs[i].Image < refs[j].Image
+		}
+		return refs[i].Key < refs[j].Key
+	})
+	return refs
+}
+
+// touchBlob marks hash as recently used, so garbage collection leaves it alone while a
+// client that was just told the server has it uploads the metadata referencing it.
+func (s *server) touchBlob(hash string) {
+	now := time.Now()
+	os.Chtimes(s.blobPath(hash), now, now)
+}
+
+// GCReport is the answer to POST /gc. With DryRun nothing was removed, and the
+// report says what would have been.
+type GCReport struct {
+	DryRun         bool     `json:"dry_run"`
+	PrunedImages   []string `json:"pruned_images,omitempty"` // with prune
+	LiveBlobs      int      `json:"live_blobs"`
+	SweptBlobs     int      `json:"swept_blobs"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	RecentBlobs    int      `json:"recent_blobs"` // unreferenced, but kept for the grace period
+}
+
+type gcOptions struct {
+	dryRun bool
+	// prune also removes images that are no longer the latest of their name, and
+	// uploads that were never committed, so their blobs can be swept
+	prune bool
+	grace time.Duration
+}
+
+// collectGarbage removes blobs no image references: it marks the hash of every key of
+// every image, then sweeps the blob store. It holds s.mu for writing throughout, so no
+// upload can add a reference to a blob while it is being removed. Every image is
+// loaded to be marked; if one can't be, nothing is swept, since its blobs might be.
+// Files an interrupted upload left behind in the blob store are swept too.
+func (s *server) collectGarbage(opts gcOptions) (GCReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := GCReport{DryRun: opts.dryRun}
+	cutoff := time.Now().Add(-opts.grace)
+	pruned := map[string]bool{}
+	if opts.prune {
+		for ref := range s.images {
+			if ref == defaultImage || (s.refs.Committed[ref] && s.refs.Tags[imageName(ref)] == ref) {
+				continue
+			}
+			info, err := os.Stat(s.imageLogPath(ref))
+			if err == nil && info.ModTime().After(cutoff) {
+				continue
+			}
+			pruned[ref] = true
+			report.PrunedImages = append(report.PrunedImages, ref)
+		}
+		sort.Strings(report.PrunedImages)
+	}
+
+	live := map[string]struct{}{}
+	for ref := range s.images {
+		if pruned[ref] {
+			continue
+		}
+		img, ok := s.loadedImage(ref)
+		if !ok {
+			return report, fmt.Errorf("image %q can't be read; start with -reindex to recover it", ref)
+		}
+		for _, entry := range img.keydir {
+			live[entry.HashValue] = struct{}{}
+		}
+	}
+
+	if !opts.dryRun {
+		for ref := range pruned {
+			if err := s.dropImage(ref); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	blobsDir := filepath.Join(s.dirName, _blobsDir)
+	blobs, err := os.ReadDir(blobsDir)
+	if err != nil {
+		return report, err
+	}
+	for _, de := range blobs {
+		hash := de.Name()
+		if _, ok := live[hash]; ok {
+			report.LiveBlobs++
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			log.Printf("gc: %s: %v", hash, err)
+			continue
+		}
+		if info.ModTime().After(cutoff) {
+			if hashRegex.MatchString(hash) {
+				report.RecentBlobs++
+			}
+			continue
+		}
+		if !hashRegex.MatchString(hash) {
+			// left behind by an interrupted upload
+			if !opts.dryRun {
+				os.Remove(filepath.Join(blobsDir, hash))
+			}
+			continue
+		}
+		if !opts.dryRun {
+			if err := os.Remove(s.blobPath(hash)); err != nil {
+				log.Printf("gc: removing %s: %v", hash, err)
+				continue
+			}
+		}
+		report.SweptBlobs++
+		report.ReclaimedBytes += info.Size()
+	}
+	return report, nil
+}
+
+// dropImage removes ref's index and its references. Callers must hold s.mu for writing.
+func (s *server) dropImage(ref string) error {
+	if err := os.Remove(s.imageLogPath(ref)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.images, ref)
+	delete(s.refs.Committed, ref)
+	delete(s.refs.Configs, ref)
+	if name := imageName(ref); s.refs.Tags[name] == ref {
+		delete(s.refs.Tags, name)
+	}
+	return s.saveRefs()
+}
+
+// handleGC collects garbage for admins.
+//
+//	POST /gc?dry_run=true  reports what would be removed and the bytes it would free
+//	POST /gc?prune=true    also removes images that are no longer the latest of their name
+//	POST /gc?grace=30m     spares what is newer than this (default 1h)
+func (s *server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requestUser(r).Admin {
+		http.Error(w, "only admins can collect garbage", http.StatusForbidden)
+		return
+	}
+	opts := gcOptions{grace: _gcGrace}
+	var err error
+	query := r.URL.Query()
+	if v := query.Get("dry_run"); v != "" {
+		if opts.dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid dry_run", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("prune"); v != "" {
+		if opts.prune, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid prune", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("grace"); v != "" {
+		if opts.grace, err = time.ParseDuration(v); err != nil || opts.grace < 0 {
+			http.Error(w, "invalid grace, want e.g. 30m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := s.collectGarbage(opts)
+	if err != nil {
+		log.Printf("gc: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("gc: dry run %v: pruned %d images, swept %d blobs (%d bytes), kept %d live and %d recent",
+		report.DryRun, len(report.PrunedImages), report.SweptBlobs, report.ReclaimedBytes, report.LiveBlobs, report.RecentBlobs)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultImage is the namespace used when a request names no image. It holds the
+// shared base tree that existed before per-image namespaces, and the scripts
+// uploaded by sway run.
+const defaultImage = ""
+
+const _imagesDir = "images"
+const _refsFile = "refs.json"
+
+// imageRefRegex matches references of the form name@digest, e.g. sway-myproject@3f2a9c1b7d4e.
+var imageRefRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+@[a-f0-9]+$`)
+
+func validImageRef(ref string) bool {
+	return ref == defaultImage || imageRefRegex.MatchString(ref)
+}
+
+func imageName(ref string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	return name
+}
+
+// image is the key index of one exported image. Blobs are shared between images,
+// so only metadata lives here. It is replayed from the image's log the first time the
+// image is used, so startup doesn't read every log.
+type image struct {
+	keydir           map[string]KeyValue            // file path to metadata; Value is never set
+	knownDirectories map[string]map[string]struct{} // directory path to set of child keys
+	load             sync.Once
+	err              error // why the log couldn't be replayed
+}
+
+func newImage() *image {
+	return &image{
+		keydir:           map[string]KeyValue{},
+		knownDirectories: map[string]map[string]struct{}{},
+	}
+}
+
+func (img *image) add(entry KeyValue) {
+	img.keydir[entry.Key] = entry
+	if entry.Parent != "" {
+		if _, ok := img.knownDirectories[entry.Parent]; !ok {
+			img.knownDirectories[entry.Parent] = map[string]struct{}{}
+		}
+		img.knownDirectories[entry.Parent][entry.Key] = struct{}{}
+	}
+}
+
+// loadedImage returns the index of ref, replaying its log the first time, and whether
+// there is one. An image whose log can't be replayed is left out until -reindex
+// recovers it. Callers must hold s.mu, for reading at least.
+func (s *server) loadedImage(ref string) (*image, bool) {
+	img, ok := s.images[ref]
+	if !ok || s.replay(ref, img) != nil {
+		return nil, false
+	}
+	return img, true
+}
+
+// image returns the index of ref to add entries to, creating it if needed. Callers must
+// hold s.mu exclusively.
+func (s *server) image(ref string) (*image, error) {
+	img, ok := s.images[ref]
+	if !ok {
+		img = newImage()
+		img.load.Do(func() {}) // there is no log yet
+		s.images[ref] = img
+	}
+	return img, s.replay(ref, img)
+}
+
+// replay loads the log of ref into img once.
+func (s *server) replay(ref string, img *image) error {
+	img.load.Do(func() {
+		img.err = s.loadImageLog(ref, img)
+		if img.err != nil {
+			log.Printf("loadImages: skipping image %q: %v; start with -reindex to recover it", ref, img.err)
+		}
+	})
+	return img.err
+}
+
+// imageRefs is persisted in images/refs.json.
+type imageRefs struct {
+	Tags      map[string]string `json:"tags"`      // image name to the most recently committed reference
+	Committed map[string]bool   `json:"committed"` // committed references can no longer be uploaded to
+	// image reference to the runtime config (CMD, ENTRYPOINT, ENV, WORKDIR, USER) sent
+	// with its commit. The server stores it as is.
+	Configs map[string]json.RawMessage `json:"configs,omitempty"`
+	// image name to the user who first uploaded to it; only they and admins can
+	// upload to or commit the name's references
+	Owners map[string]string `json:"owners,omitempty"`
+}
+
+type ImageInfo struct {
+	Name   string          `json:"name"`
+	Ref    string          `json:"ref"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+func (s *server) imageLogPath(ref string) string {
+	name := ref
+	if ref == defaultImage {
+		name = "default"
+	}
+	return filepath.Join(s.dirName, _imagesDir, name+".log")
+}
+
+// appendImageLog appends entries to the image's log, which is replayed when the image
+// is first used. The batch is one JSON array on one line, written with a single write and
+// synced before returning, so after a crash the log holds either all of it or a cut-off
+// last line that loadImageLog drops. Callers must hold s.mu exclusively so appends
+// don't interleave, replay the log with image before appending to it, and apply
+// entries to the in-memory index only once this succeeds.
+func (s *server) appendImageLog(ref string, entries []KeyValue) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	record, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("encoding image log: %w", err)
+	}
+	f, err := os.OpenFile(s.imageLogPath(ref), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening image log: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("opening image log: %w", err)
+	}
+
+	if _, err := f.Write(append(record, '\n')); err != nil {
+		// don't leave half a batch for the next append to follow
+		f.Truncate(info.Size())
+		return fmt.Errorf("writing image log: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("writing image log: %w", err)
+	}
+	return nil
+}
+
+// decodeLogRecord decodes one line of an image log: a JSON array of the entries of a
+// batch, or a single entry as written by older servers.
+func decodeLogRecord(line []byte) ([]KeyValue, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) > 0 && line[0] == '[' {
+		var entries []KeyValue
+		err := json.Unmarshal(line, &entries)
+		return entries, err
+	}
+	var entry KeyValue
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, err
+	}
+	return []KeyValue{entry}, nil
+}
+
+// loadImages lists the image logs, which are replayed when each image is first used,
+// and reads the committed references.
+func (s *server) loadImages() error {
+	dir := filepath.Join(s.dirName, _imagesDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading dir %s: %w", dir, err)
+	}
+	for _, de := range entries {
+		name, isLog := strings.CutSuffix(de.Name(), ".log")
+		if de.IsDir() || !isLog {
+			continue
+		}
+		ref := name
+		if name == "default" {
+			ref = defaultImage
+		}
+		s.images[ref] = newImage()
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, _refsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", _refsFile, err)
+	}
+	if err := json.Unmarshal(content, &s.refs); err != nil {
+		return fmt.Errorf("decoding %s: %w", _refsFile, err)
+	}
+	if s.refs.Tags == nil {
+		s.refs.Tags = map[string]string{}
+	}
+	if s.refs.Committed == nil {
+		s.refs.Committed = map[string]bool{}
+	}
+	if s.refs.Configs == nil {
+		s.refs.Configs = map[string]json.RawMessage{}
+	}
+	if s.refs.Owners == nil {
+		s.refs.Owners = map[string]string{}
+	}
+	return nil
+}
+
+// canWrite reports whether u may upload to or commit ref. The default image is shared
+// by everyone, so only admins can change it. Other images belong to whoever uploaded
+// to their name first. Callers must hold s.mu.
+func (s *server) canWrite(u user, ref string) bool {
+	if u.Admin {
+		return true
+	}
+	if ref == defaultImage {
+		return false
+	}
+	owner, ok := s.refs.Owners[imageName(ref)]
+	return !ok || owner == u.Name
+}
+
+// claim makes u the owner of ref's name if it has none yet. Callers must hold s.mu
+// for writing.
+func (s *server) claim(u user, ref string) error {
+	name := imageName(ref)
+	if ref == defaultImage || u.Name == "" || s.refs.Owners[name] != "" {
+		return nil
+	}
+	s.refs.Owners[name] = u.Name
+	return s.saveRefs()
+}
+
+// loadImageLog replays the log of ref into img. A last line a crash cut off is dropped
+// from the log; a broken line before it fails the whole image, which -reindex recovers.
+func (s *server) loadImageLog(ref string, img *image) error {
+	f, err := os.OpenFile(s.imageLogPath(ref), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64 // offset of the end of the last complete record
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				// the last append was cut off before its newline
+				return s.truncateImageLog(f, ref, good)
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading line %d: %w", n, err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			entries, err := decodeLogRecord(line)
+			if err != nil {
+				if _, peekErr := r.Peek(1); peekErr == io.EOF {
+					// a crash can also leave garbage after the last record
+					return s.truncateImageLog(f, ref, good)
+				}
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			for _, entry := range entries {
+				img.add(entry)
+			}
+		}
+		good += int64(len(line))
+	}
+	log.Printf("loadImages: loaded image %q, %d keys", ref, len(img.keydir))
+	return nil
+}
+
+// truncateImageLog drops what follows the last complete record of ref's log; the
+// records before it are already replayed.
+func (s *server) truncateImageLog(f *os.File, ref string, size int64) error {
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("dropping incomplete last batch: %w", err)
+	}
+	log.Printf("loadImages: dropped the incomplete last batch of image %q", ref)
+	return nil
+}
+
+func (s *server) saveRefs() error {
+	data, err := json.Marshal(s.refs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dirName, _imagesDir, _refsFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// handleImages resolves and commits image references.
+//
+//	GET  /images?name=<name>  returns the latest committed reference for name
+//	GET  /images?ref=<ref>    returns the committed reference ref
+//	GET  /images              lists every image name and its latest reference
+//	POST /images?ref=<ref>    commits ref, making it immutable and the latest for its name.
+//	                          The body, if any, is the image config as JSON.
+//
+// Single-image answers include the image config.
+func (s *server) handleImages(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("name")
+		ref := r.URL.Query().Get("ref")
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if name != "" || ref != "" {
+			if ref == "" {
+				ref = s.refs.Tags[name]
+			}
+			if !s.refs.Committed[ref] {
+				http.Error(w, "Image not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ImageInfo{Name: imageName(ref), Ref: ref, Config: s.refs.Configs[ref]})
+			return
+		}
+		infos := make([]ImageInfo, 0, len(s.refs.Tags))
+		for name, ref := range s.refs.Tags {
+			infos = append(infos, ImageInfo{Name: name, Ref: ref})
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+
+	case http.MethodPost:
+		ref := r.URL.Query().Get("ref")
+		if ref == defaultImage || !validImageRef(ref) {
+			http.Error(w, "invalid image reference", http.StatusBadRequest)
+			return
+		}
+		config, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		if len(config) > 0 && !json.Valid(config) {
+			http.Error(w, "invalid image config", http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if !s.canWrite(requestUser(r), ref) {
+			http.Error(w, "image "+imageName(ref)+" belongs to another user", http.StatusForbidden)
+			return
+		}
+		if _, ok := s.loadedImage(ref); !ok {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		s.refs.Tags[imageName(ref)] = ref
+		s.refs.Committed[ref] = true
+		if len(config) > 0 {
+			s.refs.Configs[ref] = config
+		}
+		if err := s.saveRefs(); err != nil {
+			log.Printf("failed to save refs: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("committed image %s", ref)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ImageInfo{Name: imageName(ref), Ref: ref})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
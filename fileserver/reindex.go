@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// _reindexBatch is how many entries reindex writes per log record.
+const _reindexBatch = 1000
+
+// reindexReport says what reindex found.
+type reindexReport struct {
+	Images       int  // image logs rewritten
+	Entries      int  // entries kept
+	BadRecords   int  // log lines that couldn't be read
+	MissingBlobs int  // entries dropped because their content is gone
+	RebuiltRefs  bool // refs.json couldn't be read and was rebuilt from the logs
+}
+
+// reindex recovers the index of the store in dirName when it is corrupt. Every image
+// log is read skipping lines that can't be decoded, entries whose content is no longer
+// in blobs/ are dropped, and the log is rewritten with only the latest entry of each
+// key. refs.json is checked against the logs, and rebuilt from them if it can't be
+// read. The server must not be running on dirName.
+func reindex(dirName string) (reindexReport, error) {
+	var report reindexReport
+	imagesDir := filepath.Join(dirName, _imagesDir)
+	if _, err := os.Stat(imagesDir); os.IsNotExist(err) {
+		// nothing to recover; buildIndex migrates stores from before images
+		return report, nil
+	}
+
+	blobs := map[string]struct{}{}
+	des, err := os.ReadDir(filepath.Join(dirName, _blobsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	for _, de := range des {
+		if hashRegex.MatchString(de.Name()) {
+			blobs[de.Name()] = struct{}{}
+		}
+	}
+
+	des, err = os.ReadDir(imagesDir)
+	if err != nil {
+		return report, err
+	}
+	logs := map[string]os.FileInfo{} // image reference to its log
+	for _, de := range des {
+		name, isLog := strings.CutSuffix(de.Name(), ".log")
+		if de.IsDir() || !isLog {
+			continue
+		}
+		path := filepath.Join(imagesDir, de.Name())
+		kept, err := rewriteImageLog(path, blobs, &report)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", de.Name(), err)
+		}
+		report.Images++
+		report.Entries += kept
+		ref := name
+		if name == "default" {
+			ref = defaultImage
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return report, err
+		}
+		logs[ref] = info
+	}
+
+	refs, err := reindexRefs(imagesDir, logs, &report)
+	if err != nil {
+		return report, err
+	}
+	data, err := json.Marshal(refs)
+	if err != nil {
+		return report, err
+	}
+	path := filepath.Join(imagesDir, _refsFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return report, err
+	}
+	return report, os.Rename(path+".tmp", path)
+}
+
+// rewriteImageLog compacts the log at path, keeping what can be read, and returns how
+// many entries it kept.
+func rewriteImageLog(path string, blobs map[string]struct{}, report *reindexReport) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	latest := map[string]KeyValue{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			entries, decodeErr := decodeLogRecord(line)
+			if decodeErr != nil {
+				report.BadRecords++
+			}
+			for _, entry := range entries {
+				latest[entry.Key] = entry
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for key, entry := range latest {
+		_, stored := blobs[entry.HashValue]
+		if !entry.IsDir && entry.LinkTarget == "" && !stored {
+			report.MissingBlobs++
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(tmp)
+	for start := 0; start < len(keys); start += _reindexBatch {
+		batch := make([]KeyValue, 0, _reindexBatch)
+		for _, key := range keys[start:min(start+_reindexBatch, len(keys))] {
+			batch = append(batch, latest[key])
+		}
+		record, err := json.Marshal(batch)
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		w.Write(append(record, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return 0, err
+	}
+	// garbage collection and rebuilding refs.json go by when the image was written
+	return len(keys), os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// reindexRefs returns refs.json with every reference that has no log left dropped. If
+// refs.json can't be read, it is kept as refs.json.corrupt and rebuilt: every image is
+// taken as committed, and the one with the newest log as the latest of its name.
+// Image configs and owners can't be recovered that way.
+func reindexRefs(imagesDir string, logs map[string]os.FileInfo, report *reindexReport) (imageRefs, error) {
+	refs := imageRefs{}
+	path := filepath.Join(imagesDir, _refsFile)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return refs, err
+	}
+	if err == nil && json.Unmarshal(data, &refs) != nil {
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return refs, err
+		}
+		refs = imageRefs{}
+		report.RebuiltRefs = true
+	}
+	if refs.Tags == nil {
+		refs.Tags = map[string]string{}
+	}
+	if refs.Committed == nil {
+		refs.Committed = map[string]bool{}
+	}
+	if refs.Configs == nil {
+		refs.Configs = map[string]json.RawMessage{}
+	}
+	if refs.Owners == nil {
+		refs.Owners = map[string]string{}
+	}
+
+	if report.RebuiltRefs {
+		for ref, info := range logs {
+			if ref == defaultImage {
+				continue
+			}
+			refs.Committed[ref] = true
+			name := imageName(ref)
+			if tagged, ok := refs.Tags[name]; !ok || info.ModTime().After(logs[tagged].ModTime()) {
+				refs.Tags[name] = ref
+			}
+		}
+		log.Printf("reindex: %s was unreadable, rebuilt it from the image logs; image configs and owners are lost", _refsFile)
+	}
+
+	for ref := range refs.Committed {
+		if _, ok := logs[ref]; !ok {
+			delete(refs.Committed, ref)
+			delete(refs.Configs, ref)
+		}
+	}
+	for name, ref := range refs.Tags {
+		if _, ok := logs[ref]; !ok {
+			delete(refs.Tags, name)
+		}
+	}
+	return refs, nil
+}
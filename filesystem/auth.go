@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tokens file lists who may run containers, one user per line, in the same format
+// as the fileserver's, whose -issue-token prints lines to copy here:
+//
+//	# username sha256-of-token [admin]
+//	alice 2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+//
+// Admins can see and cancel everyone's runs.
+const _defaultTokensFile = "tokens"
+
+// user is who sent a request.
+type user struct {
+	Name  string
+	Admin bool
+}
+
+// tokenStore checks API tokens against the tokens file. The file is read again when
+// it changes, so users can be added or revoked without a restart.
+type tokenStore struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]user // token hash to its user
+}
+
+func newTokenStore(path string) (*tokenStore, error) {
+	t := &tokenStore{path: path}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// reload reads the tokens file if it changed since it was last read. Callers must
+// hold t.mu or own t.
+func (t *tokenStore) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(t.modTime) && t.users != nil {
+		return nil
+	}
+	users, err := readTokens(t.path)
+	if err != nil {
+		return err
+	}
+	t.users = users
+	t.modTime = info.ModTime()
+	return nil
+}
+
+// readTokens parses the tokens file at path. The fileserver has the same function;
+// both are tested against testdata/tokens, so they agree on which tokens are valid.
+func readTokens(path string) (map[string]user, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]user{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "admin") {
+			return nil, fmt.Errorf("%s:%d: want \"username sha256 [admin]\"", path, n)
+		}
+		users[strings.ToLower(fields[1])] = user{Name: fields[0], Admin: len(fields) == 3}
+	}
+	return users, scanner.Err()
+}
+
+// lookup returns the user token belongs to.
+func (t *tokenStore) lookup(token string) (user, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.reload(); err != nil {
+		// keep serving with the tokens we have
+		log.Printf("reloading %s: %v", t.path, err)
+	}
+	u, ok := t.users[hashToken(token)]
+	return u, ok
+}
+
+type userKey struct{}
+
+// requireToken lets requests through to next only with a valid
+// "Authorization: Bearer <token>" header, and tells next who sent them.
+func (t *tokenStore) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sway"`)
+			http.Error(w, "missing API token", http.StatusUnauthorized)
+			return
+		}
+		u, ok := t.lookup(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sway"`)
+			http.Error(w, "invalid API token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	}
+}
+
+// requestUser returns who sent r, and false if the worker runs without authentication.
+func requestUser(r *http.Request) (user, bool) {
+	u, ok := r.Context().Value(userKey{}).(user)
+	return u, ok
+}
+
+// canSee reports whether the sender of r may look at or cancel a run of owner.
+func canSee(r *http.Request, owner string) bool {
+	u, ok := requestUser(r)
+	return !ok || u.Admin || u.Name == owner
+}
+
+// tokenTransport sends the worker's own token to the fileserver with every request.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lastnameswayne/tinycontainer/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_requireToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(path, []byte("# worker tokens\nalice "+hashToken("sway_alice")+"\nroot "+hashToken("sway_root")+" admin\n"), 0600))
+	tokens, err := newTokenStore(path)
+	require.NoError(t, err)
+
+	var got user
+	handler := tokens.requireToken(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = requestUser(r)
+	})
+	do := func(header string) int {
+		req := httptest.NewRequest(http.MethodPost, "/runs", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(""))
+	assert.Equal(t, http.StatusUnauthorized, do("Bearer sway_mallory"))
+	assert.Equal(t, http.StatusUnauthorized, do("Basic sway_alice"))
+
+	assert.Equal(t, http.StatusOK, do("Bearer sway_alice"))
+	assert.Equal(t, user{Name: "alice"}, got)
+	assert.Equal(t, http.StatusOK, do("Bearer sway_root"))
+	assert.Equal(t, user{Name: "root", Admin: true}, got)
+
+	// revoking alice takes effect without a restart
+	require.NoError(t, os.WriteFile(path, []byte("root "+hashToken("sway_root")+" admin\n"), 0600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+	assert.Equal(t, http.StatusUnauthorized, do("Bearer sway_alice"))
+
+	require.NoError(t, os.WriteFile(path, []byte("alice\n"), 0600))
+	_, err = newTokenStore(path)
+	assert.Error(t, err)
+}
+
+func Test_runOwnership(t *testing.T) {
+	require.NoError(t, db.Init(filepath.Join(t.TempDir(), "runs.db")))
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = nil
+	})
+	path := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(path, []byte("alice "+hashToken("sway_alice")+"\nbob "+hashToken("sway_bob")+"\nroot "+hashToken("sway_root")+" admin\n"), 0600))
+	tokens, err := newTokenStore(path)
+	require.NoError(t, err)
+
+	fs := &FS{jobs: make(map[int64]*runJob)}
+	fs.queue = newRunQueue(0, scheduleFIFO, func(*runJob) {})
+	handler := http.NewServeMux()
+	handler.HandleFunc("GET /runs/{id}", tokens.requireToken(fs.GetRun))
+	handler.HandleFunc("/stats", tokens.requireToken(Stats))
+
+	finishedID, err := db.QueueRun("done.py", time.Now(), "alice", "{}", db.Limits{})
+	require.NoError(t, err)
+	require.NoError(t, db.FinishRun(finishedID, 10, "", "", 0, 0, 0, 0, db.StatusSucceeded, ""))
+
+	queuedID, err := db.QueueRun("eval.py", time.Now(), "alice", "{}", db.Limits{})
+	require.NoError(t, err)
+	queued := newRunJob(RunRequest{Username: "alice"}, "eval.py")
+	defer queued.cancel()
+	queued.id = queuedID
+	fs.jobs[queuedID] = queued
+	fs.queue.enqueue(queued)
+
+	get := func(id int64, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/runs/"+strconv.FormatInt(id, 10), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, id := range []int64{finishedID, queuedID} {
+		assert.Equal(t, http.StatusOK, get(id, "sway_alice"), "owner")
+		assert.Equal(t, http.StatusNotFound, get(id, "sway_bob"), "another user")
+		assert.Equal(t, http.StatusOK, get(id, "sway_root"), "admin")
+	}
+
+	stats := func(token string) []db.RunRecord {
+		req := httptest.NewRequest(http.MethodPost, "/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var runs []db.RunRecord
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &runs))
+		return runs
+	}
+	assert.Len(t, stats("sway_alice"), 2, "owner")
+	assert.Empty(t, stats("sway_bob"), "another user")
+	assert.Len(t, stats("sway_root"), 2, "admin")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "no token")
+}
+
+// The fileserver runs the same test: both read the tokens file format from the
+// repository's testdata, so they can't disagree on which tokens are valid.
+func Test_tokensFileFormat(t *testing.T) {
+	data, err := os.ReadFile("../testdata/tokens/valid.json")
+	require.NoError(t, err)
+	var want struct {
+		Tokens map[string]struct {
+			Name  string `json:"name"`
+			Admin bool   `json:"admin"`
+		} `json:"tokens"`
+		Unknown []string `json:"unknown"`
+	}
+	require.NoError(t, json.Unmarshal(data, &want))
+	require.NotEmpty(t, want.Tokens)
+
+	tokens, err := newTokenStore("../testdata/tokens/valid")
+	require.NoError(t, err)
+	assert.Len(t, tokens.users, len(want.Tokens))
+	for token, w := range want.Tokens {
+		u, ok := tokens.lookup(token)
+		assert.True(t, ok, token)
+		assert.Equal(t, user{Name: w.Name, Admin: w.Admin}, u, token)
+	}
+	for _, token := range want.Unknown {
+		_, ok := tokens.lookup(token)
+		assert.False(t, ok, token)
+	}
+
+	invalid, err := filepath.Glob("../testdata/tokens/invalid-*")
+	require.NoError(t, err)
+	require.NotEmpty(t, invalid)
+	for _, path := range invalid {
+		_, err := readTokens(path)
+		assert.Error(t, err, path)
+	}
+}
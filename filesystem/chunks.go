@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// _chunkSize is the unit file content is fetched from the fileserver and cached on
+// disk in. Reading one symbol out of a large shared library only pulls the chunks
+// around it instead of the whole file.
+const _chunkSize = 1 << 20
+
+func chunkPath(hash string, idx int64) string {
+	return filepath.Join(_cacheDir, fmt.Sprintf("%s.%d", hash, idx))
+}
+
+// chunkCall is an in-flight fetch of one chunk. Concurrent readers of the same chunk
+// (e.g. kernel readahead) wait for it instead of fetching it again.
+type chunkCall struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// readAt fills dest with the content of blob hash starting at offset. Chunks are read
+// from the disk cache, or fetched from the fileserver and cached.
+func (fs *FS) readAt(hash string, size int64, dest []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(dest) && offset+int64(n) < size {
+		pos := offset + int64(n)
+		idx := pos / _chunkSize
+		within := pos - idx*_chunkSize
+
+		read, err := readCachedChunk(chunkPath(hash, idx), dest[n:], within)
+		if err != nil {
+			data, err := fs.fetchChunk(hash, size, idx)
+			if err != nil {
+				return n, err
+			}
+			if within >= int64(len(data)) {
+				return n, fmt.Errorf("chunk %d of %s is short: %d bytes", idx, hash, len(data))
+			}
+			read = copy(dest[n:], data[within:])
+		}
+		n += read
+	}
+	return n, nil
+}
+
+// readCachedChunk reads from a chunk file in the disk cache without loading all of it.
+func readCachedChunk(path string, dest []byte, within int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(dest[:min(int64(len(dest)), _chunkSize-within)], within)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (fs *FS) fetchChunk(hash string, size, idx int64) ([]byte, error) {
+	path := chunkPath(hash, idx)
+
+	fs.chunksMu.Lock()
+	if call, ok := fs.chunksInFlight[path]; ok {
+		fs.chunksMu.Unlock()
+		call.wg.Wait()
+		return call.data, call.err
+	}
+	call := &chunkCall{}
+	call.wg.Add(1)
+	fs.chunksInFlight[path] = call
+	fs.chunksMu.Unlock()
+
+	start := idx * _chunkSize
+	end := min(start+_chunkSize, size) - 1
+	call.data, call.err = fs.fetchRange(hash, start, end)
+	if call.err == nil {
+		if err := writeCacheFile(path, bytes.NewReader(call.data)); err != nil {
+			log.Printf("error writing chunk to disk cache: %v", err)
+		}
+	}
+
+	fs.chunksMu.Lock()
+	delete(fs.chunksInFlight, path)
+	fs.chunksMu.Unlock()
+	call.wg.Done()
+	return call.data, call.err
+}
+
+// writeCacheFile copies r through a temp file so readers never see a partial file.
+func writeCacheFile(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -20,19 +21,9 @@ func getFileserverURL() string {
 
 var ErrNotFoundOnFileServer = fmt.Errorf("NOT FOUND ON FILESERVER")
 
-// listEntry is a lightweight entry for directory listings (no file content)
-type listEntry struct {
-	Key       string `json:"key"`
-	HashValue string `json:"hash_value"`
-	Name      string `json:"name"`
-	IsDir     bool   `json:"is_dir"`
-	Size      int64  `json:"size"`
-	Mode      int64  `json:"mode"`
-}
-
 // getContentsFromFileServer only gets the filenames and metadata - not the actual binary value of the files in the directory.
-func (d *Directory) getContentsFromFileServer() ([]listEntry, error) {
-	requestUrl := fmt.Sprintf("%s/fetch?filepath=%s/", d.rootFS.fileserverURL, url.QueryEscape(d.path))
+func (d *Directory) getContentsFromFileServer() ([]KeyValue, error) {
+	requestUrl := fmt.Sprintf("%s/fetch?image=%s&filepath=%s/", d.rootFS.fileserverURL, url.QueryEscape(d.view.image), url.QueryEscape(d.path))
 
 	req, err := http.NewRequest("GET", requestUrl, nil)
 	if err != nil {
@@ -57,25 +48,16 @@ func (d *Directory) getContentsFromFileServer() ([]listEntry, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
 		return nil, fmt.Errorf("error decoding response: %w", err)
 	}
-
-	// Convert KeyValue to ListEntry
-	result := make([]listEntry, len(entries))
-	for i, e := range entries {
-		result[i] = listEntry{
-			Key:       e.Key,
-			HashValue: e.HashValue,
-			Name:      e.Name,
-			IsDir:     e.IsDir,
-			Size:      e.Size,
-			Mode:      e.Mode,
-		}
-	}
-	return result, nil
+	return entries, nil
 }
 
 func (d *Directory) getEntryFromFileServer(name string) (KeyValue, error) {
-	path := d.path
-	requestUrl := fmt.Sprintf("%s/fetch?filepath=%s", d.rootFS.fileserverURL, url.QueryEscape(path+"/"+name))
+	return d.rootFS.fetchEntry(d.view.image, d.path+"/"+name)
+}
+
+// fetchEntry fetches the metadata of a single entry from the given image.
+func (fs *FS) fetchEntry(image, key string) (KeyValue, error) {
+	requestUrl := fmt.Sprintf("%s/fetch?image=%s&filepath=%s", fs.fileserverURL, url.QueryEscape(image), url.QueryEscape(key))
 	log.Printf("fetching %s", requestUrl)
 
 	req, err := http.NewRequest("GET", requestUrl, nil)
@@ -83,7 +65,7 @@ func (d *Directory) getEntryFromFileServer(name string) (KeyValue, error) {
 		return KeyValue{}, fmt.Errorf("error creating request: %w", err)
 	}
 
-	resp, err := d.rootFS.client.Do(req)
+	resp, err := fs.client.Do(req)
 	if err != nil {
 		return KeyValue{}, fmt.Errorf("error sending request: %w", err)
 	}
@@ -104,3 +86,107 @@ func (d *Directory) getEntryFromFileServer(name string) (KeyValue, error) {
 
 	return entry, nil
 }
+
+// getBlob starts a GET of the whole blob with the given hash. The caller must close
+// the body.
+func (fs *FS) getBlob(hash string) (io.ReadCloser, error) {
+	requestUrl := fmt.Sprintf("%s/blobs/%s", fs.fileserverURL, hash)
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFoundOnFileServer
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+// fetchBlob fetches the whole content of the blob with the given hash into memory.
+func (fs *FS) fetchBlob(hash string) ([]byte, error) {
+	body, err := fs.getBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// fetchRange fetches bytes start..end (inclusive) of the blob with the given hash.
+func (fs *FS) fetchRange(hash string, start, end int64) ([]byte, error) {
+	requestUrl := fmt.Sprintf("%s/blobs/%s", fs.fileserverURL, hash)
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return io.ReadAll(resp.Body)
+	case http.StatusOK:
+		// the server ignored the range and sent the whole blob
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if start >= int64(len(data)) {
+			return nil, fmt.Errorf("range %d-%d outside blob of %d bytes", start, end, len(data))
+		}
+		return data[start:min(end+1, int64(len(data)))], nil
+	case http.StatusNotFound:
+		return nil, ErrNotFoundOnFileServer
+	default:
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+// fetchImageConfig fetches the runtime config that was committed with image. The
+// default image has none.
+func (fs *FS) fetchImageConfig(image string) (ImageConfig, error) {
+	if image == defaultImage {
+		return ImageConfig{}, nil
+	}
+	requestUrl := fmt.Sprintf("%s/images?ref=%s", fs.fileserverURL, url.QueryEscape(image))
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := fs.client.Do(req)
+	if err != nil {
+		return ImageConfig{}, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ImageConfig{}, ErrNotFoundOnFileServer
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ImageConfig{}, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var info struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return ImageConfig{}, fmt.Errorf("error decoding response: %w", err)
+	}
+	return info.Config, nil
+}
@@ -9,6 +9,16 @@ import (
 
 var DB *sql.DB
 
+// Run statuses. Rows from before statuses existed get succeeded or failed from their
+// exit code.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
 func Init(path string) error {
 	var err error
 	DB, err = sql.Open("sqlite", path)
@@ -28,20 +38,93 @@ func Init(path string) error {
 			memory_cache_hits INTEGER,
 			disk_cache_hits INTEGER,
 			server_fetches INTEGER,
-			username TEXT
+			username TEXT,
+			status TEXT,
+			error TEXT,
+			request TEXT,
+			memory_limit INTEGER,
+			cpu_limit REAL,
+			pids_limit INTEGER,
+			timeout_ms INTEGER
 		)
 	`)
+	if err != nil {
+		return err
+	}
+	if err := migrate(); err != nil {
+		return err
+	}
+
+	// nothing is running right after a restart; runs the worker was in the middle of are
+	// lost. Queued runs are picked up again with QueuedRuns.
+	_, err = DB.Exec(`UPDATE runs SET status = ?, error = ? WHERE status = ?`,
+		StatusFailed, "worker restarted before the run finished", StatusRunning)
 	return err
 }
 
-func LogRun(filename string, startedAt time.Time, durationMs int64,
-	stdout, stderr string, exitCode int,
-	memoryHits, diskHits, serverFetches int64, username string) (int64, error) {
+// migrate adds the columns that databases created by older workers lack.
+func migrate() error {
+	rows, err := DB.Query(`SELECT name FROM pragma_table_info('runs')`)
+	if err != nil {
+		return err
+	}
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if !columns["status"] {
+		if _, err := DB.Exec(`ALTER TABLE runs ADD COLUMN status TEXT`); err != nil {
+			return err
+		}
+		_, err := DB.Exec(`UPDATE runs SET status = CASE WHEN exit_code = 0 THEN ? ELSE ? END`, StatusSucceeded, StatusFailed)
+		if err != nil {
+			return err
+		}
+	}
+	added := []struct{ name, typ string }{
+		{"error", "TEXT"},
+		{"request", "TEXT"},
+		{"memory_limit", "INTEGER"},
+		{"cpu_limit", "REAL"},
+		{"pids_limit", "INTEGER"},
+		{"timeout_ms", "INTEGER"},
+	}
+	for _, column := range added {
+		if columns[column.name] {
+			continue
+		}
+		if _, err := DB.Exec(`ALTER TABLE runs ADD COLUMN ` + column.name + ` ` + column.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Limits are the resource limits a run was given.
+type Limits struct {
+	MemoryLimit int64   `json:"memory_limit"` // bytes
+	CPULimit    float64 `json:"cpu_limit"`    // cores
+	PidsLimit   int64   `json:"pids_limit"`
+	TimeoutMs   int64   `json:"timeout_ms"`
+}
 
+// QueueRun records a run waiting for a free slot on the worker and returns its ID.
+// request is kept so the run can be started after a restart.
+func QueueRun(filename string, queuedAt time.Time, username, request string, limits Limits) (int64, error) {
 	res, err := DB.Exec(`
-		INSERT INTO runs (filename, started_at, duration_ms, stdout, stderr, exit_code, memory_cache_hits, disk_cache_hits, server_fetches, username)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, filename, startedAt, durationMs, stdout, stderr, exitCode, memoryHits, diskHits, serverFetches, username)
+		INSERT INTO runs (filename, started_at, duration_ms, exit_code, username, status, request, memory_limit, cpu_limit, pids_limit, timeout_ms)
+		VALUES (?, ?, 0, 0, ?, ?, ?, ?, ?, ?, ?)
+	`, filename, queuedAt, username, StatusQueued, request, limits.MemoryLimit, limits.CPULimit, limits.PidsLimit, limits.TimeoutMs)
 	if err != nil {
 		return 0, err
 	}
@@ -49,6 +132,54 @@ func LogRun(filename string, startedAt time.Time, durationMs int64,
 	return res.LastInsertId()
 }
 
+// StartRun records that queued run id has started, running filename. Its request is
+// no longer needed.
+func StartRun(id int64, filename string, startedAt time.Time) error {
+	_, err := DB.Exec(`UPDATE runs SET filename = ?, started_at = ?, status = ?, request = NULL WHERE id = ?`,
+		filename, startedAt, StatusRunning, id)
+	return err
+}
+
+// QueuedRun is a run still waiting to start, as recorded by QueueRun.
+type QueuedRun struct {
+	ID       int64
+	Filename string
+	QueuedAt time.Time
+	Username string
+	Request  string
+}
+
+// QueuedRuns returns the runs still waiting to start, oldest first.
+func QueuedRuns() ([]QueuedRun, error) {
+	rows, err := DB.Query(`SELECT id, filename, started_at, COALESCE(username, ''), COALESCE(request, '') FROM runs WHERE status = ? ORDER BY id`, StatusQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []QueuedRun
+	for rows.Next() {
+		var r QueuedRun
+		if err := rows.Scan(&r.ID, &r.Filename, &r.QueuedAt, &r.Username, &r.Request); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// FinishRun records the outcome of run id.
+func FinishRun(id int64, durationMs int64,
+	stdout, stderr string, exitCode int,
+	memoryHits, diskHits, serverFetches int64, status, errMsg string) error {
+
+	_, err := DB.Exec(`
+		UPDATE runs SET duration_ms = ?, stdout = ?, stderr = ?, exit_code = ?, memory_cache_hits = ?, disk_cache_hits = ?, server_fetches = ?, status = ?, error = ?, request = NULL
+		WHERE id = ?
+	`, durationMs, stdout, stderr, exitCode, memoryHits, diskHits, serverFetches, status, errMsg, id)
+	return err
+}
+
 type RunRecord struct {
 	ID              int64     `json:"id"`
 	Filename        string    `json:"filename"`
@@ -61,10 +192,26 @@ type RunRecord struct {
 	DiskCacheHits   int64     `json:"disk_cache_hits"`
 	ServerFetches   int64     `json:"server_fetches"`
 	Username        string    `json:"username"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	Limits
+}
+
+const _runColumns = "id, filename, started_at, duration_ms, COALESCE(stdout, ''), COALESCE(stderr, ''), exit_code, COALESCE(memory_cache_hits, 0), COALESCE(disk_cache_hits, 0), COALESCE(server_fetches, 0), COALESCE(username, ''), COALESCE(status, ''), COALESCE(error, ''), COALESCE(memory_limit, 0), COALESCE(cpu_limit, 0), COALESCE(pids_limit, 0), COALESCE(timeout_ms, 0)"
+
+func scanRun(row interface{ Scan(...any) error }) (RunRecord, error) {
+	var r RunRecord
+	err := row.Scan(&r.ID, &r.Filename, &r.StartedAt, &r.DurationMs, &r.Stdout, &r.Stderr, &r.ExitCode, &r.MemoryCacheHits, &r.DiskCacheHits, &r.ServerFetches, &r.Username, &r.Status, &r.Error, &r.MemoryLimit, &r.CPULimit, &r.PidsLimit, &r.TimeoutMs)
+	return r, err
+}
+
+// GetRun returns run id, or sql.ErrNoRows if there is none.
+func GetRun(id int64) (RunRecord, error) {
+	return scanRun(DB.QueryRow("SELECT "+_runColumns+" FROM runs WHERE id = ?", id))
 }
 
 func GetAllRuns() ([]RunRecord, error) {
-	rows, err := DB.Query("SELECT id, filename, started_at, duration_ms, stdout, stderr, exit_code, memory_cache_hits, disk_cache_hits, server_fetches, username FROM runs ORDER BY id DESC")
+	rows, err := DB.Query("SELECT " + _runColumns + " FROM runs ORDER BY id DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -72,8 +219,8 @@ func GetAllRuns() ([]RunRecord, error) {
 
 	var runs []RunRecord
 	for rows.Next() {
-		var r RunRecord
-		if err := rows.Scan(&r.ID, &r.Filename, &r.StartedAt, &r.DurationMs, &r.Stdout, &r.Stderr, &r.ExitCode, &r.MemoryCacheHits, &r.DiskCacheHits, &r.ServerFetches, &r.Username); err != nil {
+		r, err := scanRun(rows)
+		if err != nil {
 			return nil, err
 		}
 		runs = append(runs, r)
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"hash/fnv"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -18,18 +18,70 @@ import (
 type Directory struct {
 	fusefs.Inode
 	mu       sync.RWMutex
-	keyDir   map[string]cachedMetadata
 	attr     fuse.Attr
 	path     string
+	view     *view // the mounted copy of the image this directory belongs to
 	rootFS   *FS
 	parent   *Directory
 	children map[string]*Directory // directory name to object
 }
 
 type cachedMetadata struct {
-	hash string
-	mode int64
-	size int64
+	isDir      bool
+	hash       string
+	mode       int64 // permission and setuid/setgid/sticky bits
+	size       int64
+	uid        uint32
+	gid        uint32
+	mtime      int64
+	nlink      uint32
+	hardLink   string // key shared by every path of a hard-link group
+	linkTarget string // set for symlinks
+}
+
+// entryMetadata keeps the parts of a fileserver entry needed to recreate its inode.
+func entryMetadata(entry KeyValue) cachedMetadata {
+	return cachedMetadata{
+		isDir:      entry.IsDir,
+		hash:       entry.HashValue,
+		mode:       entry.Mode,
+		size:       entry.Size,
+		uid:        uint32(entry.Uid),
+		gid:        uint32(entry.Gid),
+		mtime:      entry.ModTime,
+		nlink:      uint32(entry.Nlink),
+		hardLink:   entry.HardLink,
+		linkTarget: entry.LinkTarget,
+	}
+}
+
+// attr returns the attributes reported to the kernel. The file type bits come from
+// the inode, so only permission and setuid/setgid/sticky bits are kept from mode.
+func (m cachedMetadata) attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  uint32(m.mode) & 07777,
+		Size:  uint64(m.size),
+		Mtime: uint64(m.mtime),
+		Ctime: uint64(m.mtime),
+		Nlink: max(m.nlink, 1),
+		Owner: fuse.Owner{Uid: m.uid, Gid: m.gid},
+	}
+}
+
+// stableAttr gives every path of a hard-link group the same inode number, so the
+// kernel sees them as one file. Other files get an automatic inode number.
+func (d *Directory) stableAttr(m cachedMetadata) fusefs.StableAttr {
+	if m.hardLink == "" {
+		return fusefs.StableAttr{Ino: 0}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(d.view.name + ":" + m.hardLink))
+	// stay below the automatic inode numbers, which start at 1<<63; 1 is the root
+	ino := h.Sum64() >> 1
+	if ino <= 1 {
+		ino += 2
+	}
+	return fusefs.StableAttr{Ino: ino}
 }
 
 var _ = (fusefs.NodeReaddirer)((*Directory)(nil))
@@ -68,27 +120,34 @@ func (d *Directory) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errn
 	return fusefs.NewListDirStream(all), 0
 }
 
-// fetchServerEntries fetches directory entries from the fileserver and registers
-// them as children. Acquires d.mu exclusively for the duration of child registration.
+// fetchServerEntries fetches directory entries from the fileserver, unless another
+// view of the image already has, and registers them as children. Acquires d.mu
+// exclusively for the duration of child registration.
 func (d *Directory) fetchServerEntries(ctx context.Context) ([]fuse.DirEntry, error) {
-	fileEntries, err := d.getContentsFromFileServer()
-	if err != nil {
-		return nil, err
+	fileEntries, ok := d.view.meta.listing(d.path)
+	if !ok {
+		var err error
+		if fileEntries, err = d.getContentsFromFileServer(); err != nil {
+			return nil, err
+		}
+		d.view.meta.addListing(d.path, fileEntries)
 	}
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	out := make([]fuse.DirEntry, 0, len(fileEntries))
 	for _, entry := range fileEntries {
-		if entry.IsDir {
-			d.addDirChild(ctx, entry.Name)
-		} else {
-			f := &file{
-				path: filepath.Join(_cacheDir, entry.HashValue),
-				attr: fuse.Attr{Mode: uint32(entry.Mode), Size: uint64(entry.Size)},
-			}
-			d.addFileChild(ctx, entry.Name, entry.HashValue, f)
+		metadata := entryMetadata(entry)
+		switch {
+		case entry.IsDir:
+			d.addDirChild(ctx, entry.Name, metadata)
+			out = append(out, fuse.DirEntry{Name: entry.Name, Mode: fuse.S_IFDIR})
+		case entry.LinkTarget != "":
+			d.addSymlinkChild(ctx, entry.Name, metadata)
+			out = append(out, fuse.DirEntry{Name: entry.Name, Mode: fuse.S_IFLNK})
+		default:
+			inode := d.addFileChild(ctx, entry.Name, metadata)
+			out = append(out, fuse.DirEntry{Name: entry.Name, Mode: fuse.S_IFREG, Ino: inode.StableAttr().Ino})
 		}
-		out = append(out, fuse.DirEntry{Name: entry.Name, Mode: uint32(entry.Mode)})
 	}
 	return out, nil
 }
@@ -96,7 +155,7 @@ func (d *Directory) fetchServerEntries(ctx context.Context) ([]fuse.DirEntry, er
 func (d *Directory) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
 	key := filepath.Join(d.path, name)
 	// Check if directory/file is known to be not found
-	if d.rootFS.isNotFound(key) {
+	if d.view.isNotFound(key) {
 		return nil, syscall.ENOENT
 	}
 	// Skip Python temp files - they'll never exist on server
@@ -104,7 +163,9 @@ func (d *Directory) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 		return nil, syscall.ENOENT
 	}
 	// We can't cache the user's runscript, as it might change! Needs to be fetched fresh.
-	if isScript(name) {
+	// Uploaded scripts only live at the root, so files deeper in the tree that look
+	// like one are served from the image.
+	if d.parent == nil && d.view.scripts && isScript(name) {
 		return d.scriptFromFileserver(ctx, name, out)
 	}
 
@@ -112,13 +173,13 @@ func (d *Directory) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	d.mu.RLock()
 	if childDir, found := d.children[name]; found {
 		d.mu.RUnlock()
-		LookupStats.MemoryCacheHits.Add(1)
+		d.view.stats.MemoryCacheHits.Add(1)
 		return &childDir.Inode, 0
 	}
 	d.mu.RUnlock()
 
-	// Directory/File is on the disk
-	if inode, ok := d.fromDiskCache(ctx, name, key, out); ok {
+	// Metadata is already known from a directory listing or an earlier lookup
+	if inode, ok := d.fromMetadata(ctx, name, key, out); ok {
 		return inode, 0
 	}
 
@@ -126,141 +187,143 @@ func (d *Directory) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	return d.fromFileServer(ctx, name, key, out)
 }
 
-// fromFileServer fetches a single entry from the fileserver and registers it as a child.
-// For directories: acquires d.mu exclusively via defer.
-// For files: acquires d.mu exclusively only for child registration; WriteFile runs outside the lock.
+// fromFileServer fetches the metadata of a single entry from the fileserver and registers
+// it as a child. No content is downloaded; file.Read fetches it when the file is read.
+// Acquires d.mu exclusively for child registration.
 func (d *Directory) fromFileServer(ctx context.Context, name, key string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
 	entry, err := d.getEntryFromFileServer(name)
 	if err == ErrNotFoundOnFileServer {
-		d.rootFS.addNotFound(key)
+		d.view.addNotFound(key)
 		return nil, syscall.ENOENT
 	}
 	if err != nil {
 		log.Printf("error fetching file data for %s: %v", name, err)
 		return nil, syscall.EIO
 	}
-	LookupStats.ServerFetches.Add(1)
-	if entry.IsDir {
-		d.mu.Lock()
-		defer d.mu.Unlock()
-		return d.addDirChild(ctx, name), 0
-	}
+	d.view.stats.ServerFetches.Add(1)
+	metadata := entryMetadata(entry)
+	d.view.meta.addEntry(key, metadata)
+	return d.addChild(ctx, name, metadata, out), 0
+}
 
-	f := mapEntryToFile(entry)
+// addChild registers the child described by metadata and fills in out. Acquires d.mu
+// exclusively for child registration.
+func (d *Directory) addChild(ctx context.Context, name string, metadata cachedMetadata, out *fuse.EntryOut) *fusefs.Inode {
 	d.mu.Lock()
-	inode := d.addFileChild(ctx, name, entry.HashValue, f)
-	d.mu.Unlock()
-	if err := os.WriteFile(filepath.Join(_cacheDir, entry.HashValue), entry.Value, 0644); err != nil {
-		log.Printf("error writing file to disk cache: %v", err)
+	defer d.mu.Unlock()
+	switch {
+	case metadata.isDir:
+		return d.addDirChild(ctx, name, metadata)
+	case metadata.linkTarget != "":
+		setSymlinkEntryOut(out, metadata)
+		return d.addSymlinkChild(ctx, name, metadata)
+	default:
+		setFileEntryOut(out, metadata.attr())
+		return d.addFileChild(ctx, name, metadata)
 	}
-	setFileEntryOut(out, f.attr.Mode, f.attr.Size)
-	return inode, 0
 }
 
 func (d *Directory) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Mode = syscall.S_IFDIR | 0755
+	out.Attr = d.attr
+	if out.Mode == 0 {
+		// directories the worker creates itself, and entries uploaded without a mode
+		out.Mode = 0755
+	}
+	out.Mode |= syscall.S_IFDIR
 	out.Nlink = 2
 	return 0
 }
 
-func mapCachedEntryToFile(cachedMetadata cachedMetadata, binaryData []byte) *file {
-	file := &file{
-		Data: binaryData,
-		path: filepath.Join(_cacheDir, cachedMetadata.hash),
+func (d *Directory) mapCachedEntryToFile(cachedMetadata cachedMetadata) *file {
+	return &file{
+		path:   filepath.Join(_cacheDir, cachedMetadata.hash),
+		hash:   cachedMetadata.hash,
+		rootFS: d.rootFS,
+		attr:   cachedMetadata.attr(),
 	}
-	file.attr.Mode = uint32(cachedMetadata.mode)
-	file.attr.Size = uint64(cachedMetadata.size)
-
-	return file
 }
 
 func mapEntryToFile(entry KeyValue) *file {
-	if int64(len(entry.Value)) != entry.Size {
-		log.Printf("SIZE MISMATCH for %s: Value len=%d, Size=%d", entry.Name, len(entry.Value), entry.Size)
+	metadata := entryMetadata(entry)
+	return &file{
+		path: filepath.Join(_cacheDir, metadata.hash),
+		hash: metadata.hash,
+		attr: metadata.attr(),
 	}
-	file := &file{
-		Data: entry.Value,
-		path: filepath.Join(_cacheDir, entry.HashValue),
-	}
-	file.attr.Mode = uint32(entry.Mode)
-	file.attr.Size = uint64(entry.Size)
-
-	return file
 }
 
-func setFileEntryOut(out *fuse.EntryOut, mode uint32, size uint64) {
-	out.Attr.Mode = mode | 0777
-	out.Attr.Size = size
-	out.Attr.Nlink = 1
+func setFileEntryOut(out *fuse.EntryOut, attr fuse.Attr) {
+	out.Attr = attr
 	out.SetEntryTimeout(_kernelInodeTimeout)
 	out.SetAttrTimeout(_kernelInodeTimeout)
 }
 
-// fromDiskCache checks keyDir (under RLock), reads the file from disk without holding
-// any lock, then registers the child (under exclusive lock).
-func (d *Directory) fromDiskCache(ctx context.Context, name, key string, out *fuse.EntryOut) (*fusefs.Inode, bool) {
-	d.mu.RLock()
-	metadata, ok := d.keyDir[key]
-	d.mu.RUnlock()
+// fromMetadata answers a lookup from the metadata of the image fetched before, by this
+// view or another one, then registers the child (under exclusive lock). Content does
+// not have to be on disk; file.Read fetches it on demand.
+func (d *Directory) fromMetadata(ctx context.Context, name, key string, out *fuse.EntryOut) (*fusefs.Inode, bool) {
+	metadata, ok := d.view.meta.entry(key)
 	if !ok {
 		return nil, false
 	}
-	binaryData, err := os.ReadFile(filepath.Join(_cacheDir, metadata.hash))
-	if err != nil {
-		return nil, false
-	}
-	LookupStats.DiskCacheHits.Add(1)
-	d.mu.Lock()
-	inode := d.NewInode(ctx, mapCachedEntryToFile(metadata, binaryData), fusefs.StableAttr{Ino: 0})
-	d.AddChild(name, inode, false)
-	d.mu.Unlock()
-	setFileEntryOut(out, uint32(metadata.mode), uint64(metadata.size))
-	return inode, true
+	d.view.stats.DiskCacheHits.Add(1)
+	return d.addChild(ctx, name, metadata, out), true
 }
 
 // scriptFromFileserver fetches the script from the server with zero entry/attr timeouts
-// so the kernel never caches it. Acquires d.mu exclusively to register the child with overwrite=true.
+// so the kernel never caches it. Scripts are always read from the default image, whatever
+// image the directory belongs to. Acquires d.mu exclusively to register the child with overwrite=true.
 func (d *Directory) scriptFromFileserver(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
-	entry, err := d.getEntryFromFileServer(name)
+	entry, err := d.rootFS.fetchEntry(defaultImage, filepath.Join(d.path, name))
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	data, err := d.rootFS.fetchBlob(entry.HashValue)
 	if err != nil {
+		log.Printf("error fetching script %s: %v", name, err)
 		return nil, syscall.EIO
 	}
 
-	LookupStats.ServerFetches.Add(1)
+	d.view.stats.ServerFetches.Add(1)
 	out.SetEntryTimeout(0)
 	out.SetAttrTimeout(0)
 
-	inode := d.NewInode(ctx, mapEntryToFile(entry), fusefs.StableAttr{Ino: 0})
+	f := mapEntryToFile(entry)
+	f.Data = data
+	inode := d.NewInode(ctx, f, fusefs.StableAttr{Ino: 0})
 	d.mu.Lock()
 	d.AddChild(name, inode, true) // overwrite=true: always replace stale script inodes
 	d.mu.Unlock()
 	return inode, 0
 }
 
-// addFileChild registers a file inode and updates keyDir. Callers must hold lock exclusively
-// since d.keyDir is modified.
-func (d *Directory) addFileChild(ctx context.Context, name, hash string, f *file) *fusefs.Inode {
-	inode := d.NewInode(ctx, f, fusefs.StableAttr{Ino: 0})
+// addFileChild registers a file inode. Paths of the same hard-link group share one
+// inode. Callers must hold d.mu exclusively.
+func (d *Directory) addFileChild(ctx context.Context, name string, metadata cachedMetadata) *fusefs.Inode {
+	inode := d.NewInode(ctx, d.mapCachedEntryToFile(metadata), d.stableAttr(metadata))
+	d.AddChild(name, inode, false)
+	return inode
+}
+
+// addSymlinkChild registers a symlink inode. Callers must hold d.mu exclusively.
+func (d *Directory) addSymlinkChild(ctx context.Context, name string, metadata cachedMetadata) *fusefs.Inode {
+	l := &symlink{target: metadata.linkTarget, attr: metadata.attr()}
+	inode := d.NewInode(ctx, l, fusefs.StableAttr{Mode: syscall.S_IFLNK})
 	d.AddChild(name, inode, false)
-	if hash == "" {
-		return inode
-	}
-	d.keyDir[filepath.Join(d.path, name)] = cachedMetadata{
-		hash: hash,
-		size: int64(f.attr.Size),
-		mode: int64(f.attr.Mode),
-	}
 	return inode
 }
 
 // addDirChild registers a directory inode. Callers must hold d.mu exclusively
 // since d.children is modified.
-func (d *Directory) addDirChild(ctx context.Context, name string) *fusefs.Inode {
+func (d *Directory) addDirChild(ctx context.Context, name string, metadata cachedMetadata) *fusefs.Inode {
 	if dir, ok := d.children[name]; ok {
 		return &dir.Inode
 	}
 	newDir := d.rootFS.newDir(filepath.Join(d.path, name))
+	newDir.view = d.view
 	newDir.parent = d
+	newDir.attr = metadata.attr()
 	node := d.NewPersistentInode(ctx, newDir, fusefs.StableAttr{Mode: syscall.S_IFDIR})
 	d.AddChild(name, node, false)
 	d.children[name] = newDir
@@ -3,14 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -45,6 +48,45 @@ func Test_DirectoryReadDir(t *testing.T) {
 		assert.Contains(t, names, "numpy")
 		assert.Contains(t, names, "requests.py")
 	})
+	t.Run("lists symlinks as symlinks", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode([]KeyValue{{Name: "python3", LinkTarget: "python3.10"}})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+
+		stream, errno := dir.Readdir(context.Background())
+		require.Equal(t, syscall.Errno(0), errno)
+
+		entries := collectEntries(t, stream)
+		require.Len(t, entries, 1)
+		assert.Equal(t, uint32(fuse.S_IFLNK), entries[0].Mode)
+		assert.Equal(t, "python3.10", dir.view.meta.entries["/app/python3"].linkTarget)
+	})
+	t.Run("hard links share an inode", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode([]KeyValue{
+				{Name: "python3.10", HashValue: "py", Size: 10, HardLink: "app/python3.10", Nlink: 2},
+				{Name: "python3", HashValue: "py", Size: 10, HardLink: "app/python3.10", Nlink: 2},
+				{Name: "pip", HashValue: "pip", Size: 3},
+			})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+
+		stream, errno := dir.Readdir(context.Background())
+		require.Equal(t, syscall.Errno(0), errno)
+
+		inos := map[string]uint64{}
+		for _, e := range collectEntries(t, stream) {
+			inos[e.Name] = e.Ino
+		}
+		assert.NotZero(t, inos["python3"])
+		assert.Equal(t, inos["python3.10"], inos["python3"])
+		assert.NotEqual(t, inos["python3"], inos["pip"])
+	})
 	t.Run("lists children when server returns 404", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
@@ -58,9 +100,9 @@ func Test_DirectoryReadDir(t *testing.T) {
 
 		parentDir := &Directory{
 			path:     "/test",
+			view:     newView("app", defaultImage),
 			rootFS:   testFS,
 			children: map[string]*Directory{},
-			keyDir:   map[string]cachedMetadata{},
 		}
 
 		childDir := &Directory{
@@ -91,6 +133,7 @@ func Test_DirectoryReadDir(t *testing.T) {
 
 		emptyDir := &Directory{
 			path:     "/empty",
+			view:     newView("app", defaultImage),
 			rootFS:   testFS,
 			children: map[string]*Directory{},
 		}
@@ -113,6 +156,7 @@ func Test_DirectoryReadDir(t *testing.T) {
 
 		dir := &Directory{
 			path:     "/encodings",
+			view:     newView("app", defaultImage),
 			rootFS:   testFS,
 			children: map[string]*Directory{},
 		}
@@ -200,7 +244,7 @@ func Test_DirectoryLookup(t *testing.T) {
 		assert.Equal(t, syscall.EIO, errno)
 	})
 
-	t.Run("disk cache hit returns inode without hitting server", func(t *testing.T) {
+	t.Run("metadata hit returns inode without hitting server", func(t *testing.T) {
 		var requestCount atomic.Int64
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			requestCount.Add(1)
@@ -209,50 +253,177 @@ func Test_DirectoryLookup(t *testing.T) {
 
 		dir := newFUSEBridgedTestDir(server.URL)
 
-		hash := "diskcachehit123"
-		content := []byte("test file content")
-		require.NoError(t, os.MkdirAll(_cacheDir, 0755))
-		require.NoError(t, os.WriteFile(filepath.Join(_cacheDir, hash), content, 0644))
-		t.Cleanup(func() { os.Remove(filepath.Join(_cacheDir, hash)) })
-
-		dir.keyDir[filepath.Join(dir.path, "numpy.so")] = cachedMetadata{
-			hash: hash,
-			size: int64(len(content)),
+		// content is not on disk; only the metadata is needed to answer the lookup
+		dir.view.meta.addEntry(filepath.Join(dir.path, "numpy.so"), cachedMetadata{
+			hash: "keydirhit123",
+			size: 17,
 			mode: 0644,
-		}
+		})
 
-		before := LookupStats.DiskCacheHits.Load()
+		before := dir.view.stats.DiskCacheHits.Load()
 		inode, errno := dir.Lookup(context.Background(), "numpy.so", &fuse.EntryOut{})
 
 		assert.Equal(t, syscall.Errno(0), errno)
 		assert.NotNil(t, inode)
-		assert.Equal(t, int64(1), LookupStats.DiskCacheHits.Load()-before)
+		assert.Equal(t, int64(1), dir.view.stats.DiskCacheHits.Load()-before)
 		assert.Equal(t, int64(0), requestCount.Load())
 	})
 
-	t.Run("server fetch returns inode and increments counter", func(t *testing.T) {
+	t.Run("server fetch returns inode without downloading content", func(t *testing.T) {
 		entry := KeyValue{
 			Name:      "numpy.so",
 			HashValue: "serverfetch456",
 			Size:      12,
 			Mode:      0644,
-			Value:     []byte("hello world\n"),
 		}
+		var blobRequests atomic.Int64
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/blobs/"+entry.HashValue {
+				blobRequests.Add(1)
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello world\n"))
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(entry)
 		}))
 		defer server.Close()
 
 		dir := newFUSEBridgedTestDir(server.URL)
-		t.Cleanup(func() { os.Remove(filepath.Join(_cacheDir, entry.HashValue)) })
+		t.Cleanup(func() { os.Remove(chunkPath(entry.HashValue, 0)) })
 
-		before := LookupStats.ServerFetches.Load()
-		inode, errno := dir.Lookup(context.Background(), "numpy.so", &fuse.EntryOut{})
+		before := dir.view.stats.ServerFetches.Load()
+		out := &fuse.EntryOut{}
+		inode, errno := dir.Lookup(context.Background(), "numpy.so", out)
 
-		assert.Equal(t, syscall.Errno(0), errno)
+		require.Equal(t, syscall.Errno(0), errno)
 		assert.NotNil(t, inode)
-		assert.Equal(t, int64(1), LookupStats.ServerFetches.Load()-before)
+		assert.Equal(t, int64(1), dir.view.stats.ServerFetches.Load()-before)
+		assert.Equal(t, uint64(12), out.Attr.Size)
+		assert.Equal(t, int64(0), blobRequests.Load(), "lookup must not fetch content")
+
+		dest := make([]byte, 5)
+		res, errno := inode.Operations().(*file).Read(context.Background(), nil, dest, 6)
+		require.Equal(t, syscall.Errno(0), errno)
+		got, _ := res.Bytes(dest)
+		assert.Equal(t, "world", string(got))
+		assert.Equal(t, int64(1), blobRequests.Load())
+	})
+
+	t.Run("reports ownership, mode bits and mtime from the image", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(KeyValue{Name: "sudo", HashValue: "sudo", Size: 5, Mode: 04755, Uid: 0, Gid: 27, ModTime: 1700000000})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+
+		out := &fuse.EntryOut{}
+		inode, errno := dir.Lookup(context.Background(), "sudo", out)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, uint32(04755), out.Attr.Mode)
+
+		attr := &fuse.AttrOut{}
+		require.Equal(t, syscall.Errno(0), inode.Operations().(*file).Getattr(context.Background(), nil, attr))
+		assert.Equal(t, uint32(04755), attr.Mode)
+		assert.Equal(t, uint32(27), attr.Gid)
+		assert.Equal(t, uint64(1700000000), attr.Mtime)
+		assert.Equal(t, uint32(1), attr.Nlink)
+	})
+
+	t.Run("symlink from fileserver is readable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(KeyValue{Name: "lib", LinkTarget: "usr/lib"})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+
+		out := &fuse.EntryOut{}
+		inode, errno := dir.Lookup(context.Background(), "lib", out)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, uint32(syscall.S_IFLNK), out.Attr.Mode&syscall.S_IFMT)
+		assert.Equal(t, uint32(syscall.S_IFLNK), inode.StableAttr().Mode)
+
+		target, errno := inode.Operations().(*symlink).Readlink(context.Background())
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, "usr/lib", string(target))
+	})
+
+	t.Run("fetches from the directory's image", func(t *testing.T) {
+		var gotImage string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotImage = r.URL.Query().Get("image")
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		dir, _ := newTestDir(server.URL)
+		dir.view.image = "sway-test@abc123"
+
+		_, errno := dir.Lookup(context.Background(), "numpy.so", &fuse.EntryOut{})
+
+		assert.Equal(t, syscall.ENOENT, errno)
+		assert.Equal(t, "sway-test@abc123", gotImage)
+	})
+
+	t.Run("not-found cache is per view", func(t *testing.T) {
+		var requestCount atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestCount.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		dir, _ := newTestDir(server.URL)
+		other := &Directory{path: dir.path, view: newView("container-2", defaultImage), rootFS: dir.rootFS, children: map[string]*Directory{}}
+
+		dir.Lookup(context.Background(), "missing.so", &fuse.EntryOut{})
+		other.Lookup(context.Background(), "missing.so", &fuse.EntryOut{})
+
+		assert.Equal(t, int64(2), requestCount.Load())
+	})
+
+	t.Run("scripts are fetched from the default image", func(t *testing.T) {
+		var gotImage, gotPath string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/blobs/scripthash" {
+				w.Write([]byte("print(1)"))
+				return
+			}
+			gotImage = r.URL.Query().Get("image")
+			gotPath = r.URL.Query().Get("filepath")
+			json.NewEncoder(w).Encode(KeyValue{Name: "alice_app.py", HashValue: "scripthash", Size: 8})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+		dir.view.image = "sway-test@abc123"
+
+		inode, errno := dir.Lookup(context.Background(), "alice_app.py", &fuse.EntryOut{})
+
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, "", gotImage)
+		assert.Equal(t, "/app/alice_app.py", gotPath)
+		assert.Equal(t, []byte("print(1)"), inode.Operations().(*file).Data)
+	})
+
+	t.Run("project views serve script-like files from the project", func(t *testing.T) {
+		var gotImage string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotImage = r.URL.Query().Get("image")
+			json.NewEncoder(w).Encode(KeyValue{Name: "alice_app.py", HashValue: "projecthash", Size: 8})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+		dir.view.image = "project-alice-ml@abc123"
+		dir.view.scripts = false
+
+		inode, errno := dir.Lookup(context.Background(), "alice_app.py", &fuse.EntryOut{})
+
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, "project-alice-ml@abc123", gotImage)
+		assert.Nil(t, inode.Operations().(*file).Data)
 	})
 
 	t.Run("memory cache hit returns inode without hitting server", func(t *testing.T) {
@@ -267,15 +438,35 @@ func Test_DirectoryLookup(t *testing.T) {
 		childDir := &Directory{path: "/app/numpy", rootFS: dir.rootFS, children: map[string]*Directory{}}
 		dir.children["numpy"] = childDir
 
-		before := LookupStats.MemoryCacheHits.Load()
+		before := dir.view.stats.MemoryCacheHits.Load()
 		inode, errno := dir.Lookup(context.Background(), "numpy", &fuse.EntryOut{})
 
 		assert.Equal(t, syscall.Errno(0), errno)
 		assert.NotNil(t, inode)
-		assert.Equal(t, int64(1), LookupStats.MemoryCacheHits.Load()-before)
+		assert.Equal(t, int64(1), dir.view.stats.MemoryCacheHits.Load()-before)
 		assert.Equal(t, int64(0), requestCount.Load())
 	})
 
+	t.Run("lookup stats are per view", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(KeyValue{Name: "numpy", IsDir: true})
+		}))
+		defer server.Close()
+
+		dir := newFUSEBridgedTestDir(server.URL)
+		other := &Directory{path: dir.path, view: newView("container-2", defaultImage), rootFS: dir.rootFS, children: map[string]*Directory{}}
+		fusefs.NewNodeFS(other, &fusefs.Options{FirstAutomaticIno: 1})
+
+		dir.Lookup(context.Background(), "numpy", &fuse.EntryOut{})
+		dir.Lookup(context.Background(), "numpy", &fuse.EntryOut{})
+		other.Lookup(context.Background(), "numpy", &fuse.EntryOut{})
+
+		assert.Equal(t, int64(1), dir.view.stats.ServerFetches.Load())
+		assert.Equal(t, int64(1), dir.view.stats.MemoryCacheHits.Load())
+		assert.Equal(t, int64(1), other.view.stats.ServerFetches.Load())
+		assert.Equal(t, int64(0), other.view.stats.MemoryCacheHits.Load())
+	})
+
 	t.Run("concurrent lookups: after first round notFoundSet prevents further server hits", func(t *testing.T) {
 		var requestCount atomic.Int64
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -326,6 +517,75 @@ func collectEntries(t *testing.T, stream fusefs.DirStream) []fuse.DirEntry {
 	return entries
 }
 
+func Test_imageMetadata(t *testing.T) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.HasSuffix(r.URL.Query().Get("filepath"), "/") {
+			json.NewEncoder(w).Encode([]KeyValue{
+				{Name: "numpy", IsDir: true, Mode: 0755},
+				{Name: "requests.py", Mode: 0644, Size: 12, HashValue: "req"},
+			})
+			return
+		}
+		if r.URL.Query().Get("filepath") != "/app/torch.so" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(KeyValue{Name: "torch.so", Mode: 0644, Size: 3, HashValue: "torch"})
+	}))
+	defer server.Close()
+	testFS := &FS{client: server.Client(), fileserverURL: server.URL, images: map[string]*imageMetadata{}}
+	// mount is what addView does for a run, without the FUSE mount
+	mount := func(name, image string) *Directory {
+		dir := &Directory{path: "/app", view: newView(name, image), rootFS: testFS, children: map[string]*Directory{}}
+		dir.view.meta = testFS.imageMetadata(image)
+		fusefs.NewNodeFS(dir, &fusefs.Options{FirstAutomaticIno: 1})
+		return dir
+	}
+	ctx := context.Background()
+
+	t.Run("runs of a committed image reuse what earlier runs fetched", func(t *testing.T) {
+		first := mount("run-1", "sway-ml@abc")
+		_, errno := first.Readdir(ctx)
+		require.Equal(t, syscall.Errno(0), errno)
+		_, errno = first.Lookup(ctx, "torch.so", &fuse.EntryOut{})
+		require.Equal(t, syscall.Errno(0), errno)
+		require.Equal(t, int64(2), requests.Load())
+
+		second := mount("run-2", "sway-ml@abc")
+		stream, errno := second.Readdir(ctx)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Len(t, collectEntries(t, stream), 2)
+		for _, name := range []string{"numpy", "requests.py", "torch.so"} {
+			_, errno := second.Lookup(ctx, name, &fuse.EntryOut{})
+			assert.Equal(t, syscall.Errno(0), errno, name)
+		}
+		assert.Equal(t, int64(2), requests.Load(), "the second run asked the fileserver again")
+		assert.Zero(t, second.view.stats.ServerFetches.Load())
+
+		second.Lookup(ctx, "missing.so", &fuse.EntryOut{})
+		assert.True(t, second.view.isNotFound("/app/missing.so"))
+		assert.False(t, first.view.isNotFound("/app/missing.so"), "the negative cache is per view")
+	})
+
+	t.Run("the default image can change, so its views don't share", func(t *testing.T) {
+		before := requests.Load()
+		mount("app", defaultImage).Readdir(ctx)
+		mount("run-3", defaultImage).Readdir(ctx)
+		assert.Equal(t, int64(2), requests.Load()-before)
+	})
+
+	t.Run("only the images used last are kept", func(t *testing.T) {
+		first := testFS.imageMetadata("sway-ml@abc")
+		for i := 0; i < _maxImageMetadata; i++ {
+			testFS.imageMetadata(fmt.Sprintf("sway-other@%d", i))
+		}
+		assert.Len(t, testFS.images, _maxImageMetadata)
+		assert.NotSame(t, first, testFS.imageMetadata("sway-ml@abc"))
+	})
+}
+
 // newFUSEBridgedTestDir is like newTestDir but initializes the FUSE inode bridge,
 // allowing NewInode/NewPersistentInode calls without a real FUSE mount.
 func newFUSEBridgedTestDir(serverURL string) *Directory {
@@ -337,15 +597,15 @@ func newFUSEBridgedTestDir(serverURL string) *Directory {
 func newTestDir(serverURL string) (*Directory, *http.Client) {
 	client := &http.Client{}
 	testFS := &FS{
-		client:        client,
-		fileserverURL: serverURL,
-		notFoundSet:   make(map[string]struct{}),
+		client:         client,
+		fileserverURL:  serverURL,
+		chunksInFlight: make(map[string]*chunkCall),
 	}
 	dir := &Directory{
 		path:     "/app",
+		view:     newView("app", defaultImage),
 		rootFS:   testFS,
 		children: map[string]*Directory{},
-		keyDir:   map[string]cachedMetadata{},
 	}
 	return dir, client
 }
@@ -5,70 +5,85 @@ import (
 	"io"
 	"log"
 	"os"
-	"sync"
 	"syscall"
 
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
-// file represents a file in the filesystem
+// file represents a file in the filesystem. Creating one (Lookup, Readdir) only needs
+// metadata, and Getattr is answered from attr. Content is never loaded as a whole: reads
+// go to the whole-file disk cache at path if an older worker left one there, otherwise
+// to the chunk cache, fetching missing chunks of hash from the fileserver.
 type file struct {
 	fusefs.Inode
-	Data     []byte
-	attr     fuse.Attr
-	path     string
-	loadOnce sync.Once
-	loadErr  syscall.Errno
+	Data   []byte // pre-populated content, used for scripts that must not be cached
+	attr   fuse.Attr
+	path   string
+	hash   string
+	rootFS *FS
 }
 
 var _ = (fusefs.NodeReader)((*file)(nil))
 var _ = (fusefs.NodeOpener)((*file)(nil))
 
 func (f *file) Read(ctx context.Context, fh fusefs.FileHandle, dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
-	if f.Data == nil {
-		log.Printf("READ called with nil Data, path=%s size=%d", f.path, f.attr.Size)
-		return fuse.ReadResultData(nil), syscall.EIO
+	if f.Data != nil {
+		if offset < 0 || int(offset) >= len(f.Data) {
+			return fuse.ReadResultData(nil), 0
+		}
+		end := int(offset) + len(dest)
+		end = min(end, len(f.Data))
+		return fuse.ReadResultData(f.Data[offset:end]), 0
 	}
-	if offset < 0 || int(offset) >= len(f.Data) {
+	size := int64(f.attr.Size)
+	if offset < 0 || offset >= size {
 		return fuse.ReadResultData(nil), 0
 	}
-	end := int(offset) + len(dest)
-	end = min(end, len(f.Data))
-	return fuse.ReadResultData(f.Data[offset:end]), 0
+	dest = dest[:min(int64(len(dest)), size-offset)]
+
+	if n, ok := readCachedFile(f.path, dest, offset); ok {
+		return fuse.ReadResultData(dest[:n]), 0
+	}
+	if f.hash == "" || f.rootFS == nil {
+		log.Printf("READ called with no content source, path=%s size=%d", f.path, f.attr.Size)
+		return fuse.ReadResultData(nil), syscall.EIO
+	}
+	n, err := f.rootFS.readAt(f.hash, size, dest, offset)
+	if err != nil {
+		log.Printf("error reading %s at %d: %v", f.hash, offset, err)
+		return fuse.ReadResultData(nil), syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+// readCachedFile reads from the whole-file disk cache, if the file is there.
+func readCachedFile(path string, dest []byte, offset int64) (int, bool) {
+	if path == "" {
+		return 0, false
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer reader.Close()
+	n, err := reader.ReadAt(dest, offset)
+	if err != nil && err != io.EOF {
+		return 0, false
+	}
+	return n, true
 }
 
+// Getattr reports the mode bits, ownership, mtime and link count from the image.
 func (f *file) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	out.Mode = 0777
-	out.Nlink = 1 // Hardcoding to 1, assume no hard-links
-	out.Size = f.attr.Size
+	out.Attr = f.attr
 	const bs = 512
 	out.Blksize = bs
 	out.Blocks = (out.Size + bs - 1) / bs
 	return 0
 }
 
+// Open does no I/O; content is fetched chunk by chunk as the kernel reads it.
 func (f *file) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
-	f.loadOnce.Do(func() {
-		if f.Data != nil {
-			return // pre-populated at construction time, nothing to load
-		}
-		reader, err := os.Open(f.path)
-		if err != nil {
-			f.loadErr = syscall.EIO
-			return
-		}
-		defer reader.Close()
-		content, err := io.ReadAll(reader)
-		if err != nil {
-			f.loadErr = syscall.EIO
-			return
-		}
-		f.Data = content
-	})
-
-	if f.loadErr != 0 {
-		return nil, 0, f.loadErr
-	}
 	return f, uint32(0), 0
 }
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFileRead(t *testing.T) {
@@ -89,3 +99,98 @@ func TestFileRead(t *testing.T) {
 		})
 	}
 }
+
+func TestFileChunkedRead(t *testing.T) {
+	// newChunkServer serves content by range and counts the requests it gets
+	newChunkServer := func(t *testing.T, content []byte) (*FS, *atomic.Int64) {
+		var requests atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+		}))
+		t.Cleanup(server.Close)
+		require.NoError(t, os.MkdirAll(_cacheDir, 0755))
+		return &FS{
+			client:         server.Client(),
+			fileserverURL:  server.URL,
+			chunksInFlight: map[string]*chunkCall{},
+		}, &requests
+	}
+	cleanupChunks := func(t *testing.T, hash string) {
+		t.Cleanup(func() {
+			matches, _ := filepath.Glob(filepath.Join(_cacheDir, hash+".*"))
+			for _, m := range matches {
+				os.Remove(m)
+			}
+		})
+	}
+
+	t.Run("fetches only the chunk that is read", func(t *testing.T) {
+		content := []byte(strings.Repeat("a", _chunkSize) + strings.Repeat("b", _chunkSize) + "tail")
+		testFS, requests := newChunkServer(t, content)
+		hash := "chunkedread1"
+		cleanupChunks(t, hash)
+		f := &file{hash: hash, rootFS: testFS, path: filepath.Join(_cacheDir, hash), attr: fuse.Attr{Size: uint64(len(content))}}
+
+		dest := make([]byte, 4)
+		result, errno := f.Read(context.Background(), nil, dest, int64(2*_chunkSize))
+		require.Equal(t, syscall.Errno(0), errno)
+		data, _ := result.Bytes(dest)
+
+		assert.Equal(t, "tail", string(data))
+		assert.Equal(t, int64(1), requests.Load())
+		assert.NoFileExists(t, chunkPath(hash, 0))
+		assert.FileExists(t, chunkPath(hash, 2))
+	})
+
+	t.Run("read spanning two chunks", func(t *testing.T) {
+		content := []byte(strings.Repeat("a", _chunkSize) + strings.Repeat("b", _chunkSize))
+		testFS, requests := newChunkServer(t, content)
+		hash := "chunkedread2"
+		cleanupChunks(t, hash)
+		f := &file{hash: hash, rootFS: testFS, path: filepath.Join(_cacheDir, hash), attr: fuse.Attr{Size: uint64(len(content))}}
+
+		dest := make([]byte, 4)
+		result, errno := f.Read(context.Background(), nil, dest, int64(_chunkSize-2))
+		require.Equal(t, syscall.Errno(0), errno)
+		data, _ := result.Bytes(dest)
+
+		assert.Equal(t, "aabb", string(data))
+		assert.Equal(t, int64(2), requests.Load())
+	})
+
+	t.Run("cached chunks are not fetched again", func(t *testing.T) {
+		content := []byte("hello chunked world")
+		testFS, requests := newChunkServer(t, content)
+		hash := "chunkedread3"
+		cleanupChunks(t, hash)
+		f := &file{hash: hash, rootFS: testFS, path: filepath.Join(_cacheDir, hash), attr: fuse.Attr{Size: uint64(len(content))}}
+
+		dest := make([]byte, 5)
+		f.Read(context.Background(), nil, dest, 0)
+		result, errno := f.Read(context.Background(), nil, dest, 6)
+		require.Equal(t, syscall.Errno(0), errno)
+		data, _ := result.Bytes(dest)
+
+		assert.Equal(t, "chunk", string(data))
+		assert.Equal(t, int64(1), requests.Load())
+	})
+
+	t.Run("whole-file disk cache is read without fetching", func(t *testing.T) {
+		content := []byte("cached on disk")
+		testFS, requests := newChunkServer(t, content)
+		hash := "chunkedread4"
+		path := filepath.Join(_cacheDir, hash)
+		require.NoError(t, os.WriteFile(path, content, 0644))
+		t.Cleanup(func() { os.Remove(path) })
+		f := &file{hash: hash, rootFS: testFS, path: path, attr: fuse.Attr{Size: uint64(len(content))}}
+
+		dest := make([]byte, 4)
+		result, errno := f.Read(context.Background(), nil, dest, 10)
+		require.Equal(t, syscall.Errno(0), errno)
+		data, _ := result.Bytes(dest)
+
+		assert.Equal(t, "disk", string(data))
+		assert.Equal(t, int64(0), requests.Load())
+	})
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -18,47 +18,80 @@ import (
 type FS struct {
 	fusefs.Inode
 
-	root           *Directory
-	path           string
-	client         *http.Client
-	fileserverURL  string
-	notFoundMu     sync.RWMutex
-	notFoundSet    map[string]struct{} // paths known not to exist; cleared at the start of each run. Using this to avoid re-fetches to the fileserver.
-}
+	root          *Directory
+	path          string
+	client        *http.Client
+	fileserverURL string
+	viewsMu       sync.Mutex
+	views         map[string]*Directory // view name to the root of its tree, mounted at <mount>/<name>
 
-func (f *FS) ClearNotFound() {
-	f.notFoundMu.Lock()
-	f.notFoundSet = make(map[string]struct{})
-	f.notFoundMu.Unlock()
-}
+	imagesMu sync.Mutex
+	images   map[string]*imageMetadata // committed image to the metadata its views share
 
-func (f *FS) addNotFound(path string) {
-	f.notFoundMu.Lock()
-	f.notFoundSet[path] = struct{}{}
-	f.notFoundMu.Unlock()
-}
+	chunksMu       sync.Mutex
+	chunksInFlight map[string]*chunkCall // chunk cache path to the fetch currently filling it
 
-func (f *FS) isNotFound(path string) bool {
-	f.notFoundMu.RLock()
-	_, ok := f.notFoundSet[path]
-	f.notFoundMu.RUnlock()
-	return ok
+	jobsMu sync.Mutex
+	jobs   map[int64]*runJob // runs that are still queued or running, by run ID
+	queue  *runQueue
 }
 
+// defaultImage is the fileserver's shared image, mounted at <mount>/app.
+const defaultImage = ""
+
 func (r *FS) OnAdd(ctx context.Context) {
+	r.addView(ctx, "app", defaultImage, false)
+}
+
+// addView mounts a new view of image at <mount>/<name>. Every image tree is rooted at
+// the "app" key on the fileserver. A project view only shows the project's files.
+// Callers must hold r.viewsMu or be in OnAdd.
+func (r *FS) addView(ctx context.Context, name, image string, project bool) *Directory {
 	p := r.EmbeddedInode()
 	rf := r.newDir("app")
-	p.AddChild("app", r.NewPersistentInode(ctx, rf, fusefs.StableAttr{Mode: syscall.S_IFDIR}), false)
+	rf.view = newView(name, image)
+	rf.view.meta = r.imageMetadata(image)
+	rf.view.scripts = !project
+	p.AddChild(name, r.NewPersistentInode(ctx, rf, fusefs.StableAttr{Mode: syscall.S_IFDIR}), false)
+
+	if !project {
+		r.initLinuxDirs(ctx, rf, []string{
+			"home", "lib", "media", "mnt", "opt",
+			"proc", "dev", "sys", "lib64",
+		})
+	}
+	r.views[name] = rf
+	return rf
+}
+
+// mountRunView mounts a fresh view of image called name for a run and returns it
+// along with its absolute path.
+func (r *FS) mountRunView(name, image string, project bool) (*view, string) {
+	r.viewsMu.Lock()
+	defer r.viewsMu.Unlock()
+	rf := r.addView(context.Background(), name, image, project)
+	return rf.view, filepath.Join(mountPath, name)
+}
 
-	r.initLinuxDirs(ctx, rf, []string{
-		"home", "lib", "media", "mnt", "opt",
-		"proc", "dev", "sys", "lib64",
-	})
+// removeView unmounts the view called name and lets go of its inodes.
+func (r *FS) removeView(name string) {
+	r.viewsMu.Lock()
+	rf, ok := r.views[name]
+	delete(r.views, name)
+	r.viewsMu.Unlock()
+	if !ok {
+		return
+	}
+	rf.RmAllChildren()
+	p := r.EmbeddedInode()
+	p.RmChild(name)
+	p.NotifyEntry(name)
 }
 
 func (r *FS) initLinuxDirs(ctx context.Context, parent *Directory, names []string) {
 	for _, name := range names {
 		dir := r.newDir(name)
+		dir.view = parent.view
 		dir.parent = parent
 		node := r.NewPersistentInode(ctx, dir, fusefs.StableAttr{Mode: syscall.S_IFDIR})
 		parent.AddChild(name, node, false)
@@ -80,14 +113,21 @@ func NewFS(path string) *FS {
 	fs := &FS{
 		path:          path,
 		fileserverURL: getFileserverURL(),
-		notFoundSet:   make(map[string]struct{}),
+		views:         make(map[string]*Directory),
+		images:        make(map[string]*imageMetadata),
+		jobs:          make(map[int64]*runJob),
+
+		chunksInFlight: make(map[string]*chunkCall),
 	}
+	fs.queue = newRunQueue(maxRunning, schedulePolicy, fs.launch)
 	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
+		Transport: &tokenTransport{
+			// the fileserver's token for this worker
+			token: os.Getenv("SWAY_TOKEN"),
+			base: &http.Transport{
+				TLSClientConfig:       fileserverTLS,
+				ResponseHeaderTimeout: _timeout,
 			},
-			ResponseHeaderTimeout: _timeout,
 		},
 		Timeout: _timeout,
 	}
@@ -109,7 +149,6 @@ func (fs *FS) newDir(path string) *Directory {
 		children: children,
 		path:     path,
 		rootFS:   fs,
-		keyDir:   make(map[string]cachedMetadata),
 	}
 }
 
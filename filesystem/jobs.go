@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lastnameswayne/tinycontainer/db"
+)
+
+// runJob is a run the worker has accepted. Its output is kept in memory while it is
+// queued and running, so clients can follow it from any connection; once it is done
+// the runs database has everything. The output is kept once, in stdout and stderr,
+// which followers read from; events only holds changes of status.
+type runJob struct {
+	id        int64 // row in the runs database; 0 if there is no database
+	req       RunRequest
+	fileName  string // what the run is logged as
+	queuedAt  time.Time
+	startedAt time.Time
+	stdout    *outputWriter
+	stderr    *outputWriter
+	ctx       context.Context // cancelled when the run is
+	cancel    context.CancelFunc
+
+	// set up once the run leaves the queue
+	containerID string
+	bundleDir   string
+	mounts      *runMounts
+
+	mu        sync.Mutex
+	state     string        // db.StatusQueued or db.StatusRunning
+	position  int           // place in the queue, from 1, while queued
+	events    []RunEvent    // changes of status so far, then the final event once done
+	changed   chan struct{} // closed and replaced whenever events or the output grows
+	done      bool
+	cancelled bool
+}
+
+func newRunJob(req RunRequest, fileName string) *runJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &runJob{
+		req:      req,
+		fileName: fileName,
+		queuedAt: time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+		state:    db.StatusQueued,
+		changed:  make(chan struct{}),
+	}
+	job.stdout = &outputWriter{stream: "stdout", events: job}
+	job.stderr = &outputWriter{stream: "stderr", events: job}
+	return job
+}
+
+// send records an event of the run and wakes up everyone following it. Output events
+// aren't recorded: the output is already in stdout and stderr.
+func (j *runJob) send(ev RunEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if ev.Stream == "" {
+		j.events = append(j.events, ev)
+	}
+	if ev.Done {
+		j.done = true
+	}
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// setQueued records the run's place in the queue and tells its followers if it moved.
+func (j *runJob) setQueued(position int) {
+	j.mu.Lock()
+	moved := j.position != position
+	j.position = position
+	j.mu.Unlock()
+	if moved {
+		j.send(RunEvent{RunId: int(j.id), Status: db.StatusQueued, QueuePosition: position})
+	}
+}
+
+// setRunning records that the run has left the queue and tells its followers.
+func (j *runJob) setRunning() {
+	j.mu.Lock()
+	j.state = db.StatusRunning
+	j.position = 0
+	j.startedAt = time.Now() // refined once the container is set up
+	j.mu.Unlock()
+	j.send(RunEvent{RunId: int(j.id), Status: db.StatusRunning})
+}
+
+// follow calls send with every event of the run, from the first, until the final
+// event has been sent or ctx is done. Output written since the last wake-up is sent
+// as one event per stream, stdout first.
+func (j *runJob) follow(ctx context.Context, send func(RunEvent)) {
+	next, stdoutSent, stderrSent := 0, 0, 0
+	for {
+		j.mu.Lock()
+		events := j.events[next:]
+		changed := j.changed
+		done := j.done
+		j.mu.Unlock()
+
+		// the output is read after done, so once the run is done all of it is there
+		var final []RunEvent
+		for _, ev := range events {
+			if ev.Done {
+				final = append(final, ev)
+				continue
+			}
+			send(ev)
+		}
+		var data string
+		if data, stdoutSent = j.stdout.since(stdoutSent); data != "" {
+			send(RunEvent{Stream: j.stdout.stream, Data: data})
+		}
+		if data, stderrSent = j.stderr.since(stderrSent); data != "" {
+			send(RunEvent{Stream: j.stderr.stream, Data: data})
+		}
+		for _, ev := range final {
+			send(ev)
+		}
+		next += len(events)
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wait blocks until the run is done and returns its final event.
+func (j *runJob) wait() RunEvent {
+	var final RunEvent
+	j.follow(context.Background(), func(ev RunEvent) { final = ev })
+	return final
+}
+
+// stop kills the container. The run then finishes as cancelled.
+func (j *runJob) stop() {
+	j.mu.Lock()
+	j.cancelled = true
+	containerID := j.containerID
+	j.mu.Unlock()
+	if containerID != "" {
+		if out, err := exec.Command("sudo", "runc", "kill", containerID, "KILL").CombinedOutput(); err != nil {
+			log.Printf("run %d: runc kill: %v: %s", j.id, err, out)
+		}
+	}
+	// also covers a container that runc hasn't created yet
+	j.cancel()
+}
+
+func (j *runJob) isCancelled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelled
+}
+
+// cancelRun cancels job: a queued run never starts, a running one is killed.
+func (fs *FS) cancelRun(job *runJob) {
+	if fs.queue.remove(job) {
+		job.mu.Lock()
+		job.cancelled = true
+		job.mu.Unlock()
+		job.cancel()
+		fs.finish(job, RunEvent{Done: true, RunId: int(job.id), ExitCode: -1}, db.StatusCancelled, 0, lookupStatsSnapshot{})
+		return
+	}
+	job.stop()
+}
+
+// launch sets up and runs a job the queue has admitted, then frees its slot.
+func (fs *FS) launch(job *runJob) {
+	defer fs.queue.done(job)
+
+	if err := fs.setupRun(job); err != nil {
+		status := db.StatusFailed
+		if job.isCancelled() {
+			status = db.StatusCancelled
+		}
+		fs.finish(job, RunEvent{Done: true, RunId: int(job.id), ExitCode: -1, Error: err.Error()}, status, 0, lookupStatsSnapshot{})
+		return
+	}
+	fs.execute(job)
+}
+
+// execute runs the container of job to completion, records the outcome and releases
+// everything the run mounted.
+func (fs *FS) execute(job *runJob) {
+	defer job.cancel()
+
+	timeout := job.req.Resources.Timeout
+	ctx, cancel := context.WithTimeout(job.ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sudo", "runc", "run", "--bundle", job.bundleDir, job.containerID)
+	cmd.Stdout = job.stdout
+	cmd.Stderr = job.stderr
+	// killing sudo would leave the container running
+	cmd.Cancel = func() error {
+		return exec.Command("sudo", "runc", "kill", job.containerID, "KILL").Run()
+	}
+	cmd.WaitDelay = 10 * time.Second
+	err := cmd.Run()
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+
+	exec.Command("sudo", "runc", "delete", job.containerID).Run()
+	duration := time.Since(job.startedAt)
+
+	stats := lookupStatsSnapshot{
+		memoryHits:    job.mounts.view.stats.MemoryCacheHits.Load(),
+		diskHits:      job.mounts.view.stats.DiskCacheHits.Load(),
+		serverFetches: job.mounts.view.stats.ServerFetches.Load(),
+	}
+
+	upperDir, releaseErr := job.mounts.release(job.req.KeepRootfs)
+	if releaseErr != nil {
+		log.Printf("run %s: %v", job.containerID, releaseErr)
+	}
+	os.RemoveAll(job.bundleDir)
+
+	final := RunEvent{Done: true, RunId: int(job.id), UpperDir: upperDir}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			final.ExitCode = exitErr.ExitCode()
+		} else {
+			final.ExitCode = -1
+			final.Error = "Failed to run container: " + err.Error()
+		}
+	}
+	if timedOut {
+		final.Error = fmt.Sprintf("run timed out after %s", timeout)
+	}
+	status := db.StatusSucceeded
+	if job.isCancelled() {
+		status = db.StatusCancelled
+	} else if final.ExitCode != 0 || final.Error != "" {
+		status = db.StatusFailed
+	}
+	fs.finish(job, final, status, duration, stats)
+}
+
+// lookupStatsSnapshot is what a run's lookupStats came to when it finished.
+type lookupStatsSnapshot struct {
+	memoryHits, diskHits, serverFetches int64
+}
+
+// finish records the outcome of job and sends its final event.
+func (fs *FS) finish(job *runJob, final RunEvent, status string, duration time.Duration, stats lookupStatsSnapshot) {
+	if db.DB != nil && job.id != 0 {
+		err := db.FinishRun(job.id, duration.Milliseconds(),
+			stripANSI(job.stdout.String()), job.stderr.String(), final.ExitCode,
+			stats.memoryHits, stats.diskHits, stats.serverFetches, status, final.Error)
+		if err != nil {
+			log.Printf("Error logging run to database: %v", err)
+		}
+	}
+
+	fs.jobsMu.Lock()
+	delete(fs.jobs, job.id)
+	fs.jobsMu.Unlock()
+	job.send(final)
+}
+
+// requeue puts the runs that were waiting when the worker last stopped back in the
+// queue, in their old order.
+func (fs *FS) requeue() error {
+	if db.DB == nil {
+		return nil
+	}
+	queued, err := db.QueuedRuns()
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for _, r := range queued {
+		var req RunRequest
+		if err := json.Unmarshal([]byte(r.Request), &req); err != nil {
+			log.Printf("run %d: can't restore queued run: %v", r.ID, err)
+			db.FinishRun(r.ID, 0, "", "", -1, 0, 0, 0, db.StatusFailed, "could not restore queued run after a worker restart")
+			continue
+		}
+		job := newRunJob(req, r.Filename)
+		job.id = r.ID
+		job.queuedAt = r.QueuedAt
+		fs.jobsMu.Lock()
+		fs.jobs[job.id] = job
+		fs.jobsMu.Unlock()
+		fs.queue.enqueue(job)
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("restored %d queued runs", restored)
+	}
+	return nil
+}
+
+// runningJob returns the run with the given ID if it is still queued or running.
+func (fs *FS) runningJob(id int64) (*runJob, bool) {
+	fs.jobsMu.Lock()
+	defer fs.jobsMu.Unlock()
+	job, ok := fs.jobs[id]
+	return job, ok
+}
+
+// RunStatus is the answer to POST /runs, GET /runs/{id} and DELETE /runs/{id}.
+type RunStatus struct {
+	RunId         int       `json:"run_id"`
+	Status        string    `json:"status"`
+	QueuePosition int       `json:"queue_position,omitempty"` // while queued, from 1
+	Filename      string    `json:"filename"`
+	StartedAt     time.Time `json:"started_at"` // when it was queued, until it starts
+	DurationMs    int64     `json:"duration_ms"`
+	ExitCode      int       `json:"exit_code"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// RunLogs is the answer to GET /runs/{id}/logs.
+type RunLogs struct {
+	RunId  int    `json:"run_id"`
+	Status string `json:"status"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+func (j *runJob) status() RunStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state == db.StatusQueued {
+		return RunStatus{
+			RunId:         int(j.id),
+			Status:        db.StatusQueued,
+			QueuePosition: j.position,
+			Filename:      j.fileName,
+			StartedAt:     j.queuedAt,
+		}
+	}
+	return RunStatus{
+		RunId:      int(j.id),
+		Status:     db.StatusRunning,
+		Filename:   j.fileName,
+		StartedAt:  j.startedAt,
+		DurationMs: time.Since(j.startedAt).Milliseconds(),
+	}
+}
+
+func recordStatus(r db.RunRecord) RunStatus {
+	return RunStatus{
+		RunId:      int(r.ID),
+		Status:     r.Status,
+		Filename:   r.Filename,
+		StartedAt:  r.StartedAt,
+		DurationMs: r.DurationMs,
+		ExitCode:   r.ExitCode,
+		Error:      r.Error,
+	}
+}
+
+// SubmitRun queues a run and answers with its ID straight away.
+func (fs *FS) SubmitRun(w http.ResponseWriter, r *http.Request) {
+	if db.DB == nil {
+		http.Error(w, "runs database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	req := RunRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if u, ok := requestUser(r); ok {
+		req.Username = u.Name
+	}
+	job, err := fs.submitRun(req)
+	if err != nil {
+		writeRunError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.status())
+}
+
+// lookupRun finds the run named in the path: queued or running, or finished in the runs
+// database.
+// It answers the request itself if there is no such run.
+func (fs *FS) lookupRun(w http.ResponseWriter, r *http.Request) (*runJob, db.RunRecord, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid run id", http.StatusBadRequest)
+		return nil, db.RunRecord{}, false
+	}
+	// other users' runs don't exist as far as the sender is concerned
+	if job, ok := fs.runningJob(id); ok && canSee(r, job.req.Username) {
+		return job, db.RunRecord{}, true
+	}
+	if db.DB == nil {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return nil, db.RunRecord{}, false
+	}
+	record, err := db.GetRun(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return nil, db.RunRecord{}, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get run: "+err.Error(), http.StatusInternalServerError)
+		return nil, db.RunRecord{}, false
+	}
+	if !canSee(r, record.Username) {
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return nil, db.RunRecord{}, false
+	}
+	return nil, record, true
+}
+
+// GetRun reports whether a run is still queued or running and how it ended.
+func (fs *FS) GetRun(w http.ResponseWriter, r *http.Request) {
+	job, record, ok := fs.lookupRun(w, r)
+	if !ok {
+		return
+	}
+	status := recordStatus(record)
+	if job != nil {
+		status = job.status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// GetRunLogs answers with the output of a run so far. With ?follow=true and an
+// application/x-ndjson Accept header, the output is streamed as RunEvents until the
+// run is done, like a streamed /run.
+func (fs *FS) GetRunLogs(w http.ResponseWriter, r *http.Request) {
+	job, record, ok := fs.lookupRun(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("follow") == "true" && r.Header.Get("Accept") == _ndjsonContentType {
+		events := newEventStream(w)
+		if job != nil {
+			job.follow(r.Context(), events.send)
+			return
+		}
+		if record.Stdout != "" {
+			events.send(RunEvent{Stream: "stdout", Data: record.Stdout})
+		}
+		if record.Stderr != "" {
+			events.send(RunEvent{Stream: "stderr", Data: record.Stderr})
+		}
+		events.send(RunEvent{Done: true, ExitCode: record.ExitCode, RunId: int(record.ID), Error: record.Error})
+		return
+	}
+
+	logs := RunLogs{RunId: int(record.ID), Status: record.Status, Stdout: record.Stdout, Stderr: record.Stderr}
+	if job != nil {
+		logs = RunLogs{RunId: int(job.id), Status: job.status().Status, Stdout: job.stdout.String(), Stderr: job.stderr.String()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs)
+}
+
+// CancelRun takes a queued run out of the queue, or kills the container of a running one.
+func (fs *FS) CancelRun(w http.ResponseWriter, r *http.Request) {
+	job, _, ok := fs.lookupRun(w, r)
+	if !ok {
+		return
+	}
+	if job == nil {
+		http.Error(w, "Run already finished", http.StatusConflict)
+		return
+	}
+	status := job.status()
+	fs.cancelRun(job)
+	status.Status = db.StatusCancelled
+	status.QueuePosition = 0
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lastnameswayne/tinycontainer/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runJob(t *testing.T) {
+	t.Run("followers get every event from the start until the run is done", func(t *testing.T) {
+		job := newRunJob(RunRequest{}, "app.py")
+		defer job.cancel()
+		job.stdout.Write([]byte("epoch 1\n"))
+
+		got := make(chan []RunEvent)
+		go func() {
+			events := []RunEvent{}
+			job.follow(context.Background(), func(ev RunEvent) { events = append(events, ev) })
+			got <- events
+		}()
+		job.stderr.Write([]byte("warning\n"))
+		job.send(RunEvent{Done: true, ExitCode: 2, RunId: 7})
+
+		assert.Equal(t, []RunEvent{
+			{Stream: "stdout", Data: "epoch 1\n"},
+			{Stream: "stderr", Data: "warning\n"},
+			{Done: true, ExitCode: 2, RunId: 7},
+		}, <-got)
+		assert.Equal(t, RunEvent{Done: true, ExitCode: 2, RunId: 7}, job.wait())
+		assert.Equal(t, "epoch 1\n", job.stdout.String())
+	})
+
+	t.Run("output is kept once, and a late follower gets all of it", func(t *testing.T) {
+		job := newRunJob(RunRequest{}, "app.py")
+		defer job.cancel()
+		job.send(RunEvent{Status: db.StatusRunning})
+		for i := 0; i < 1000; i++ {
+			job.stdout.Write([]byte("step\n"))
+		}
+		job.stderr.Write([]byte("warning\n"))
+		job.send(RunEvent{Done: true})
+		assert.Len(t, job.events, 2, "only changes of status are kept as events")
+
+		events := []RunEvent{}
+		job.follow(context.Background(), func(ev RunEvent) { events = append(events, ev) })
+		assert.Equal(t, []RunEvent{
+			{Status: db.StatusRunning},
+			{Stream: "stdout", Data: strings.Repeat("step\n", 1000)},
+			{Stream: "stderr", Data: "warning\n"},
+			{Done: true},
+		}, events)
+	})
+
+	t.Run("following stops when the client goes away", func(t *testing.T) {
+		job := newRunJob(RunRequest{}, "app.py")
+		defer job.cancel()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		stopped := make(chan struct{})
+		go func() {
+			job.follow(ctx, func(RunEvent) {})
+			close(stopped)
+		}()
+		cancel()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("follow didn't return after its context was cancelled")
+		}
+	})
+}
+
+func Test_runEndpoints(t *testing.T) {
+	require.NoError(t, db.Init(filepath.Join(t.TempDir(), "runs.db")))
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = nil
+	})
+
+	fs := &FS{jobs: make(map[int64]*runJob)}
+	// nothing is ever admitted, so runs stay queued
+	fs.queue = newRunQueue(0, scheduleFIFO, func(*runJob) {})
+	handler := http.NewServeMux()
+	handler.HandleFunc("GET /runs/{id}", fs.GetRun)
+	handler.HandleFunc("GET /runs/{id}/logs", fs.GetRunLogs)
+	handler.HandleFunc("DELETE /runs/{id}", fs.CancelRun)
+
+	finishedID, err := db.QueueRun("done.py", time.Now(), "alice", "{}", db.Limits{})
+	require.NoError(t, err)
+	require.NoError(t, db.StartRun(finishedID, "done.py", time.Now()))
+	require.NoError(t, db.FinishRun(finishedID, 1200, "hello\n", "oops\n", 1, 0, 0, 0, db.StatusFailed, ""))
+
+	runningID, err := db.QueueRun("train.py", time.Now(), "alice", "{}", db.Limits{})
+	require.NoError(t, err)
+	require.NoError(t, db.StartRun(runningID, "train.py", time.Now()))
+	job := newRunJob(RunRequest{}, "train.py")
+	defer job.cancel()
+	job.id = runningID
+	job.startedAt = time.Now()
+	job.setRunning()
+	job.stdout.Write([]byte("epoch 1\n"))
+	fs.jobs[runningID] = job
+
+	queuedID, err := db.QueueRun("eval.py", time.Now(), "bob", "{}", db.Limits{})
+	require.NoError(t, err)
+	queued := newRunJob(RunRequest{Username: "bob"}, "eval.py")
+	queued.id = queuedID
+	fs.jobs[queuedID] = queued
+	fs.queue.enqueue(queued)
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+	runPath := func(id int64, suffix string) string {
+		return "/runs/" + strconv.FormatInt(id, 10) + suffix
+	}
+
+	t.Run("status of a finished run comes from the database", func(t *testing.T) {
+		rec := do(http.MethodGet, runPath(finishedID, ""))
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status RunStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, db.StatusFailed, status.Status)
+		assert.Equal(t, 1, status.ExitCode)
+		assert.Equal(t, "done.py", status.Filename)
+		assert.Equal(t, int64(1200), status.DurationMs)
+	})
+
+	t.Run("status of a running run comes from the worker", func(t *testing.T) {
+		rec := do(http.MethodGet, runPath(runningID, ""))
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status RunStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, db.StatusRunning, status.Status)
+		assert.Equal(t, int(runningID), status.RunId)
+	})
+
+	t.Run("logs of running and finished runs", func(t *testing.T) {
+		var logs RunLogs
+		rec := do(http.MethodGet, runPath(runningID, "/logs"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+		assert.Equal(t, "epoch 1\n", logs.Stdout)
+
+		rec = do(http.MethodGet, runPath(finishedID, "/logs"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &logs))
+		assert.Equal(t, RunLogs{RunId: int(finishedID), Status: db.StatusFailed, Stdout: "hello\n", Stderr: "oops\n"}, logs)
+	})
+
+	t.Run("unknown and malformed run ids", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/runs/999").Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/runs/999").Code)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/runs/abc").Code)
+	})
+
+	t.Run("a finished run can't be cancelled", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, do(http.MethodDelete, runPath(finishedID, "")).Code)
+	})
+
+	t.Run("queued runs report their position and can be cancelled before they start", func(t *testing.T) {
+		rec := do(http.MethodGet, runPath(queuedID, ""))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status RunStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, db.StatusQueued, status.Status)
+		assert.Equal(t, 1, status.QueuePosition)
+
+		rec = do(http.MethodDelete, runPath(queuedID, ""))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+
+		assert.Equal(t, RunEvent{Done: true, RunId: int(queuedID), ExitCode: -1}, queued.wait())
+		record, err := db.GetRun(queuedID)
+		require.NoError(t, err)
+		assert.Equal(t, db.StatusCancelled, record.Status)
+		queuedRuns, err := db.QueuedRuns()
+		require.NoError(t, err)
+		assert.Empty(t, queuedRuns)
+	})
+}
+
+func Test_requeue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs.db")
+	require.NoError(t, db.Init(path))
+	t.Cleanup(func() {
+		db.DB.Close()
+		db.DB = nil
+	})
+
+	request, err := json.Marshal(RunRequest{FileName: "eval.py", Username: "bob", Args: []string{"--fast"}})
+	require.NoError(t, err)
+	queuedID, err := db.QueueRun("eval.py", time.Now(), "bob", string(request), db.Limits{})
+	require.NoError(t, err)
+	brokenID, err := db.QueueRun("broken.py", time.Now(), "bob", "not json", db.Limits{})
+	require.NoError(t, err)
+	runningID, err := db.QueueRun("train.py", time.Now(), "alice", "{}", db.Limits{})
+	require.NoError(t, err)
+	require.NoError(t, db.StartRun(runningID, "train.py", time.Now()))
+
+	// the worker restarts
+	db.DB.Close()
+	require.NoError(t, db.Init(path))
+	fs := &FS{jobs: make(map[int64]*runJob)}
+	fs.queue = newRunQueue(0, scheduleFIFO, func(*runJob) {})
+	require.NoError(t, fs.requeue())
+
+	job, ok := fs.runningJob(queuedID)
+	require.True(t, ok, "queued run is back in the queue")
+	defer job.cancel()
+	assert.Equal(t, []string{"--fast"}, job.req.Args)
+	assert.Equal(t, db.StatusQueued, job.status().Status)
+	assert.Equal(t, 1, job.status().QueuePosition)
+
+	broken, err := db.GetRun(brokenID)
+	require.NoError(t, err)
+	assert.Equal(t, db.StatusFailed, broken.Status)
+	interrupted, err := db.GetRun(runningID)
+	require.NoError(t, err)
+	assert.Equal(t, db.StatusFailed, interrupted.Status)
+	assert.Equal(t, "worker restarted before the run finished", interrupted.Error)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
@@ -13,15 +14,52 @@ import (
 
 func main() {
 	debug := flag.Bool("debug", false, "enable FUSE debug logging")
+	flag.BoolVar(&useOverlay, "overlay", true, "give each run a private writable overlayfs layer over the image")
+	flag.IntVar(&maxRunning, "max-runs", maxRunning, "maximum number of containers running at once; further runs wait in a queue")
+	flag.StringVar(&schedulePolicy, "schedule", schedulePolicy, "order queued runs start in: fifo, or fair to take turns between users")
+	tokensFile := flag.String("tokens", _defaultTokensFile, "file of API tokens allowed to run containers")
+	noAuth := flag.Bool("no-auth", false, "let anyone run containers without a token")
+	caFile := flag.String("ca", "", "PEM bundle of CAs the fileserver's certificate must chain to (default: the system's)")
+	fingerprint := flag.String("fingerprint", "", "only trust the fileserver certificate with this SHA-256, as the fileserver logs it")
+	certFile := flag.String("cert", "server.crt", "TLS certificate, with any intermediates after it")
+	keyFile := flag.String("key", "server.key", "private key of the TLS certificate")
+	flag.Func("max-memory", "most memory a run can ask for, e.g. 16G (default 16G)", func(s string) error {
+		n, err := parseBytes(s)
+		maxResources.Memory = n
+		return err
+	})
+	flag.Float64Var(&maxResources.CPUs, "max-cpus", maxResources.CPUs, "most CPUs a run can ask for")
+	flag.Int64Var(&maxResources.Pids, "max-pids", maxResources.Pids, "most processes a run can ask for")
+	flag.DurationVar(&maxResources.Timeout, "max-timeout", maxResources.Timeout, "longest timeout a run can ask for")
 	flag.Parse()
 	if len(flag.Args()) < 1 {
 		log.Fatal("Usage:\n  hello MOUNTPOINT")
 	}
+	if maxRunning < 1 {
+		log.Fatal("-max-runs must be at least 1")
+	}
+	if err := validSchedulePolicy(schedulePolicy); err != nil {
+		log.Fatal(err)
+	}
+	if maxResources.Memory <= 0 || maxResources.CPUs <= 0 || maxResources.Pids <= 0 || maxResources.Timeout <= 0 {
+		log.Fatal("-max-memory, -max-cpus, -max-pids and -max-timeout must be positive")
+	}
+	if *caFile != "" || *fingerprint != "" {
+		var err error
+		if fileserverTLS, err = clientTLSConfig(*caFile, *fingerprint); err != nil {
+			log.Fatalf("fileserver TLS: %v", err)
+		}
+	}
+	// tokens are sent with every request, so the worker only serves TLS
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("loading TLS certificate: %v\nMake one with sway tls init, or pass -cert and -key", err)
+	}
 	absMount, err := filepath.Abs(flag.Arg(0))
 	if err != nil {
 		log.Fatalf("invalid mount path: %v", err)
 	}
-	rootfsPath = filepath.Join(absMount, "app")
+	mountPath = absMount
 
 	opts := &fusefs.Options{}
 	cmd := exec.Command("umount", flag.Arg(0))
@@ -40,21 +78,40 @@ func main() {
 	root := NewFS(flag.Arg(0))
 	root.root = root.newDir("/") // Explicitly set the root directory
 
+	// anyone who can run a container is root in it, so running takes a token
+	auth := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if *noAuth {
+		log.Println("Warning: authentication is off, anyone who can reach the worker can run containers")
+	} else {
+		tokens, err := newTokenStore(*tokensFile)
+		if err != nil {
+			log.Fatalf("loading API tokens: %v\nCopy lines from the fileserver's tokens file, or start with -no-auth", err)
+		}
+		auth = tokens.requireToken
+	}
+
 	// start up web server
 	handler := http.NewServeMux()
-	handler.HandleFunc("/run", root.Run)
+	handler.HandleFunc("/run", auth(root.Run))
+	handler.HandleFunc("POST /runs", auth(root.SubmitRun))
+	handler.HandleFunc("GET /runs/{id}", auth(root.GetRun))
+	handler.HandleFunc("GET /runs/{id}/logs", auth(root.GetRunLogs))
+	handler.HandleFunc("DELETE /runs/{id}", auth(root.CancelRun))
 	handler.HandleFunc("/run/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "./website/index.html")
 	})
-	handler.HandleFunc("/stats", Stats)
+	handler.HandleFunc("/stats", auth(Stats))
 	handler.Handle("/", http.FileServer(http.Dir("./website")))
 	httpserver := &http.Server{
-		Addr:    ":8444",
-		Handler: handler,
+		Addr:      ":8444",
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
 	}
+	// clients that pin the certificate instead of trusting a CA need this
+	log.Printf("Certificate fingerprint: %s", certFingerprint(cert))
 	go func() {
-		log.Println("Starting HTTP server on :8444")
-		if err := httpserver.ListenAndServe(); err != nil {
+		log.Println("Starting HTTPS server on :8444")
+		if err := httpserver.ListenAndServeTLS("", ""); err != nil {
 			log.Printf("HTTP server error: %v", err)
 		}
 	}()
@@ -62,5 +119,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Mount fail: %v\n", err)
 	}
+	// runs need the mount, so only now can the ones queued before a restart start
+	if err := root.requeue(); err != nil {
+		log.Printf("Warning: failed to restore queued runs: %v", err)
+	}
 	server.Wait()
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// _runsDir holds the writable layers of every run, as <runsDir>/<container id>/
+// {upper,work,merged} for the rootfs and <runsDir>/<container id>/project/... for the
+// project directory.
+const _runsDir = "runs"
+
+// useOverlay gives each run a private writable layer over the image. Set once at
+// startup from the -overlay flag.
+var useOverlay = true
+
+// overlay is a run's writable rootfs: an overlayfs with the image's read-only FUSE
+// tree as the lower layer and a fresh directory as the upper layer. Everything the
+// container writes lands in the upper layer, so runs never see each other's files and
+// the shared FUSE tree stays read-only.
+type overlay struct {
+	dir    string
+	upper  string
+	work   string
+	merged string
+}
+
+// mountOverlay mounts a new writable layer for run id over lower.
+func mountOverlay(lower, id string) (*overlay, error) {
+	dir, err := filepath.Abs(filepath.Join(_runsDir, id))
+	if err != nil {
+		return nil, err
+	}
+	o := &overlay{
+		dir:    dir,
+		upper:  filepath.Join(dir, "upper"),
+		work:   filepath.Join(dir, "work"),
+		merged: filepath.Join(dir, "merged"),
+	}
+	for _, d := range []string{o.upper, o.work, o.merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, o.upper, o.work)
+	out, err := exec.Command("sudo", "mount", "-t", "overlay", "overlay", "-o", opts, o.merged).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("mount overlay: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return o, nil
+}
+
+// unmount unmounts the overlay. Unless keep is set, the writable layer is deleted;
+// otherwise the upper directory is left in place for inspection and the path of the
+// directory holding it returned.
+// The container writes as root, so removal goes through sudo like runc does.
+func (o *overlay) unmount(keep bool) (string, error) {
+	if out, err := exec.Command("sudo", "umount", o.merged).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("unmount overlay: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if keep {
+		exec.Command("sudo", "rm", "-rf", o.work, o.merged).Run()
+		return o.dir, nil
+	}
+	if out, err := exec.Command("sudo", "rm", "-rf", o.dir).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("remove writable layer: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return "", nil
+}
+
+// runMounts is everything mounted for one run: a view of its image, a view of its
+// project directory if it has one, and the writable layers on top of both.
+type runMounts struct {
+	fs           *FS
+	id           string
+	view         *view    // the image view, whose stats are logged for the run
+	imageRootfs  string   // the image view, read-only
+	rootfs       string   // the container's root
+	project      string   // the project tree, bind mounted at the working directory; "" without a project
+	rootfsLayer  *overlay // nil without -overlay
+	projectLayer *overlay
+}
+
+// mountRun mounts the views and writable layers of run id.
+func (fs *FS) mountRun(id string, req RunRequest) (*runMounts, error) {
+	m := &runMounts{fs: fs, id: id}
+	m.view, m.imageRootfs = fs.mountRunView(id, req.Image, false)
+	m.rootfs = m.imageRootfs
+	if useOverlay {
+		layer, err := mountOverlay(m.imageRootfs, id)
+		if err != nil {
+			m.release(false)
+			return nil, fmt.Errorf("create writable rootfs: %w", err)
+		}
+		m.rootfsLayer = layer
+		m.rootfs = layer.merged
+	}
+	if req.Project == "" {
+		return m, nil
+	}
+
+	_, m.project = fs.mountRunView(m.projectViewName(), req.Project, true)
+	if useOverlay {
+		layer, err := mountOverlay(m.project, filepath.Join(id, "project"))
+		if err != nil {
+			m.release(false)
+			return nil, fmt.Errorf("create writable project directory: %w", err)
+		}
+		m.projectLayer = layer
+		m.project = layer.merged
+	}
+	return m, nil
+}
+
+func (m *runMounts) projectViewName() string {
+	return m.id + "-project"
+}
+
+// release unmounts everything mountRun mounted. With keep, the writable layers stay on
+// the worker and the directory holding them is returned.
+func (m *runMounts) release(keep bool) (string, error) {
+	var errs []error
+	// the project layer lives inside the rootfs layer's directory, so it goes first
+	if m.projectLayer != nil {
+		if _, err := m.projectLayer.unmount(keep); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	kept := ""
+	if m.rootfsLayer != nil {
+		dir, err := m.rootfsLayer.unmount(keep)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		kept = dir
+	}
+	m.fs.removeView(m.projectViewName())
+	m.fs.removeView(m.id)
+	return kept, errors.Join(errs...)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Scheduling policies of the run queue.
+const (
+	scheduleFIFO = "fifo" // runs start in the order they were submitted
+	scheduleFair = "fair" // users take turns, the one with the fewest running containers first
+)
+
+// maxRunning and schedulePolicy configure the run queue. Set once at startup from flags.
+var (
+	maxRunning     = 2
+	schedulePolicy = scheduleFIFO
+)
+
+func validSchedulePolicy(policy string) error {
+	if policy != scheduleFIFO && policy != scheduleFair {
+		return fmt.Errorf("unknown schedule policy %q, want %s or %s", policy, scheduleFIFO, scheduleFair)
+	}
+	return nil
+}
+
+// runQueue admits runs to the worker, at most max containers at a time. Runs wait in
+// the queue until a slot frees up; waiting runs are told their position whenever it
+// changes.
+type runQueue struct {
+	mu      sync.Mutex
+	max     int
+	policy  string
+	pending []*runJob      // in submission order
+	running map[string]int // username to number of running containers
+	total   int
+	starts  uint64            // runs started so far
+	last    map[string]uint64 // username to the starts count when their last run started
+	start   func(*runJob)     // called in a goroutine of its own for every admitted run
+}
+
+func newRunQueue(max int, policy string, start func(*runJob)) *runQueue {
+	return &runQueue{
+		max:     max,
+		policy:  policy,
+		running: make(map[string]int),
+		last:    make(map[string]uint64),
+		start:   start,
+	}
+}
+
+// enqueue adds job to the queue, starting it straight away if there is a free slot.
+func (q *runQueue) enqueue(job *runJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, job)
+	q.dispatch()
+}
+
+// done frees the slot of a run that was started.
+func (q *runQueue) done(job *runJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.total--
+	q.running[job.req.Username]--
+	if q.running[job.req.Username] <= 0 {
+		delete(q.running, job.req.Username)
+	}
+	q.dispatch()
+}
+
+// remove takes job out of the queue. It reports false if job isn't waiting, because it
+// has been started already.
+func (q *runQueue) remove(job *runJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			q.dispatch()
+			return true
+		}
+	}
+	return false
+}
+
+// order returns the waiting runs in the order they would start if nothing else were
+// submitted.
+func (q *runQueue) order() []*runJob {
+	if q.policy != scheduleFair {
+		return append([]*runJob(nil), q.pending...)
+	}
+
+	// the next run is the oldest one of the user with the fewest running containers,
+	// and of those the user whose turn was longest ago, counting the runs this order
+	// has started so far
+	running := make(map[string]int, len(q.running))
+	for user, n := range q.running {
+		running[user] = n
+	}
+	last := make(map[string]uint64, len(q.last))
+	for user, n := range q.last {
+		last[user] = n
+	}
+	starts := q.starts
+	before := func(a, b string) bool {
+		if running[a] != running[b] {
+			return running[a] < running[b]
+		}
+		return last[a] < last[b]
+	}
+
+	remaining := append([]*runJob(nil), q.pending...)
+	order := make([]*runJob, 0, len(remaining))
+	for len(remaining) > 0 {
+		next := 0
+		for i, job := range remaining {
+			if before(job.req.Username, remaining[next].req.Username) {
+				next = i
+			}
+		}
+		job := remaining[next]
+		starts++
+		running[job.req.Username]++
+		last[job.req.Username] = starts
+		order = append(order, job)
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	return order
+}
+
+// dispatch starts waiting runs while there are free slots and tells the rest where
+// they are in the queue. Callers must hold q.mu.
+func (q *runQueue) dispatch() {
+	order := q.order()
+	for q.total < q.max && len(order) > 0 {
+		job := order[0]
+		order = order[1:]
+		for i, pending := range q.pending {
+			if pending == job {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		q.total++
+		q.starts++
+		q.running[job.req.Username]++
+		q.last[job.req.Username] = q.starts
+		job.setRunning()
+		go q.start(job)
+	}
+	for i, job := range order {
+		job.setQueued(i + 1)
+	}
+}
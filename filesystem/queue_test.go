@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lastnameswayne/tinycontainer/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runQueue(t *testing.T) {
+	newJob := func(user, name string) *runJob {
+		job := newRunJob(RunRequest{Username: user}, name)
+		t.Cleanup(job.cancel)
+		return job
+	}
+	started := func(t *testing.T, ch chan *runJob) string {
+		t.Helper()
+		select {
+		case job := <-ch:
+			return job.fileName
+		case <-time.After(time.Second):
+			t.Fatal("no run started")
+			return ""
+		}
+	}
+	assertNoneStarted := func(t *testing.T, ch chan *runJob) {
+		t.Helper()
+		select {
+		case job := <-ch:
+			t.Fatalf("%s started with no free slot", job.fileName)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	t.Run("fifo starts runs in submission order, at most max at a time", func(t *testing.T) {
+		ch := make(chan *runJob, 10)
+		q := newRunQueue(2, scheduleFIFO, func(job *runJob) { ch <- job })
+		a, b, c, d := newJob("alice", "a"), newJob("alice", "b"), newJob("bob", "c"), newJob("alice", "d")
+		for _, job := range []*runJob{a, b, c, d} {
+			q.enqueue(job)
+		}
+
+		assert.ElementsMatch(t, []string{"a", "b"}, []string{started(t, ch), started(t, ch)})
+		assertNoneStarted(t, ch)
+		assert.Equal(t, db.StatusQueued, c.status().Status)
+		assert.Equal(t, 1, c.status().QueuePosition)
+		assert.Equal(t, 2, d.status().QueuePosition)
+		assert.Equal(t, db.StatusRunning, a.status().Status)
+
+		q.done(a)
+		assert.Equal(t, "c", started(t, ch))
+		assert.Equal(t, 1, d.status().QueuePosition)
+		q.done(b)
+		assert.Equal(t, "d", started(t, ch))
+	})
+
+	t.Run("fair lets the user with the fewest running containers go first", func(t *testing.T) {
+		ch := make(chan *runJob, 10)
+		q := newRunQueue(1, scheduleFair, func(job *runJob) { ch <- job })
+		a1, a2, a3, b1 := newJob("alice", "a1"), newJob("alice", "a2"), newJob("alice", "a3"), newJob("bob", "b1")
+		for _, job := range []*runJob{a1, a2, a3, b1} {
+			q.enqueue(job)
+		}
+
+		assert.Equal(t, "a1", started(t, ch))
+		assert.Equal(t, 1, b1.status().QueuePosition)
+		assert.Equal(t, 2, a2.status().QueuePosition)
+		assert.Equal(t, 3, a3.status().QueuePosition)
+
+		q.done(a1)
+		assert.Equal(t, "b1", started(t, ch))
+		q.done(b1)
+		assert.Equal(t, "a2", started(t, ch))
+	})
+
+	t.Run("removed runs never start and the rest move up", func(t *testing.T) {
+		ch := make(chan *runJob, 10)
+		q := newRunQueue(1, scheduleFIFO, func(job *runJob) { ch <- job })
+		a, b, c := newJob("alice", "a"), newJob("bob", "b"), newJob("carol", "c")
+		for _, job := range []*runJob{a, b, c} {
+			q.enqueue(job)
+		}
+		assert.Equal(t, "a", started(t, ch))
+
+		assert.True(t, q.remove(b))
+		assert.False(t, q.remove(a), "a running run isn't in the queue")
+		assert.Equal(t, 1, c.status().QueuePosition)
+
+		q.done(a)
+		assert.Equal(t, "c", started(t, ch))
+		assertNoneStarted(t, ch)
+	})
+
+	t.Run("followers are told their position and when the run starts", func(t *testing.T) {
+		ch := make(chan *runJob, 10)
+		q := newRunQueue(1, scheduleFIFO, func(job *runJob) { ch <- job })
+		a, b, c := newJob("alice", "a"), newJob("bob", "b"), newJob("carol", "c")
+		for _, job := range []*runJob{a, b, c} {
+			q.enqueue(job)
+		}
+		started(t, ch)
+		q.done(a)
+		started(t, ch)
+		q.done(b)
+		started(t, ch)
+		c.send(RunEvent{Done: true})
+
+		events := []RunEvent{}
+		c.follow(t.Context(), func(ev RunEvent) { events = append(events, ev) })
+		require.Len(t, events, 4)
+		assert.Equal(t, RunEvent{Status: db.StatusQueued, QueuePosition: 2}, events[0])
+		assert.Equal(t, RunEvent{Status: db.StatusQueued, QueuePosition: 1}, events[1])
+		assert.Equal(t, RunEvent{Status: db.StatusRunning}, events[2])
+	})
+}
+
+func Test_validSchedulePolicy(t *testing.T) {
+	assert.NoError(t, validSchedulePolicy(scheduleFIFO))
+	assert.NoError(t, validSchedulePolicy(scheduleFair))
+	assert.Error(t, validSchedulePolicy("lifo"))
+}
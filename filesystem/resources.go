@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lastnameswayne/tinycontainer/db"
+)
+
+// RunResources are the limits a run asks for. Zero fields take the worker's defaults.
+type RunResources struct {
+	Memory  int64         // bytes
+	CPUs    float64       // cores, may be fractional
+	Pids    int64         // processes and threads
+	Timeout time.Duration // wall clock, from when the container starts
+}
+
+// _defaultResources are what a run gets when it doesn't ask for anything.
+var _defaultResources = RunResources{
+	Memory:  1 << 30,
+	CPUs:    1,
+	Pids:    128,
+	Timeout: 30 * time.Minute,
+}
+
+// maxResources caps what a run can ask for. Set once at startup from flags.
+var maxResources = RunResources{
+	Memory:  16 << 30,
+	CPUs:    4,
+	Pids:    4096,
+	Timeout: 6 * time.Hour,
+}
+
+// _cpuPeriod is the CFS period the CPU quota is a share of.
+const _cpuPeriod = 100000
+
+// resolveResources fills in the defaults for what req leaves unset and checks it
+// against max. Defaults above max are lowered to it.
+func resolveResources(req, max RunResources) (RunResources, error) {
+	if req.Memory < 0 || req.CPUs < 0 || req.Pids < 0 || req.Timeout < 0 {
+		return RunResources{}, fmt.Errorf("resource limits can't be negative")
+	}
+	if req.CPUs > 0 && req.CPUs*_cpuPeriod < 1000 {
+		return RunResources{}, fmt.Errorf("cpus must be at least 0.01")
+	}
+
+	res := req
+	if res.Memory == 0 {
+		res.Memory = min(_defaultResources.Memory, max.Memory)
+	}
+	if res.CPUs == 0 {
+		res.CPUs = min(_defaultResources.CPUs, max.CPUs)
+	}
+	if res.Pids == 0 {
+		res.Pids = min(_defaultResources.Pids, max.Pids)
+	}
+	if res.Timeout == 0 {
+		res.Timeout = min(_defaultResources.Timeout, max.Timeout)
+	}
+
+	switch {
+	case res.Memory > max.Memory:
+		return RunResources{}, fmt.Errorf("memory %s is over the worker's maximum of %s", formatBytes(res.Memory), formatBytes(max.Memory))
+	case res.CPUs > max.CPUs:
+		return RunResources{}, fmt.Errorf("cpus %g is over the worker's maximum of %g", res.CPUs, max.CPUs)
+	case res.Pids > max.Pids:
+		return RunResources{}, fmt.Errorf("pids %d is over the worker's maximum of %d", res.Pids, max.Pids)
+	case res.Timeout > max.Timeout:
+		return RunResources{}, fmt.Errorf("timeout %s is over the worker's maximum of %s", res.Timeout, max.Timeout)
+	}
+	return res, nil
+}
+
+// linux returns the cgroup limits of res for the runc config. Swap is not allowed on
+// top of the memory limit.
+func (res RunResources) linux() *LinuxResources {
+	return &LinuxResources{
+		Memory: &LinuxMemory{Limit: int64Ptr(res.Memory), Swap: int64Ptr(res.Memory)},
+		CPU:    &LinuxCPU{Quota: int64Ptr(int64(res.CPUs * _cpuPeriod)), Period: uint64Ptr(_cpuPeriod)},
+		Pids:   &LinuxPids{Limit: res.Pids},
+	}
+}
+
+// limits is res as recorded in the runs database.
+func (res RunResources) limits() db.Limits {
+	return db.Limits{
+		MemoryLimit: res.Memory,
+		CPULimit:    res.CPUs,
+		PidsLimit:   res.Pids,
+		TimeoutMs:   res.Timeout.Milliseconds(),
+	}
+}
+
+var _byteUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseBytes parses sizes like 512M or 8G, in powers of 1024 like docker run --memory.
+// KB, KiB and K are all the same. The worker and sway each have a copy; both are
+// tested against testdata/sizes.json, so sway refuses what the worker would.
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], s[i:]
+	if strings.HasSuffix(unit, "IB") {
+		unit = strings.TrimSuffix(unit, "IB")
+	} else if len(unit) > 1 {
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	multiplier, ok := _byteUnits[unit]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q, want e.g. 512M or 8G", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func formatBytes(n int64) string {
+	for _, unit := range []string{"T", "G", "M", "K"} {
+		if m := _byteUnits[unit]; n >= m && n%m == 0 {
+			return strconv.FormatInt(n/m, 10) + unit
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resolveResources(t *testing.T) {
+	max := RunResources{Memory: 8 << 30, CPUs: 4, Pids: 1024, Timeout: time.Hour}
+
+	t.Run("unset limits take the defaults", func(t *testing.T) {
+		res, err := resolveResources(RunResources{}, max)
+		require.NoError(t, err)
+		assert.Equal(t, _defaultResources, res)
+	})
+
+	t.Run("requested limits are kept", func(t *testing.T) {
+		res, err := resolveResources(RunResources{Memory: 8 << 30, CPUs: 0.5, Timeout: time.Minute}, max)
+		require.NoError(t, err)
+		assert.Equal(t, RunResources{Memory: 8 << 30, CPUs: 0.5, Pids: 128, Timeout: time.Minute}, res)
+	})
+
+	t.Run("defaults above the maximum are lowered to it", func(t *testing.T) {
+		res, err := resolveResources(RunResources{}, RunResources{Memory: 512 << 20, CPUs: 0.5, Pids: 64, Timeout: time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, RunResources{Memory: 512 << 20, CPUs: 0.5, Pids: 64, Timeout: time.Minute}, res)
+	})
+
+	t.Run("limits over the maximum are rejected", func(t *testing.T) {
+		_, err := resolveResources(RunResources{Memory: 16 << 30}, max)
+		assert.EqualError(t, err, "memory 16G is over the worker's maximum of 8G")
+		_, err = resolveResources(RunResources{CPUs: 8}, max)
+		assert.Error(t, err)
+		_, err = resolveResources(RunResources{Pids: 2048}, max)
+		assert.Error(t, err)
+		_, err = resolveResources(RunResources{Timeout: 2 * time.Hour}, max)
+		assert.Error(t, err)
+	})
+
+	t.Run("negative and tiny limits are rejected", func(t *testing.T) {
+		_, err := resolveResources(RunResources{Memory: -1}, max)
+		assert.Error(t, err)
+		_, err = resolveResources(RunResources{CPUs: 0.001}, max)
+		assert.Error(t, err)
+	})
+}
+
+// Test_parseBytes reads its cases from the repository's testdata, which sway's
+// copy of parseBytes is tested against too, so the two can't disagree.
+func Test_parseBytes(t *testing.T) {
+	data, err := os.ReadFile("../testdata/sizes.json")
+	require.NoError(t, err)
+	var cases struct {
+		Valid   map[string]int64
+		Invalid []string
+	}
+	require.NoError(t, json.Unmarshal(data, &cases))
+	require.NotEmpty(t, cases.Valid)
+
+	for in, want := range cases.Valid {
+		got, err := parseBytes(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+	for _, in := range cases.Invalid {
+		_, err := parseBytes(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func Test_runSpecResources(t *testing.T) {
+	process, err := runProcess(RunRequest{FileName: "alice_app.py"}, ImageConfig{}, t.TempDir())
+	require.NoError(t, err)
+
+	data, err := json.Marshal(runSpec(process, "/mnt/c1", "/lib64", RunResources{Memory: 8 << 30, CPUs: 2.5, Pids: 256, Timeout: time.Minute}))
+	require.NoError(t, err)
+
+	var config struct {
+		Linux struct {
+			Resources struct {
+				Memory  map[string]int64 `json:"memory"`
+				CPU     map[string]int64 `json:"cpu"`
+				Pids    map[string]int64 `json:"pids"`
+				Devices []map[string]any `json:"devices"`
+			} `json:"resources"`
+		} `json:"linux"`
+	}
+	require.NoError(t, json.Unmarshal(data, &config))
+	res := config.Linux.Resources
+	assert.Equal(t, map[string]int64{"limit": 8 << 30, "swap": 8 << 30}, res.Memory)
+	assert.Equal(t, map[string]int64{"quota": 250000, "period": 100000}, res.CPU)
+	assert.Equal(t, map[string]int64{"limit": 256}, res.Pids)
+	assert.Len(t, res.Devices, 1)
+}
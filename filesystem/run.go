@@ -1,22 +1,29 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/lastnameswayne/tinycontainer/db"
 )
 
-// rootfsPath is the absolute path to the FUSE mount's app directory, used as
-// the runc container rootfs. Set once at startup from the CLI mount argument.
-var rootfsPath string
+// mountPath is the absolute path of the FUSE mount. Each run's view of its image is a
+// directory under it, used as the runc container rootfs. Set once at startup from the CLI mount argument.
+var mountPath string
+
+// imageRefRegex matches fileserver image references of the form name@digest.
+var imageRefRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+@[a-f0-9]+$`)
+
+// scriptNameRegex matches the file names accepted for a run's script.
+var scriptNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
 
 var ansiRegex = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]`)
 
@@ -25,202 +32,46 @@ func stripANSI(s string) string {
 }
 
 type RunRequest struct {
-	FileName string
-	Username string
+	FileName   string   // with Project, the script's path inside the project
+	Project    string   // image holding the project directory, mounted at the working directory
+	Username   string   // replaced by the token's user when the worker checks tokens
+	Image      string   // name@digest reference; empty runs against the default image
+	KeepRootfs bool     // keep the run's writable layer on the worker instead of deleting it
+	Args       []string // passed to the script after its path
+	Env        []string // KEY=VAL, added to the default environment
+	Entrypoint []string // runs the script instead of /usr/bin/env python3
+	Resources  RunResources
 }
 
-var runcConfigTemplateStr = `{
-    "ociVersion": "1.2.0",
-    "process": {
-        "terminal": false,
-        "user": {
-            "uid": 0,
-            "gid": 0
-        },
-        "args": [
-            "/usr/bin/env",
-            "python3",
-            "/%s"
-        ],
-        "env": [
-            "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-            "TERM=xterm"
-        ],
-        "cwd": "/",
-        "capabilities": {
-            "bounding": [
-                "CAP_AUDIT_WRITE",
-                "CAP_KILL",
-                "CAP_NET_BIND_SERVICE"
-            ],
-            "effective": [
-                "CAP_AUDIT_WRITE",
-                "CAP_KILL",
-                "CAP_NET_BIND_SERVICE"
-            ],
-            "permitted": [
-                "CAP_AUDIT_WRITE",
-                "CAP_KILL",
-                "CAP_NET_BIND_SERVICE"
-            ]
-        },
-        "rlimits": [
-            {
-                "type": "RLIMIT_NOFILE",
-                "hard": 1024,
-                "soft": 1024
-            }
-        ],
-        "noNewPrivileges": true
-    },
-    "root": {
-        "path": "%s",
-        "readonly": false
-    },
-    "hostname": "runc",
-    "mounts": [
-        {
-            "destination": "/proc",
-            "type": "proc",
-            "source": "proc"
-        },
-        {
-            "destination": "/lib64",
-            "type": "bind",
-            "source": "%s",
-            "options": ["rbind", "ro"]
-        },
-        {
-            "destination": "/dev",
-            "type": "tmpfs",
-            "source": "tmpfs",
-            "options": [
-                "nosuid",
-                "strictatime",
-                "mode=755",
-                "size=65536k"
-            ]
-        },
-        {
-            "destination": "/dev/pts",
-            "type": "devpts",
-            "source": "devpts",
-            "options": [
-                "nosuid",
-                "noexec",
-                "newinstance",
-                "ptmxmode=0666",
-                "mode=0620",
-                "gid=5"
-            ]
-        },
-        {
-            "destination": "/dev/shm",
-            "type": "tmpfs",
-            "source": "shm",
-            "options": [
-                "nosuid",
-                "noexec",
-                "nodev",
-                "mode=1777",
-                "size=65536k"
-            ]
-        },
-        {
-            "destination": "/dev/mqueue",
-            "type": "mqueue",
-            "source": "mqueue",
-            "options": [
-                "nosuid",
-                "noexec",
-                "nodev"
-            ]
-        },
-        {
-            "destination": "/sys",
-            "type": "sysfs",
-            "source": "sysfs",
-            "options": [
-                "nosuid",
-                "noexec",
-                "nodev",
-                "ro"
-            ]
-        },
-        {
-            "destination": "/sys/fs/cgroup",
-            "type": "cgroup",
-            "source": "cgroup",
-            "options": [
-                "nosuid",
-                "noexec",
-                "nodev",
-                "relatime",
-                "ro"
-            ]
-        }
-    ],
-    "linux": {
-        "resources": {
-            "memory": {
-                "limit": 1073741824,
-                "swap": 1073741824
-            },
-            "cpu": {
-                "quota": 100000,
-                "period": 100000
-            },
-            "pids": {
-                "limit": 128
-            },
-            "devices": [
-                {
-                    "allow": false,
-                    "access": "rwm"
-                }
-            ]
-        },
-        "namespaces": [
-            {"type": "pid"},
-            {"type": "network"},
-            {"type": "ipc"},
-            {"type": "uts"},
-            {"type": "mount"},
-            {"type": "cgroup"}
-        ],
-        "maskedPaths": [
-            "/proc/acpi",
-            "/proc/asound",
-            "/proc/kcore",
-            "/proc/keys",
-            "/proc/latency_stats",
-            "/proc/timer_list",
-            "/proc/timer_stats",
-            "/proc/sched_debug",
-            "/sys/firmware",
-            "/proc/scsi"
-        ],
-        "readonlyPaths": [
-            "/proc/bus",
-            "/proc/fs",
-            "/proc/irq",
-            "/proc/sys",
-            "/proc/sysrq-trigger"
-        ]
-    }
-}
-`
-
-const _runcTimeout = 30 * time.Minute
-
 type RunResponse struct {
 	Stdout   string `json:"stdout"`
 	Stderr   string `json:"stderr"`
 	ExitCode int    `json:"exit_code"`
 	Error    string `json:"error,omitempty"`
 	RunId    int    `json:"run_id"`
+	UpperDir string `json:"upper_dir,omitempty"` // where the writable layer was kept, with KeepRootfs
 }
 
+// runError is a run that could not be started, with the status to answer with.
+type runError struct {
+	status int
+	msg    string
+}
+
+func (e *runError) Error() string { return e.msg }
+
+func writeRunError(w http.ResponseWriter, err error) {
+	if re, ok := err.(*runError); ok {
+		http.Error(w, re.msg, re.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Run runs a container and answers once it is done, or streams its output as it is
+// produced if the client asked for application/x-ndjson. The run doesn't depend on the
+// connection: if the client goes away it carries on and can be followed with
+// GET /runs/{id}/logs.
 func (fs *FS) Run(w http.ResponseWriter, r *http.Request) {
 	req := RunRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -228,98 +79,201 @@ func (fs *FS) Run(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	fileName := req.FileName
-	if fileName == "" {
-		http.Error(w, "filename is required", http.StatusBadRequest)
-		return
+	if u, ok := requestUser(r); ok {
+		req.Username = u.Name
 	}
-	matched, _ := regexp.MatchString(`^[a-zA-Z0-9_.\-]+$`, fileName)
-	if !matched {
-		http.Error(w, "invalid filename", http.StatusBadRequest)
+
+	job, err := fs.submitRun(req)
+	if err != nil {
+		writeRunError(w, err)
 		return
 	}
 
-	fs.ClearNotFound()
-
-	// create a per-run bundle directory so concurrent runs don't share config.json
-	bundleDir, err := os.MkdirTemp("", "runc-bundle-*")
-	if err != nil {
-		http.Error(w, "Failed to create bundle dir: "+err.Error(), http.StatusInternalServerError)
+	if r.Header.Get("Accept") == _ndjsonContentType {
+		events := newEventStream(w)
+		// tell the client which run this is before any output, so it can reattach
+		if job.id != 0 {
+			events.send(RunEvent{RunId: int(job.id)})
+		}
+		job.follow(r.Context(), events.send)
 		return
 	}
-	defer os.RemoveAll(bundleDir)
 
-	runcConfig := fmt.Sprintf(runcConfigTemplateStr, fileName, rootfsPath, filepath.Join(rootfsPath, "usr", "lib64"))
-	if err := os.WriteFile(filepath.Join(bundleDir, "config.json"), []byte(runcConfig), 0644); err != nil {
-		http.Error(w, "Failed to write config: "+err.Error(), http.StatusInternalServerError)
+	final := job.wait()
+	if final.Error != "" {
+		http.Error(w, final.Error, http.StatusInternalServerError)
 		return
 	}
 
-	// run runc command
-	startTime := time.Now()
-	containerID := fmt.Sprintf("container-%d", time.Now().UnixNano())
-	ctx, cancel := context.WithTimeout(context.Background(), _runcTimeout)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, "sudo", "runc", "run", "--bundle", bundleDir, containerID)
+	// write stdout back to user
+	response := RunResponse{
+		RunId:    final.RunId,
+		Stdout:   job.stdout.String(),
+		Stderr:   job.stderr.String(),
+		ExitCode: final.ExitCode,
+		UpperDir: final.UpperDir,
+	}
 
-	stdout, err := cmd.Output()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	exec.Command("sudo", "runc", "delete", containerID).Run()
-	duration := time.Since(startTime)
-	exitCode := 0
-	stderrStr := ""
+// submitRun checks req and queues it. Setup errors are *runError; the rest of the
+// setup happens once the run leaves the queue.
+func (fs *FS) submitRun(req RunRequest) (*runJob, error) {
+	// without a script the image's own command runs
+	fileName := req.FileName
+	if fileName != "" && !validScriptPath(fileName, req.Project != "") {
+		return nil, &runError{http.StatusBadRequest, "invalid filename"}
+	}
 
+	if req.Image != defaultImage && !imageRefRegex.MatchString(req.Image) {
+		return nil, &runError{http.StatusBadRequest, "invalid image reference"}
+	}
+	if req.Project != "" && !imageRefRegex.MatchString(req.Project) {
+		return nil, &runError{http.StatusBadRequest, "invalid project reference"}
+	}
+	if err := validateEnv(req.Env); err != nil {
+		return nil, &runError{http.StatusBadRequest, err.Error()}
+	}
+	// resolved now, so the limits recorded and the ones the run gets after a restart
+	// are the ones it was accepted with
+	resources, err := resolveResources(req.Resources, maxResources)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-			stderrStr = string(exitErr.Stderr)
-		} else {
-			http.Error(w, "Failed to run container: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+		return nil, &runError{http.StatusBadRequest, err.Error()}
+	}
+	req.Resources = resources
+	if fileName == "" {
+		fileName = "image command"
 	}
 
-	memoryHits, diskHits, serverFetches := getAndResetLookupStats()
-
-	username := req.Username
-
-	id := int64(0)
+	job := newRunJob(req, fileName)
 	if db.DB != nil {
-		id, err = db.LogRun(fileName, startTime, duration.Milliseconds(),
-			stripANSI(string(stdout)), stderrStr, exitCode,
-			memoryHits, diskHits, serverFetches, username)
+		// kept so the run survives a worker restart while it waits
+		request, _ := json.Marshal(req)
+		id, err := db.QueueRun(fileName, job.queuedAt, req.Username, string(request), req.Resources.limits())
 		if err != nil {
-			fmt.Println("Error logging run to database:", err)
+			job.cancel()
+			return nil, &runError{http.StatusInternalServerError, "Failed to record run: " + err.Error()}
 		}
+		job.id = id
+		fs.jobsMu.Lock()
+		fs.jobs[job.id] = job
+		fs.jobsMu.Unlock()
 	}
 
-	// write stdout back to user
-	response := RunResponse{
-		RunId:    int(id),
-		Stdout:   string(stdout),
-		Stderr:   stderrStr,
-		ExitCode: exitCode,
+	fs.queue.enqueue(job)
+	return job, nil
+}
+
+// setupRun mounts the views and layers of a run the queue has admitted and writes its
+// bundle. If it fails, nothing is left mounted.
+func (fs *FS) setupRun(job *runJob) error {
+	req := job.req
+	containerID := fmt.Sprintf("container-%d", time.Now().UnixNano())
+
+	// create a per-run bundle directory so concurrent runs don't share config.json
+	bundleDir, err := os.MkdirTemp("", "runc-bundle-*")
+	if err != nil {
+		return fmt.Errorf("Failed to create bundle dir: %w", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// views of our own keep other runs' lookups out of this run's stats and negative
+	// cache, and the image tree is read-only, so writes go to private layers on top
+	mounts, err := fs.mountRun(containerID, req)
+	if err != nil {
+		os.RemoveAll(bundleDir)
+		return fmt.Errorf("Failed to mount rootfs: %w", err)
+	}
+	fail := func(err error) error {
+		mounts.release(false)
+		os.RemoveAll(bundleDir)
+		return err
+	}
+
+	// images that were never committed have no config
+	imageConfig, err := fs.fetchImageConfig(req.Image)
+	if err != nil && err != ErrNotFoundOnFileServer {
+		return fail(fmt.Errorf("Failed to fetch image config: %w", err))
+	}
+	process, err := runProcess(req, imageConfig, mounts.imageRootfs)
+	if err != nil {
+		return fail(err)
+	}
+	fileName := req.FileName
+	if fileName == "" {
+		fileName = strings.Join(process.Args, " ")
+	}
+
+	spec := runSpec(process, mounts.rootfs, filepath.Join(mounts.imageRootfs, "usr", "lib64"), req.Resources)
+	if mounts.project != "" {
+		spec.Mounts = append(spec.Mounts, Mount{
+			Destination: process.Cwd,
+			Type:        "bind",
+			Source:      mounts.project,
+			Options:     []string{"rbind", "rw"},
+		})
+	}
+	runcConfig, _ := json.MarshalIndent(spec, "", "    ")
+	if err := os.WriteFile(filepath.Join(bundleDir, "config.json"), runcConfig, 0644); err != nil {
+		return fail(fmt.Errorf("Failed to write config: %w", err))
+	}
+
+	// a cancel from here on kills the container
+	job.mu.Lock()
+	cancelled := job.cancelled
+	if !cancelled {
+		job.containerID = containerID
+		job.bundleDir = bundleDir
+		job.mounts = mounts
+		job.fileName = fileName
+		job.startedAt = time.Now()
+	}
+	job.mu.Unlock()
+	if cancelled {
+		return fail(fmt.Errorf("run cancelled before its container started"))
+	}
+
+	if db.DB != nil && job.id != 0 {
+		if err := db.StartRun(job.id, fileName, job.startedAt); err != nil {
+			log.Printf("Error logging run to database: %v", err)
+		}
+	}
+	return nil
 }
 
+// Stats lists the runs the sender can see, with their output: their own, or every
+// run for admins.
 func Stats(w http.ResponseWriter, r *http.Request) {
-	runs, err := db.GetAllRuns()
+	all, err := db.GetAllRuns()
 	if err != nil {
 		http.Error(w, "Failed to get runs: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	runs := make([]db.RunRecord, 0, len(all))
+	for _, run := range all {
+		if canSee(r, run.Username) {
+			runs = append(runs, run)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(runs)
 }
 
-func getAndResetLookupStats() (memoryHits, diskHits, serverFetches int64) {
-	memoryHits = LookupStats.MemoryCacheHits.Swap(0)
-	diskHits = LookupStats.DiskCacheHits.Swap(0)
-	serverFetches = LookupStats.ServerFetches.Swap(0)
-	return
+// validScriptPath reports whether name can be the script of a run: a file name, or
+// with a project a relative path inside it.
+func validScriptPath(name string, inProject bool) bool {
+	if !inProject {
+		return scriptNameRegex.MatchString(name)
+	}
+	if path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !scriptNameRegex.MatchString(part) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validScriptPath(t *testing.T) {
+	assert.True(t, validScriptPath("alice_app.py", false))
+	assert.False(t, validScriptPath("jobs/train.py", false))
+
+	assert.True(t, validScriptPath("train.py", true))
+	assert.True(t, validScriptPath("jobs/train.py", true))
+	assert.False(t, validScriptPath("../train.py", true))
+	assert.False(t, validScriptPath("/etc/passwd", true))
+	assert.False(t, validScriptPath("jobs/../../train.py", true))
+	assert.False(t, validScriptPath("jobs//train.py", true))
+	assert.False(t, validScriptPath("jobs/$(id).py", true))
+}
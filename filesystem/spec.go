@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The types below are the subset of the OCI runtime spec (config.json) that the
+// worker fills in. Field names and JSON tags follow github.com/opencontainers/runtime-spec.
+
+type Spec struct {
+	Version  string   `json:"ociVersion"`
+	Process  *Process `json:"process,omitempty"`
+	Root     *Root    `json:"root,omitempty"`
+	Hostname string   `json:"hostname,omitempty"`
+	Mounts   []Mount  `json:"mounts,omitempty"`
+	Linux    *Linux   `json:"linux,omitempty"`
+}
+
+type Process struct {
+	Terminal        bool               `json:"terminal,omitempty"`
+	User            User               `json:"user"`
+	Args            []string           `json:"args,omitempty"`
+	Env             []string           `json:"env,omitempty"`
+	Cwd             string             `json:"cwd"`
+	Capabilities    *LinuxCapabilities `json:"capabilities,omitempty"`
+	Rlimits         []POSIXRlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool               `json:"noNewPrivileges,omitempty"`
+}
+
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+type LinuxCapabilities struct {
+	Bounding  []string `json:"bounding,omitempty"`
+	Effective []string `json:"effective,omitempty"`
+	Permitted []string `json:"permitted,omitempty"`
+}
+
+type POSIXRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type Root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+type Mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type Linux struct {
+	Resources     *LinuxResources  `json:"resources,omitempty"`
+	Namespaces    []LinuxNamespace `json:"namespaces,omitempty"`
+	MaskedPaths   []string         `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string         `json:"readonlyPaths,omitempty"`
+}
+
+type LinuxResources struct {
+	Memory  *LinuxMemory        `json:"memory,omitempty"`
+	CPU     *LinuxCPU           `json:"cpu,omitempty"`
+	Pids    *LinuxPids          `json:"pids,omitempty"`
+	Devices []LinuxDeviceCgroup `json:"devices,omitempty"`
+}
+
+type LinuxMemory struct {
+	Limit *int64 `json:"limit,omitempty"`
+	Swap  *int64 `json:"swap,omitempty"`
+}
+
+type LinuxCPU struct {
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+}
+
+type LinuxPids struct {
+	Limit int64 `json:"limit"`
+}
+
+type LinuxDeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Access string `json:"access,omitempty"`
+}
+
+type LinuxNamespace struct {
+	Type string `json:"type"`
+}
+
+// _defaultEntrypoint runs the uploaded script when the request names no entrypoint.
+var _defaultEntrypoint = []string{"/usr/bin/env", "python3"}
+
+var _defaultEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"TERM=xterm",
+}
+
+// envKeyRegex matches the names accepted for -e KEY=VAL.
+var envKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnv checks that every entry is of the form KEY=VAL.
+func validateEnv(env []string) error {
+	for _, kv := range env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || !envKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid environment variable %q, want KEY=VAL", kv)
+		}
+	}
+	return nil
+}
+
+// mergeEnv returns base with the variables in overrides added, replacing any of the
+// same name. Order is kept, with new variables at the end.
+func mergeEnv(base, overrides []string) []string {
+	env := append([]string(nil), base...)
+	index := make(map[string]int, len(env))
+	for i, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		index[key] = i
+	}
+	for _, kv := range overrides {
+		key, _, _ := strings.Cut(kv, "=")
+		if i, ok := index[key]; ok {
+			env[i] = kv
+			continue
+		}
+		index[key] = len(env)
+		env = append(env, kv)
+	}
+	return env
+}
+
+// errNoCommand means the run has neither a script nor an image command to run.
+var errNoCommand = errors.New("no script given and the image has no command")
+
+// processArgs is the command line of the container. script is the path of the script
+// in the container, or "" to run the image's command. A script runs like
+// `docker run <image> python3 <script> <args>`: after the image's ENTRYPOINT, or
+// after req.Entrypoint, which replaces both the ENTRYPOINT and python3. Without a
+// script the image's ENTRYPOINT and CMD run; req.Entrypoint replaces both and
+// req.Args replaces CMD.
+func processArgs(req RunRequest, config ImageConfig, script string) []string {
+	var args []string
+	if script == "" {
+		entrypoint, cmd := config.Entrypoint, config.Cmd
+		if len(req.Entrypoint) > 0 {
+			entrypoint, cmd = req.Entrypoint, nil
+		}
+		if len(req.Args) > 0 {
+			cmd = req.Args
+		}
+		args = append(args, entrypoint...)
+		return append(args, cmd...)
+	}
+
+	if len(req.Entrypoint) > 0 {
+		args = append(args, req.Entrypoint...)
+	} else {
+		args = append(args, config.Entrypoint...)
+		args = append(args, _defaultEntrypoint...)
+	}
+	args = append(args, script)
+	return append(args, req.Args...)
+}
+
+// runProcess builds the process section of the runc config from req and the image's
+// config. rootfs is the image tree, read to resolve a USER given by name.
+func runProcess(req RunRequest, config ImageConfig, rootfs string) (*Process, error) {
+	cwd := config.WorkingDir
+	if req.Project != "" {
+		cwd = projectMountPoint(config)
+	}
+	if cwd == "" {
+		cwd = "/"
+	}
+	// uploaded scripts are at the root of the image tree, project scripts in the project
+	script := ""
+	if req.FileName != "" {
+		script = "/" + req.FileName
+		if req.Project != "" {
+			script = path.Join(cwd, req.FileName)
+		}
+	}
+
+	args := processArgs(req, config, script)
+	if len(args) == 0 {
+		return nil, errNoCommand
+	}
+	user, err := resolveUser(rootfs, config.User)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+	return &Process{
+		User: user,
+		Args: args,
+		Env:  mergeEnv(mergeEnv(_defaultEnv, config.Env), req.Env),
+		Cwd:  cwd,
+		Capabilities: &LinuxCapabilities{
+			Bounding:  caps,
+			Effective: caps,
+			Permitted: caps,
+		},
+		Rlimits:         []POSIXRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+		NoNewPrivileges: true,
+	}, nil
+}
+
+// _projectDir is where the project is mounted if the image has no WORKDIR.
+const _projectDir = "/app"
+
+// projectMountPoint is where a run's project directory is mounted and the process
+// starts: the image's WORKDIR, or /app if it has none.
+func projectMountPoint(config ImageConfig) string {
+	dir := path.Clean("/" + config.WorkingDir)
+	if dir == "/" {
+		return _projectDir
+	}
+	return dir
+}
+
+// resolveUser turns an image USER of the form user, uid, user:group or uid:gid into
+// ids. Names are looked up in the image's /etc/passwd and /etc/group. Without a group
+// the user's primary group from /etc/passwd is used, or 0 if it isn't listed there.
+func resolveUser(rootfs, spec string) (User, error) {
+	if spec == "" {
+		return User{}, nil
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+
+	passwd := filepath.Join(rootfs, "etc", "passwd")
+	var u User
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u.UID = uint32(uid)
+		if fields, ok := findIDEntry(passwd, name, 2); ok {
+			u.GID = parseID(fields[3])
+		}
+	} else {
+		fields, ok := findIDEntry(passwd, name, 0)
+		if !ok {
+			return User{}, fmt.Errorf("user %q not found in the image's /etc/passwd", name)
+		}
+		u.UID, u.GID = parseID(fields[2]), parseID(fields[3])
+	}
+
+	if !hasGroup {
+		return u, nil
+	}
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		u.GID = uint32(gid)
+		return u, nil
+	}
+	fields, ok := findIDEntry(filepath.Join(rootfs, "etc", "group"), group, 0)
+	if !ok {
+		return User{}, fmt.Errorf("group %q not found in the image's /etc/group", group)
+	}
+	u.GID = parseID(fields[2])
+	return u, nil
+}
+
+// findIDEntry returns the fields of the first line of a passwd or group file whose
+// field at index equals value. Both formats have the name at 0 and the id at 2.
+func findIDEntry(path, value string, index int) ([]string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 4 && fields[index] == value {
+			return fields, true
+		}
+	}
+	return nil, false
+}
+
+func parseID(s string) uint32 {
+	id, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(id)
+}
+
+func int64Ptr(v int64) *int64    { return &v }
+func uint64Ptr(v uint64) *uint64 { return &v }
+
+// runSpec builds the runc config that runs process with rootfs as the container's
+// root, limited to res. lib64 is bind mounted read-only at /lib64.
+func runSpec(process *Process, rootfs, lib64 string, res RunResources) *Spec {
+	resources := res.linux()
+	resources.Devices = []LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}
+	return &Spec{
+		Version:  "1.2.0",
+		Process:  process,
+		Root:     &Root{Path: rootfs},
+		Hostname: "runc",
+		Mounts: []Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/lib64", Type: "bind", Source: lib64, Options: []string{"rbind", "ro"}},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: &Linux{
+			Resources: resources,
+			Namespaces: []LinuxNamespace{
+				{Type: "pid"}, {Type: "network"}, {Type: "ipc"},
+				{Type: "uts"}, {Type: "mount"}, {Type: "cgroup"},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys",
+				"/proc/latency_stats", "/proc/timer_list", "/proc/timer_stats",
+				"/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+}
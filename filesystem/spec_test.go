@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_runProcess(t *testing.T) {
+	t.Run("runs the script with python3 by default", func(t *testing.T) {
+		process, err := runProcess(RunRequest{FileName: "alice_app.py"}, ImageConfig{}, t.TempDir())
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/usr/bin/env", "python3", "/alice_app.py"}, process.Args)
+		assert.Equal(t, _defaultEnv, process.Env)
+		assert.Equal(t, "/", process.Cwd)
+		assert.Equal(t, User{}, process.User)
+	})
+
+	t.Run("passes args, env and entrypoint", func(t *testing.T) {
+		req := RunRequest{
+			FileName:   "alice_app.py",
+			Args:       []string{"--epochs", "5"},
+			Env:        []string{"HF_HOME=/tmp/hf", "TERM=dumb"},
+			Entrypoint: []string{"/bin/sh", "-e"},
+		}
+
+		process, err := runProcess(req, ImageConfig{Entrypoint: []string{"/entrypoint.sh"}}, t.TempDir())
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/bin/sh", "-e", "/alice_app.py", "--epochs", "5"}, process.Args)
+		assert.Equal(t, []string{_defaultEnv[0], "TERM=dumb", "HF_HOME=/tmp/hf"}, process.Env)
+	})
+
+	t.Run("uses the image's env, workdir and entrypoint", func(t *testing.T) {
+		config := ImageConfig{
+			Env:        []string{"PATH=/opt/venv/bin:/usr/bin", "LANG=C.UTF-8"},
+			Entrypoint: []string{"/entrypoint.sh"},
+			Cmd:        []string{"python", "app.py"},
+			WorkingDir: "/app",
+		}
+
+		process, err := runProcess(RunRequest{FileName: "alice_app.py", Env: []string{"LANG=en_US.UTF-8"}}, config, t.TempDir())
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/entrypoint.sh", "/usr/bin/env", "python3", "/alice_app.py"}, process.Args)
+		assert.Equal(t, []string{"PATH=/opt/venv/bin:/usr/bin", "TERM=xterm", "LANG=en_US.UTF-8"}, process.Env)
+		assert.Equal(t, "/app", process.Cwd)
+	})
+
+	t.Run("runs the image's command without a script", func(t *testing.T) {
+		config := ImageConfig{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"python", "app.py"}}
+
+		process, err := runProcess(RunRequest{}, config, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/entrypoint.sh", "python", "app.py"}, process.Args)
+
+		process, err = runProcess(RunRequest{Entrypoint: []string{"nvidia-smi"}}, config, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"nvidia-smi"}, process.Args)
+
+		_, err = runProcess(RunRequest{}, ImageConfig{}, t.TempDir())
+		assert.ErrorIs(t, err, errNoCommand)
+	})
+
+	t.Run("runs project scripts from the working directory", func(t *testing.T) {
+		req := RunRequest{FileName: "jobs/train.py", Project: "project-alice-ml@abc123"}
+
+		process, err := runProcess(req, ImageConfig{WorkingDir: "/work"}, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, "/work", process.Cwd)
+		assert.Equal(t, []string{"/usr/bin/env", "python3", "/work/jobs/train.py"}, process.Args)
+
+		process, err = runProcess(req, ImageConfig{}, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, "/app", process.Cwd)
+		assert.Equal(t, []string{"/usr/bin/env", "python3", "/app/jobs/train.py"}, process.Args)
+	})
+
+	t.Run("resolves the image's user", func(t *testing.T) {
+		rootfs := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte("root:x:0:\nstaff:x:50:\n"), 0644))
+
+		for spec, want := range map[string]User{
+			"app":       {UID: 1000, GID: 1001},
+			"1000":      {UID: 1000, GID: 1001},
+			"2000":      {UID: 2000, GID: 0},
+			"app:staff": {UID: 1000, GID: 50},
+			"2000:3000": {UID: 2000, GID: 3000},
+		} {
+			process, err := runProcess(RunRequest{FileName: "alice_app.py"}, ImageConfig{User: spec}, rootfs)
+			require.NoError(t, err, spec)
+			assert.Equal(t, want, process.User, spec)
+		}
+
+		_, err := runProcess(RunRequest{FileName: "alice_app.py"}, ImageConfig{User: "nobody"}, rootfs)
+		assert.Error(t, err)
+	})
+}
+
+func Test_runSpec(t *testing.T) {
+	process, err := runProcess(RunRequest{FileName: "alice_app.py"}, ImageConfig{}, t.TempDir())
+	require.NoError(t, err)
+
+	data, err := json.Marshal(runSpec(process, "/mnt/c1", "/lib64", _defaultResources))
+	require.NoError(t, err)
+
+	var config map[string]any
+	require.NoError(t, json.Unmarshal(data, &config))
+	assert.Equal(t, "1.2.0", config["ociVersion"])
+	assert.Equal(t, map[string]any{"path": "/mnt/c1"}, config["root"])
+	assert.Equal(t, map[string]any{"uid": float64(0), "gid": float64(0)}, config["process"].(map[string]any)["user"])
+}
+
+func Test_validateEnv(t *testing.T) {
+	assert.NoError(t, validateEnv([]string{"HF_HOME=/tmp/hf", "EMPTY="}))
+	assert.Error(t, validateEnv([]string{"NOVALUE"}))
+	assert.Error(t, validateEnv([]string{"1BAD=x"}))
+	assert.Error(t, validateEnv([]string{"=x"}))
+}
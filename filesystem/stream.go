@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// _ndjsonContentType is requested by clients that want container output streamed
+// as it is produced instead of one RunResponse at the end.
+const _ndjsonContentType = "application/x-ndjson"
+
+// RunEvent is one line of a streamed run. Output events carry Stream and Data;
+// the final event has Done set and carries the exit code and run ID. Events without
+// either say which run this is, or carry a change of Status: its place in the queue
+// while it waits, then running once it starts.
+type RunEvent struct {
+	Stream        string `json:"stream,omitempty"` // "stdout" or "stderr"
+	Data          string `json:"data,omitempty"`
+	Status        string `json:"status,omitempty"`         // "queued" or "running"
+	QueuePosition int    `json:"queue_position,omitempty"` // with Status queued, from 1
+	Done          bool   `json:"done,omitempty"`
+	ExitCode      int    `json:"exit_code"`
+	RunId         int    `json:"run_id,omitempty"`
+	Error         string `json:"error,omitempty"`
+	UpperDir      string `json:"upper_dir,omitempty"` // where the writable layer was kept, with KeepRootfs
+}
+
+// eventStream writes RunEvents to the response as newline-delimited JSON, flushing
+// after every event so the client sees output while the container runs.
+type eventStream struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", _ndjsonContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return &eventStream{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (s *eventStream) send(ev RunEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.Encode(ev)
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// eventSink receives the events of a run: an eventStream writing them to a client,
+// or the runJob that wakes up everyone following the run.
+type eventSink interface {
+	send(ev RunEvent)
+}
+
+// outputWriter keeps a copy of one of the container's output streams for the runs
+// database and for clients following the run, and forwards each write to events.
+type outputWriter struct {
+	stream string
+	events eventSink // nil when only the copy is wanted
+	mu     sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	o.buf.Write(p)
+	o.mu.Unlock()
+	if o.events != nil {
+		o.events.send(RunEvent{Stream: o.stream, Data: string(p)})
+	}
+	return len(p), nil
+}
+
+func (o *outputWriter) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// since returns what was written after the first n bytes, and how many bytes have
+// been written.
+func (o *outputWriter) since(n int) (string, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return string(o.buf.Bytes()[n:]), o.buf.Len()
+}
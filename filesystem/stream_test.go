@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_outputWriter(t *testing.T) {
+	t.Run("streams every write as an event and keeps a copy", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		events := newEventStream(rec)
+		stdout := &outputWriter{stream: "stdout", events: events}
+		stderr := &outputWriter{stream: "stderr", events: events}
+
+		stdout.Write([]byte("epoch 1\n"))
+		stderr.Write([]byte("warning\n"))
+		stdout.Write([]byte("epoch 2\n"))
+		events.send(RunEvent{Done: true, ExitCode: 3, RunId: 7})
+
+		assert.Equal(t, _ndjsonContentType, rec.Header().Get("Content-Type"))
+		assert.True(t, rec.Flushed)
+		assert.Equal(t, "epoch 1\nepoch 2\n", stdout.String())
+		assert.Equal(t, "warning\n", stderr.String())
+
+		got := []RunEvent{}
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var ev RunEvent
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev))
+			got = append(got, ev)
+		}
+		require.Len(t, got, 4)
+		assert.Equal(t, RunEvent{Stream: "stdout", Data: "epoch 1\n"}, got[0])
+		assert.Equal(t, RunEvent{Stream: "stderr", Data: "warning\n"}, got[1])
+		assert.Equal(t, RunEvent{Done: true, ExitCode: 3, RunId: 7}, got[3])
+	})
+
+	t.Run("buffers without streaming when there is no event stream", func(t *testing.T) {
+		stdout := &outputWriter{stream: "stdout"}
+
+		n, err := stdout.Write([]byte("hello"))
+
+		require.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.Equal(t, "hello", stdout.String())
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"syscall"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// symlink is a symbolic link. The target is part of the entry's metadata on the
+// fileserver, so reading the link never fetches content. Relative and absolute
+// targets are resolved by the kernel inside the container's rootfs.
+type symlink struct {
+	fusefs.Inode
+	target string
+	attr   fuse.Attr
+}
+
+var _ = (fusefs.NodeReadlinker)((*symlink)(nil))
+var _ = (fusefs.NodeGetattrer)((*symlink)(nil))
+
+func (l *symlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	return []byte(l.target), 0
+}
+
+func (l *symlink) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Attr = l.attr
+	out.Mode = syscall.S_IFLNK | 0777
+	out.Size = uint64(len(l.target))
+	return 0
+}
+
+func setSymlinkEntryOut(out *fuse.EntryOut, metadata cachedMetadata) {
+	out.Attr = metadata.attr()
+	out.Attr.Mode = syscall.S_IFLNK | 0777
+	out.Attr.Size = uint64(len(metadata.linkTarget))
+	out.SetEntryTimeout(_kernelInodeTimeout)
+	out.SetAttrTimeout(_kernelInodeTimeout)
+}
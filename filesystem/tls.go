@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileserverTLS is how the worker checks the fileserver's certificate. Set once at
+// startup from -ca and -fingerprint; nil trusts the system's roots.
+var fileserverTLS *tls.Config
+
+// parseFingerprint accepts a certificate's SHA-256 in hex, with or without colons and
+// a "sha256:" prefix, as the fileserver logs it at startup.
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	sum, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %q, want the SHA-256 of the certificate in hex", s)
+	}
+	return sum, nil
+}
+
+// clientTLSConfig trusts certificates that chain to the CAs in caFile, and with a
+// fingerprint only the certificate that has it. With only a fingerprint the chain
+// isn't checked, which is what makes pinning a self-signed certificate work.
+func clientTLSConfig(caFile, fingerprint string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if fingerprint == "" {
+		return config, nil
+	}
+
+	pin, err := parseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if caFile == "" {
+		// the pin replaces the chain, so skip Go's check, which would reject a
+		// self-signed certificate, and do it in VerifyConnection instead
+		config.InsecureSkipVerify = true
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("server certificate sha256:%x doesn't match the pinned fingerprint", sum)
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// certFingerprint is the SHA-256 of the leaf certificate of cert, in the form sway
+// accepts to pin it.
+func certFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_clientTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	cert := server.Certificate()
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644))
+	other := selfSignedCert(t)
+	otherCAFile := filepath.Join(t.TempDir(), "other.crt")
+	require.NoError(t, os.WriteFile(otherCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other}), 0644))
+
+	get := func(t *testing.T, caFile, fingerprint string) error {
+		t.Helper()
+		config, err := clientTLSConfig(caFile, fingerprint)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	t.Run("the system roots don't trust a private CA", func(t *testing.T) {
+		assert.Error(t, get(t, "", ""))
+	})
+	t.Run("a CA bundle", func(t *testing.T) {
+		assert.NoError(t, get(t, caFile, ""))
+		assert.Error(t, get(t, otherCAFile, ""))
+	})
+	t.Run("a pinned fingerprint, in the forms people paste", func(t *testing.T) {
+		assert.NoError(t, get(t, "", fingerprint))
+		assert.NoError(t, get(t, "", "sha256:"+strings.ToUpper(fingerprint)))
+		var colons []string
+		for i := 0; i < len(fingerprint); i += 2 {
+			colons = append(colons, fingerprint[i:i+2])
+		}
+		assert.NoError(t, get(t, "", strings.Join(colons, ":")))
+		assert.NoError(t, get(t, caFile, fingerprint))
+	})
+	t.Run("a fingerprint of another certificate", func(t *testing.T) {
+		sum := sha256.Sum256(other)
+		assert.ErrorContains(t, get(t, "", hex.EncodeToString(sum[:])), "doesn't match the pinned fingerprint")
+	})
+	t.Run("bad settings", func(t *testing.T) {
+		_, err := clientTLSConfig("", "abc")
+		assert.Error(t, err)
+		_, err = clientTLSConfig(filepath.Join(t.TempDir(), "missing.crt"), "")
+		assert.Error(t, err)
+	})
+}
+
+// selfSignedCert returns a new self-signed CA certificate in DER.
+func selfSignedCert(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return der
+}
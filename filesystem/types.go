@@ -1,27 +1,28 @@
 package main
 
-import (
-	"sync/atomic"
-)
-
-// LookupStats tracks cache hit/miss statistics for Lookup operations
-var LookupStats struct {
-	MemoryCacheHits atomic.Int64 // Found in children map
-	DiskCacheHits   atomic.Int64 // Found in disk cache via KeyDir
-	ServerFetches   atomic.Int64 // Had to fetch from fileserver
-}
-
 // KeyValue represents the JSON structure for set requests
 type KeyValue struct {
-	Key       string `json:"key"`
-	Value     []byte `json:"value"` // Base64 encoded binary data
-	HashValue string `json:"hash_value"`
-	Parent    string `json:"parent"`
-	Name      string `json:"name"`
-	IsDir     bool   `json:"is_dir"`
-	Size      int64  `json:"size"`
-	Mode      int64  `json:"mode"`
-	ModTime   int64  `json:"mod_time"`
-	Uid       int    `json:"uid"`
-	Gid       int    `json:"gid"`
+	Key        string `json:"key"`
+	HashValue  string `json:"hash_value"`            // content is fetched separately from /blobs/<hash>
+	LinkTarget string `json:"link_target,omitempty"` // set for symlinks, which have no content
+	HardLink   string `json:"hard_link,omitempty"`   // key shared by every path of a hard-link group
+	Nlink      int    `json:"nlink,omitempty"`       // number of paths in the hard-link group
+	Parent     string `json:"parent"`
+	Name       string `json:"name"`
+	IsDir      bool   `json:"is_dir"`
+	Size       int64  `json:"size"`
+	Mode       int64  `json:"mode"` // permission and setuid/setgid/sticky bits
+	ModTime    int64  `json:"mod_time"`
+	Uid        int    `json:"uid"`
+	Gid        int    `json:"gid"`
+}
+
+// ImageConfig is how an image asks to be run: its CMD, ENTRYPOINT, ENV, WORKDIR and
+// USER, as uploaded by sway export. Field names follow the OCI image spec.
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lookupStats tracks cache hit/miss statistics for Lookup operations
+type lookupStats struct {
+	MemoryCacheHits atomic.Int64 // Found in children map
+	DiskCacheHits   atomic.Int64 // Answered from KeyDir metadata without a server round-trip
+	ServerFetches   atomic.Int64 // Had to fetch metadata from fileserver
+}
+
+// view is one mounted copy of an image's tree, at <mount>/<name>. Every run gets a
+// view of its own, so the kernel sends that run's requests, and only those, to the
+// view's directories. That keeps the negative cache and the lookup stats per run.
+// What the fileserver says about the image is kept in meta, which all views of a
+// committed image share, and file content is cached on disk per chunk for all views.
+type view struct {
+	name        string
+	image       string // fileserver image; "" is the default image
+	scripts     bool   // serve scripts uploaded by sway run at the root, from the default image
+	meta        *imageMetadata
+	stats       lookupStats
+	notFoundMu  sync.RWMutex
+	notFoundSet map[string]struct{} // paths known not to exist. Using this to avoid re-fetches to the fileserver.
+}
+
+// newView makes a view of image with metadata of its own; addView gives it the
+// image's shared metadata instead.
+func newView(name, image string) *view {
+	return &view{
+		name:        name,
+		image:       image,
+		scripts:     true,
+		meta:        newImageMetadata(image != defaultImage),
+		notFoundSet: make(map[string]struct{}),
+	}
+}
+
+func (v *view) addNotFound(path string) {
+	v.notFoundMu.Lock()
+	v.notFoundSet[path] = struct{}{}
+	v.notFoundMu.Unlock()
+}
+
+func (v *view) isNotFound(path string) bool {
+	v.notFoundMu.RLock()
+	_, ok := v.notFoundSet[path]
+	v.notFoundMu.RUnlock()
+	return ok
+}
+
+// _maxImageMetadata is how many images' metadata the worker keeps once no run needs it
+// any more, for the next runs of those images.
+const _maxImageMetadata = 32
+
+// imageMetadata is the metadata of an image's entries and the listings of its
+// directories, as fetched from the fileserver. A committed image never changes, so
+// its metadata is shared by every view of it, and a run starts with what the runs
+// before it fetched. Directory listings are only kept for such images: the default
+// image changes whenever a script is uploaded.
+type imageMetadata struct {
+	immutable bool
+	mu        sync.RWMutex
+	entries   map[string]cachedMetadata // key to its metadata
+	listings  map[string][]KeyValue     // directory key to its entries
+	lastUsed  time.Time                 // when a view last got it; guarded by FS.imagesMu
+}
+
+func newImageMetadata(immutable bool) *imageMetadata {
+	return &imageMetadata{
+		immutable: immutable,
+		entries:   make(map[string]cachedMetadata),
+		listings:  make(map[string][]KeyValue),
+	}
+}
+
+func (m *imageMetadata) entry(key string) (cachedMetadata, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	metadata, ok := m.entries[key]
+	return metadata, ok
+}
+
+func (m *imageMetadata) addEntry(key string, metadata cachedMetadata) {
+	m.mu.Lock()
+	m.entries[key] = metadata
+	m.mu.Unlock()
+}
+
+// listing returns the entries of directory dir, if they were fetched before.
+func (m *imageMetadata) listing(dir string) ([]KeyValue, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries, ok := m.listings[dir]
+	return entries, ok
+}
+
+// addListing records the entries of directory dir, and of each entry its metadata.
+func (m *imageMetadata) addListing(dir string, entries []KeyValue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.immutable {
+		m.listings[dir] = entries
+	}
+	for _, entry := range entries {
+		m.entries[filepath.Join(dir, entry.Name)] = entryMetadata(entry)
+	}
+}
+
+// imageMetadata returns the metadata views of image share. The default image can
+// change, so each view of it gets its own. Only the _maxImageMetadata images used
+// last are kept; a view keeps using the metadata it got even once it isn't.
+func (r *FS) imageMetadata(image string) *imageMetadata {
+	if image == defaultImage {
+		return newImageMetadata(false)
+	}
+	r.imagesMu.Lock()
+	defer r.imagesMu.Unlock()
+	m, ok := r.images[image]
+	if !ok {
+		if len(r.images) >= _maxImageMetadata {
+			oldest := ""
+			for ref, other := range r.images {
+				if oldest == "" || other.lastUsed.Before(r.images[oldest].lastUsed) {
+					oldest = ref
+				}
+			}
+			delete(r.images, oldest)
+		}
+		m = newImageMetadata(true)
+		r.images[image] = m
+	}
+	m.lastUsed = time.Now()
+	return m
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configDir is where sway keeps its settings, e.g. ~/.config/sway on Linux.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sway"), nil
+}
+
+// loadToken returns the API token from SWAY_TOKEN, or else the one saved by sway login.
+// Without either, requests go out unauthenticated.
+func loadToken() string {
+	if token := os.Getenv("SWAY_TOKEN"); token != "" {
+		return token
+	}
+	dir, err := configDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "token"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveToken stores token for later commands, readable only by the current user.
+func saveToken(token string) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "token")
+	return path, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+// Config is what sway keeps in config.json in its config directory.
+type Config struct {
+	CACert            string `json:"ca_cert,omitempty"`            // PEM bundle of CAs the fileserver's and the worker's certificates must chain to
+	Fingerprint       string `json:"fingerprint,omitempty"`        // SHA-256 of the fileserver's certificate, pinned
+	WorkerFingerprint string `json:"worker_fingerprint,omitempty"` // SHA-256 of the worker's certificate, pinned
+}
+
+// readConfig reads config.json, which doesn't have to exist.
+func readConfig() (Config, error) {
+	var config Config
+	dir, err := configDir()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("reading %s: %w", filepath.Join(dir, "config.json"), err)
+	}
+	return config, nil
+}
+
+func saveConfig(config Config) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "config.json")
+	return path, os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// tokenTransport sends the API token with every request, and says how to trust a
+// server whose certificate isn't.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.base.RoundTrip(req)
+	var unknown x509.UnknownAuthorityError
+	if errors.As(err, &unknown) {
+		return nil, fmt.Errorf("%w\n\n%s", err, _untrustedHint)
+	}
+	return resp, err
+}
+
+// tlsSettings is the config with SWAY_CA_CERT, SWAY_FINGERPRINT and
+// SWAY_WORKER_FINGERPRINT overriding what sway tls saved.
+func tlsSettings() Config {
+	config, err := readConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if ca := os.Getenv("SWAY_CA_CERT"); ca != "" {
+		config.CACert = ca
+	}
+	if fingerprint := os.Getenv("SWAY_FINGERPRINT"); fingerprint != "" {
+		config.Fingerprint = fingerprint
+	}
+	if fingerprint := os.Getenv("SWAY_WORKER_FINGERPRINT"); fingerprint != "" {
+		config.WorkerFingerprint = fingerprint
+	}
+	return config
+}
+
+// fileserverClient talks to the fileserver, trusting its certificate as configured
+// with sway tls. With no CA and no fingerprint, the system's roots are trusted.
+func fileserverClient() *http.Client {
+	config := tlsSettings()
+	tlsConfig, err := clientTLSConfig(config.CACert, config.Fingerprint)
+	if err != nil {
+		log.Fatalf("fileserver TLS: %v", err)
+	}
+	return &http.Client{
+		Transport: &tokenTransport{
+			token: loadToken(),
+			base:  &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+// workerClient talks to the worker, trusting its certificate by the same CA as the
+// fileserver's, or by its own fingerprint.
+func workerClient() *http.Client {
+	config := tlsSettings()
+	tlsConfig, err := clientTLSConfig(config.CACert, config.WorkerFingerprint)
+	if err != nil {
+		log.Fatalf("worker TLS: %v", err)
+	}
+	return &http.Client{
+		Transport: &tokenTransport{
+			token: loadToken(),
+			base:  &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+// errUnauthorized is returned when a server turns the token down.
+var errUnauthorized = errors.New("not logged in or the token was revoked, get a token from the fileserver admin and run:\n\n  sway login <token>\n")
+
+// whoami asks the fileserver who token belongs to.
+func whoami(token string) (string, error) {
+	req, err := http.NewRequest("GET", fileServerURL+"/whoami", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := fileserverClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("whoami: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var u struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+		return "", fmt.Errorf("whoami: %w", err)
+	}
+	return u.Username, nil
+}
+
+// currentUser is who runs are made as: the token's user if there is a token, otherwise
+// SWAY_USERNAME for servers that run without authentication.
+func currentUser() (string, error) {
+	if token := loadToken(); token != "" {
+		return whoami(token)
+	}
+	if username := os.Getenv("SWAY_USERNAME"); username != "" {
+		return username, nil
+	}
+	return "", fmt.Errorf("not logged in. Get a token from the fileserver admin and run:\n\n  sway login <token>\n")
+}
+
+// login checks token with the fileserver and saves it.
+func login(token string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return fmt.Errorf("usage: sway login <token>")
+	}
+	username, err := whoami(token)
+	if errors.Is(err, errUnauthorized) {
+		return fmt.Errorf("the fileserver doesn't know this token")
+	}
+	if err != nil {
+		return err
+	}
+	path, err := saveToken(token)
+	if err != nil {
+		return fmt.Errorf("saving token: %w", err)
+	}
+	if username == "" {
+		fmt.Printf("The fileserver runs without authentication, token saved to %s anyway\n", path)
+		return nil
+	}
+	fmt.Printf("Logged in as %s, token saved to %s\n", username, path)
+	return nil
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/briandowns/spinner"
@@ -14,7 +15,16 @@ import (
 
 const _imageTar = "image.tar"
 
-func export(verbose bool) error {
+// exportOptions are the settings of `sway export`. Without image or from, the
+// Dockerfile in the current directory is built with docker.
+type exportOptions struct {
+	image     string // pulled from its registry
+	plainHTTP bool   // talk to image's registry over HTTP
+	from      string // a docker image save tarball or OCI image layout
+}
+
+// export builds, pulls or loads the image and uploads it to the fileserver.
+func export(verbose bool, opts exportOptions) error {
 	Verbose = verbose
 	green := color.New(color.FgGreen).SprintFunc()
 
@@ -22,10 +32,102 @@ func export(verbose bool) error {
 	if err != nil {
 		return fmt.Errorf("could not get working directory: %w", err)
 	}
-	imageName := "sway-" + filepath.Base(cwd)
+	imageName := defaultImageName(cwd)
 
 	fmt.Println("This can take a few minutes...")
 	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
+
+	cache := openHashCache(fileServerURL)
+	var files []KeyValue
+	var digest, tempDir string
+	var config ImageConfig
+	switch {
+	case opts.image != "":
+		s.Suffix = " Pulling " + opts.image + "..."
+		s.Start()
+		files, digest, tempDir, config, err = pullImage(opts.image, opts.plainHTTP, cache, func(pulled, total int) {
+			s.Suffix = fmt.Sprintf(" Pulling %s... %d/%d layers", opts.image, pulled, total)
+		})
+		s.Stop()
+		if err != nil {
+			color.Red("✗ Pull failed")
+			return err
+		}
+		fmt.Printf("%s Pulled %s\n", green("✓"), opts.image)
+	case opts.from != "":
+		s.Suffix = " Reading image layers..."
+		s.Start()
+		files, digest, tempDir, config, err = loadImage(opts.from, cache)
+		s.Stop()
+		if err != nil {
+			return fmt.Errorf("reading image: %w", err)
+		}
+	default:
+		// the upload reads file content straight from the saved tarball
+		defer os.Remove(_imageTar)
+		files, digest, tempDir, config, err = buildImage(s, imageName, cache)
+		if err != nil {
+			return err
+		}
+	}
+	defer os.RemoveAll(tempDir)
+	ref := imageName + "@" + digest
+	fmt.Printf("%s Read image %s (%d files)\n", green("✓"), ref, len(files))
+
+	// a reference names its content, so a committed one has all of it already
+	if imageCommitted(fileServerURL, ref) {
+		if err := commitImage(fileServerURL, ref, &config); err != nil {
+			return err
+		}
+		cache.markStored()
+		fmt.Printf("\n%s Already on the fileserver, ready for sway run! Image: %s\n", green("✓"), ref)
+		return nil
+	}
+
+	s.Suffix = " Syncing with fileserver..."
+	s.Start()
+	toUpload, err := syncNewFiles(files, fileServerURL, ref)
+	s.Stop()
+	if err != nil {
+		color.Red("✗ Sync failed; run sway export again to resume the upload")
+		return err
+	}
+	fmt.Printf("%s Synced with fileserver — %d new files\n", green("✓"), len(toUpload))
+
+	if len(toUpload) > 0 {
+		s.Suffix = " Uploading to fileserver..."
+		s.Start()
+		err := uploadFiles(toUpload, fileServerURL, ref, func(sent, total int) {
+			pct := sent * 100 / total
+			s.Suffix = fmt.Sprintf(" Uploading to fileserver... %d/%d files (%d%%)", sent, total, pct)
+		})
+		s.Stop()
+		if err != nil {
+			var se *statusError
+			if errors.As(err, &se) && strings.HasPrefix(se.body, "missing content") {
+				// the fileserver no longer has content the cache says it has
+				cache.forgetStored()
+			}
+			color.Red("✗ Upload failed; run sway export again to resume it")
+			return err
+		}
+		fmt.Printf("%s Uploaded %d files to fileserver\n", green("✓"), len(toUpload))
+	}
+
+	if err := commitImage(fileServerURL, ref, &config); err != nil {
+		return err
+	}
+	cache.markStored()
+
+	fmt.Printf("\n%s Ready for sway run! Image: %s\n", green("✓"), ref)
+
+	return nil
+}
+
+// buildImage builds the image in the current directory with docker, saves it to a
+// tarball and indexes it with loadImage. The caller removes the tarball after upload.
+func buildImage(s *spinner.Spinner, imageName string, cache *hashCache) ([]KeyValue, string, string, ImageConfig, error) {
+	green := color.New(color.FgGreen).SprintFunc()
 	s.Suffix = " Building docker image..."
 	s.Start()
 
@@ -49,7 +151,6 @@ func export(verbose bool) error {
 		log.Fatal("error", err)
 	}
 	defer outputFile.Close()
-	defer os.Remove(_imageTar)
 	saveCmd.Stdout = outputFile
 	if err := saveCmd.Run(); err != nil {
 		s.Stop()
@@ -59,37 +160,12 @@ func export(verbose bool) error {
 	s.Stop()
 	fmt.Printf("%s Saved tarball\n", green("✓"))
 
-	s.Suffix = " Extracting image..."
+	s.Suffix = " Reading image layers..."
 	s.Start()
-	files, tempDir, err := extractImage(_imageTar)
+	defer s.Stop()
+	files, digest, tempDir, config, err := loadImage(_imageTar, cache)
 	if err != nil {
-		s.Stop()
-		return fmt.Errorf("extracting image: %w", err)
+		return nil, "", "", ImageConfig{}, fmt.Errorf("reading image: %w", err)
 	}
-	defer os.RemoveAll(tempDir)
-	s.Stop()
-	fmt.Printf("%s Extracted image (%d files)\n", green("✓"), len(files))
-
-	s.Suffix = " Syncing with fileserver..."
-	s.Start()
-	toUpload := syncNewFiles(files, fileServerURL)
-	s.Stop()
-	fmt.Printf("%s Synced with fileserver — %d new files\n", green("✓"), len(toUpload))
-
-	if len(toUpload) > 0 {
-		s.Suffix = " Uploading to fileserver..."
-		s.Start()
-		uploadFiles(toUpload, fileServerURL, func(sent, total int) {
-			pct := sent * 100 / total
-			s.Suffix = fmt.Sprintf(" Uploading to fileserver... %d/%d files (%d%%)", sent, total, pct)
-		})
-		s.Stop()
-		fmt.Printf("%s Uploaded %d files to fileserver\n", green("✓"), len(toUpload))
-	}
-
-	os.Remove(_imageTar)
-
-	fmt.Printf("\n%s Ready for sway run!\n", green("✓"))
-
-	return nil
+	return files, digest, tempDir, config, nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// committingFileserver keeps blobs and the keys of each image, and like the real
+// fileserver refuses to change an image once it is committed.
+type committingFileserver struct {
+	*httptest.Server
+	mu        sync.Mutex
+	blobs     map[string]bool
+	images    map[string]map[string]string // ref to key to hash
+	committed map[string]bool
+	batches   int
+}
+
+func newCommittingFileserver(t *testing.T) *committingFileserver {
+	s := &committingFileserver{blobs: map[string]bool{}, images: map[string]map[string]string{}, committed: map[string]bool{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			ref = r.URL.Query().Get("image")
+		}
+		switch {
+		case r.URL.Path == "/sync":
+			var entries []SyncEntry
+			json.NewDecoder(r.Body).Decode(&entries)
+			resp := SyncResponse{NeedUpload: []string{}, NeedMetadata: []string{}}
+			for _, e := range entries {
+				if s.images[ref][e.Key] == e.Hash {
+					continue
+				} else if s.blobs[e.Hash] {
+					resp.NeedMetadata = append(resp.NeedMetadata, e.Key)
+				} else {
+					resp.NeedUpload = append(resp.NeedUpload, e.Key)
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case strings.HasPrefix(r.URL.Path, "/blobs/"):
+			io.Copy(io.Discard, r.Body)
+			s.blobs[strings.TrimPrefix(r.URL.Path, "/blobs/")] = true
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/batch-upload":
+			s.batches++
+			if s.committed[ref] {
+				http.Error(w, "image "+ref+" is committed and cannot be changed", http.StatusConflict)
+				return
+			}
+			var entries []KeyValue
+			json.NewDecoder(r.Body).Decode(&entries)
+			if s.images[ref] == nil {
+				s.images[ref] = map[string]string{}
+			}
+			for _, e := range entries {
+				s.images[ref][e.Key] = e.HashValue
+			}
+		case r.URL.Path == "/images" && r.Method == http.MethodGet:
+			if !s.committed[ref] {
+				http.Error(w, "Image not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(ImageInfo{Ref: ref})
+		case r.URL.Path == "/images" && r.Method == http.MethodPost:
+			if _, ok := s.images[ref]; !ok {
+				http.Error(w, "Image not found", http.StatusNotFound)
+				return
+			}
+			s.committed[ref] = true
+			json.NewEncoder(w).Encode(ImageInfo{Ref: ref})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_export_twice(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_TOKEN", "")
+	t.Setenv("SWAY_CA_CERT", "")
+	t.Setenv("SWAY_FINGERPRINT", "")
+	server := newCommittingFileserver(t)
+	defer func(url string) { fileServerURL = url }(fileServerURL)
+	fileServerURL = server.URL
+	layout := t.TempDir()
+	writeLayout(t, layout)
+
+	if err := export(false, exportOptions{from: layout}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.committed) != 1 {
+		t.Fatalf("committed %v, want one image", server.committed)
+	}
+	batches := server.batches
+
+	// the layers are cached as stored now, and the image is committed
+	if err := export(false, exportOptions{from: layout}); err != nil {
+		t.Fatalf("exporting the same image again: %v", err)
+	}
+	if server.batches != batches {
+		t.Errorf("%d batches were sent for an image that was already committed", server.batches-batches)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// _cacheMaxAge is how long the hash cache keeps a layer no export has used since.
+const _cacheMaxAge = 30 * 24 * time.Hour
+
+var diffIDPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// hashCache remembers, under the user config directory, what an export had to read
+// every file for, so exporting an image again only reads what changed:
+//   - what each layer holds, by its diff ID, the sha256 of the uncompressed layer tar
+//     that the image config lists. Layers are immutable, so a layer an earlier export
+//     indexed is not read or hashed again.
+//   - which layers the fileserver has all the content of, because an export with them
+//     was committed. Their files aren't synced, only their metadata is sent, and a
+//     pulled image doesn't download them at all.
+//   - the hashes of project files, by path, size and modification time.
+//
+// A nil cache remembers nothing.
+type hashCache struct {
+	dir    string
+	server string              // the file listing the layers the fileserver has
+	stored map[string]struct{} // by diff ID
+	used   []string            // the layers of the image being exported
+}
+
+// openHashCache opens the cache for exports to serverURL, and forgets layers that
+// haven't been used for _cacheMaxAge.
+func openHashCache(serverURL string) *hashCache {
+	dir, err := configDir()
+	if err != nil {
+		logln("no hash cache:", err)
+		return nil
+	}
+	dir = filepath.Join(dir, "cache")
+	sum := sha256.Sum256([]byte(serverURL))
+	c := &hashCache{
+		dir:    dir,
+		server: filepath.Join(dir, "servers", hex.EncodeToString(sum[:16])),
+		stored: map[string]struct{}{},
+	}
+	if data, err := os.ReadFile(c.server); err == nil {
+		for _, id := range strings.Fields(string(data)) {
+			c.stored[id] = struct{}{}
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, "layers"))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > _cacheMaxAge {
+			os.Remove(filepath.Join(dir, "layers", e.Name()))
+		}
+	}
+	return c
+}
+
+func (c *hashCache) layerPath(diffID string) string {
+	return filepath.Join(c.dir, "layers", strings.TrimPrefix(diffID, "sha256:")+".json")
+}
+
+// layer returns the record of the layer with diffID, if an earlier export made one,
+// and whether the fileserver has all its content. The layer counts as one of the
+// image being exported either way.
+func (c *hashCache) layer(diffID string) (*layerRecord, bool) {
+	if c == nil || !diffIDPattern.MatchString(diffID) {
+		return nil, false
+	}
+	c.used = append(c.used, diffID)
+	path := c.layerPath(diffID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var rec layerRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		logln("ignoring cached layer", diffID, err)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	_, stored := c.stored[diffID]
+	return &rec, stored
+}
+
+// saveLayer records what the layer with diffID holds.
+func (c *hashCache) saveLayer(diffID string, rec *layerRecord) {
+	if c == nil || !diffIDPattern.MatchString(diffID) {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = writeCacheFile(c.layerPath(diffID), data)
+	}
+	if err != nil {
+		logln("caching layer", diffID, err)
+	}
+}
+
+// markStored records that the fileserver has all the content of the layers of the
+// image being exported, once the image is committed. Layers the cache has forgotten
+// are dropped from the list.
+func (c *hashCache) markStored() {
+	if c == nil || len(c.used) == 0 {
+		return
+	}
+	for _, id := range c.used {
+		c.stored[id] = struct{}{}
+	}
+	ids := make([]string, 0, len(c.stored))
+	for id := range c.stored {
+		if _, err := os.Stat(c.layerPath(id)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if err := writeCacheFile(c.server, []byte(strings.Join(ids, "\n")+"\n")); err != nil {
+		logln("caching stored layers:", err)
+	}
+}
+
+// forgetStored forgets which layers the fileserver has, once it turned out not to have
+// content the cache said it has, e.g. because it was collected as garbage.
+func (c *hashCache) forgetStored() {
+	if c == nil {
+		return
+	}
+	c.stored = map[string]struct{}{}
+	os.Remove(c.server)
+}
+
+// fileHash is the hash of a project file as it was when it was hashed.
+type fileHash struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	Hash    string `json:"hash"`
+}
+
+func (c *hashCache) projectPath(dir string) string {
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(c.dir, "projects", hex.EncodeToString(sum[:16])+".json")
+}
+
+// projectHashes returns the hashes of the files of the project in dir from the last
+// time it was uploaded, by path.
+func (c *hashCache) projectHashes(dir string) map[string]fileHash {
+	hashes := map[string]fileHash{}
+	if c == nil {
+		return hashes
+	}
+	if data, err := os.ReadFile(c.projectPath(dir)); err == nil {
+		json.Unmarshal(data, &hashes)
+	}
+	return hashes
+}
+
+// saveProjectHashes records the hashes of the files of the project in dir, which were
+// hashed from the time since on. A file modified in that second may have changed
+// after it was hashed without its modification time showing it, so it isn't recorded.
+func (c *hashCache) saveProjectHashes(dir string, files []KeyValue, since int64) {
+	if c == nil {
+		return
+	}
+	hashes := map[string]fileHash{}
+	for _, f := range files {
+		if f.LocalPath != "" && f.HashValue != "" && f.ModTime < since {
+			hashes[f.LocalPath] = fileHash{f.Size, f.ModTime, f.HashValue}
+		}
+	}
+	data, err := json.Marshal(hashes)
+	if err == nil {
+		err = writeCacheFile(c.projectPath(dir), data)
+	}
+	if err != nil {
+		logln("caching project hashes:", err)
+	}
+}
+
+// writeCacheFile replaces the file at path with data in one step, so a crash never
+// leaves half of it.
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
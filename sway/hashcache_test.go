@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// diffID is the diff ID of the uncompressed layer at s.
+func diffID(t *testing.T, s fileSection) string {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func Test_hashCache_layers(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	base := writeLayer(t,
+		dirEntry("etc/"),
+		regEntry("etc/hosts", "localhost"),
+		regEntry("usr/bin/python3", "#!python"),
+		linkEntry("usr/bin/py", "usr/bin/python3", tar.TypeLink),
+	)
+	top := writeLayer(t, regEntry("etc/.wh.hosts", ""), regEntry("srv/train.py", "print(1)"))
+	layers := []fileSection{base, top}
+	ids := []string{diffID(t, base), diffID(t, top)}
+	key := func(f KeyValue) string {
+		return fmt.Sprintf("%s %s %d %d %s", f.Key, f.HashValue, f.Size, f.Nlink, f.HardLink)
+	}
+
+	cache := openHashCache("https://fileserver")
+	first, err := indexLayers(t.TempDir(), cache, layers, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("a cached layer is not read again", func(t *testing.T) {
+		// same size, other bytes: hashing it would give other hashes
+		for _, layer := range layers {
+			data, _ := os.ReadFile(layer.path)
+			os.WriteFile(layer.path, []byte(strings.Repeat("\x00", len(data))), 0644)
+			defer os.WriteFile(layer.path, data, 0644)
+		}
+		files, err := indexLayers(t.TempDir(), openHashCache("https://fileserver"), layers, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != len(first) {
+			t.Fatalf("%d files, want %d", len(files), len(first))
+		}
+		for i, f := range files {
+			if key(f) != key(first[i]) || f.LocalPath != first[i].LocalPath || f.Offset != first[i].Offset || f.Stored {
+				t.Errorf("got %+v, want %+v", f, first[i])
+			}
+		}
+	})
+
+	t.Run("layers of a committed export are not read at all", func(t *testing.T) {
+		cache.markStored()
+		gone := []fileSection{{"/nonexistent/a", 0, -1}, {"/nonexistent/b", 0, -1}}
+		files, err := indexLayers(t.TempDir(), openHashCache("https://fileserver"), gone, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, f := range files {
+			if key(f) != key(first[i]) || f.LocalPath != "" || f.HashValue != "" && !f.Stored {
+				t.Errorf("got %+v, want %+v stored", f, first[i])
+			}
+		}
+
+		// nor are they on another fileserver
+		if _, err := indexLayers(t.TempDir(), openHashCache("https://other"), gone, ids); err == nil {
+			t.Error("layers were taken as stored on another fileserver")
+		}
+
+		other := openHashCache("https://fileserver")
+		other.forgetStored()
+		if _, err := indexLayers(t.TempDir(), openHashCache("https://fileserver"), gone, ids); err == nil {
+			t.Error("layers were taken as stored after forgetting them")
+		}
+	})
+}
+
+func Test_pullImage_cached(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_REGISTRY_USERNAME", "ci")
+	t.Setenv("SWAY_REGISTRY_PASSWORD", "secret")
+	registry := newFakeRegistry(t, "team/ml")
+	host := strings.TrimPrefix(registry.URL, "http://")
+	// tag tags an image of one layer with files, whose config lists diffID for it
+	tag := func(name string, files map[string]string, diffID string) ociDescriptor {
+		layer := registry.push("application/vnd.oci.image.layer.v1.tar+gzip", layerTar(t, true, files))
+		config := registry.push("application/vnd.oci.image.config.v1+json",
+			[]byte(fmt.Sprintf(`{"config":{},"rootfs":{"type":"layers","diff_ids":["%s"]}}`, diffID)))
+		registry.tag(t, name, ociManifest{MediaType: _mediaTypeOCIManifest, Config: config, Layers: []ociDescriptor{layer}})
+		return layer
+	}
+	diffIDOf := func(files map[string]string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(layerTar(t, false, files)))
+	}
+
+	t.Run("a stored layer isn't downloaded again", func(t *testing.T) {
+		files := map[string]string{"srv/": "", "srv/requirements": "numpy"}
+		layer := tag("1.4", files, diffIDOf(files))
+		cache := openHashCache("https://fileserver")
+		_, _, tempDir, _, err := pullImage(host+"/team/ml:1.4", false, cache, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.RemoveAll(tempDir)
+		cache.markStored()
+
+		delete(registry.blobs, layer.Digest)
+		pulled, _, tempDir, _, err := pullImage(host+"/team/ml:1.4", false, openHashCache("https://fileserver"), nil)
+		if err != nil {
+			t.Fatalf("the stored layer was downloaded again: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		if len(pulled) != 2 || pulled[1].Key != "app/srv/requirements" || !pulled[1].Stored || pulled[1].HashValue == "" {
+			t.Errorf("files %+v", pulled)
+		}
+	})
+
+	t.Run("a layer that fails its checks isn't cached", func(t *testing.T) {
+		files := map[string]string{"srv/": "", "srv/train.py": "print(1)"}
+		tag("wrong-diff-id", files, diffIDOf(map[string]string{"srv/": ""}))
+		if _, _, _, _, err := pullImage(host+"/team/ml:wrong-diff-id", false, openHashCache("https://fileserver"), nil); err == nil || !strings.Contains(err.Error(), "diff ID") {
+			t.Errorf("wrong diff ID: got %v", err)
+		}
+		if rec, _ := openHashCache("https://fileserver").layer(diffIDOf(map[string]string{"srv/": ""})); rec != nil {
+			t.Error("a layer that doesn't match its diff ID was cached")
+		}
+
+		// a valid tar matching its diff ID, but not the digest the manifest names
+		tampered := map[string]string{"srv/": "", "srv/train.py": "import os"}
+		layer := tag("tampered", files, diffIDOf(tampered))
+		registry.blobs[layer.Digest] = layerTar(t, true, tampered)
+		if _, _, _, _, err := pullImage(host+"/team/ml:tampered", false, openHashCache("https://fileserver"), nil); err == nil || !strings.Contains(err.Error(), "content has digest") {
+			t.Errorf("tampered layer: got %v", err)
+		}
+		if rec, _ := openHashCache("https://fileserver").layer(diffIDOf(tampered)); rec != nil {
+			t.Error("a layer that doesn't match its digest was cached")
+		}
+	})
+}
+
+func Test_syncNewFiles_stored(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_TOKEN", "")
+	server := newFlakyFileserver(t)
+	path := filepath.Join(t.TempDir(), "new")
+	os.WriteFile(path, []byte("new"), 0644)
+	files := []KeyValue{
+		{Key: "app/lib.so", HashValue: "hash1", Size: 1, LocalPath: "/layer.tar", Offset: 512, Stored: true},
+		{Key: "app/new", Size: 3, LocalPath: path},
+	}
+	toUpload, err := syncNewFiles(files, server.URL, "sway-x@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toUpload) != 2 {
+		t.Fatalf("%d files to upload, want 2", len(toUpload))
+	}
+	// the server doesn't have hash1, but isn't asked
+	if f := toUpload[0]; f.Key != "app/lib.so" || f.LocalPath != "" {
+		t.Errorf("stored file %+v should be sent without content", f)
+	}
+	if f := toUpload[1]; f.Key != "app/new" || f.LocalPath != path || f.HashValue == "" {
+		t.Errorf("new file %+v should be sent with content", f)
+	}
+
+	// a rerun after the stored file was accepted into the image doesn't send it again
+	checkpoint, err := openCheckpoint(server.URL, "sway-x@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint.add(toUpload[:1])
+	checkpoint.Close()
+	toUpload, err = syncNewFiles(files, server.URL, "sway-x@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range toUpload {
+		if f.Key == "app/lib.so" {
+			t.Errorf("stored file %+v the image already has is sent again", f)
+		}
+	}
+}
+
+func Test_hashCache_projectHashes(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	cache := openHashCache("https://fileserver")
+	files := []KeyValue{
+		{Key: "app/a.py", LocalPath: "/p/a.py", Size: 1, ModTime: 99, HashValue: "aaa"},
+		{Key: "app/b.py", LocalPath: "/p/b.py", Size: 1, ModTime: 100, HashValue: "bbb"}, // changed while hashing?
+		{Key: "app/lib", IsDir: true, ModTime: 1},
+	}
+	cache.saveProjectHashes("/p", files, 100)
+
+	got := openHashCache("https://fileserver").projectHashes("/p")
+	if len(got) != 1 || got["/p/a.py"] != (fileHash{1, 99, "aaa"}) {
+		t.Errorf("project hashes %v", got)
+	}
+	if got := cache.projectHashes("/q"); len(got) != 0 {
+		t.Errorf("other project has hashes %v", got)
+	}
+}
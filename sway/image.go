@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageInfo is the fileserver's answer to GET/POST /images
+type ImageInfo struct {
+	Name string `json:"name"`
+	Ref  string `json:"ref"`
+}
+
+// ImageConfig is the part of the image config that says how to run the image: its
+// CMD, ENTRYPOINT, ENV, WORKDIR and USER. Field names follow the OCI image spec, so
+// it decodes straight from the "config" object of a docker image config.
+type ImageConfig struct {
+	User       string   `json:"User,omitempty"`
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// parseImageConfig decodes the runtime config from a docker or OCI image config file.
+func parseImageConfig(data []byte) (ImageConfig, error) {
+	var file struct {
+		Config ImageConfig `json:"config"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return ImageConfig{}, fmt.Errorf("cannot unmarshal image config: %w", err)
+	}
+	return file.Config, nil
+}
+
+// layerDiffIDs returns the diff IDs an image config lists for the image's n layers,
+// the sha256 of each uncompressed layer tar, or nil if it doesn't list one per layer.
+func layerDiffIDs(data []byte, n int) []string {
+	var file struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if json.Unmarshal(data, &file) != nil || len(file.RootFS.DiffIDs) != n {
+		return nil
+	}
+	return file.RootFS.DiffIDs
+}
+
+// defaultImageName is the name `sway export` gives the image built in dir.
+func defaultImageName(dir string) string {
+	return "sway-" + filepath.Base(dir)
+}
+
+// commitImage marks ref as complete on the fileserver and stores its config, if any.
+// After this the image is immutable and becomes the one `sway run` picks for its name.
+func commitImage(serverURL, ref string, config *ImageConfig) error {
+	var body []byte
+	if config != nil {
+		var err error
+		if body, err = json.Marshal(config); err != nil {
+			return fmt.Errorf("commit image: %w", err)
+		}
+	}
+
+	client := fileserverClient()
+	resp, err := client.Post(serverURL+"/images?ref="+url.QueryEscape(ref), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("commit image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("commit image: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	removeCheckpoint(serverURL, ref)
+	return nil
+}
+
+// resolveImage turns the --image flag into a full name@digest reference.
+// A reference that already has a digest is used as is. A bare name resolves to its
+// latest committed export. With no flag, the image exported from the current
+// directory is used if there is one, otherwise the shared default image ("").
+func resolveImage(serverURL, image string) (string, error) {
+	if strings.Contains(image, "@") {
+		return image, nil
+	}
+	explicit := image != ""
+	if !explicit {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return "", fmt.Errorf("could not get working directory: %w", err)
+		}
+		image = defaultImageName(cwd)
+	}
+
+	client := fileserverClient()
+	resp, err := client.Get(serverURL + "/images?name=" + url.QueryEscape(image))
+	if err != nil {
+		return "", fmt.Errorf("resolve image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		if explicit {
+			return "", fmt.Errorf("image %s not found, run sway export first", image)
+		}
+		return "", nil
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolve image: status %d", resp.StatusCode)
+	}
+
+	var info ImageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("resolve image: %w", err)
+	}
+	return info.Ref, nil
+}
+
+// imageCommitted reports whether ref was already uploaded and committed.
+func imageCommitted(serverURL, ref string) bool {
+	client := fileserverClient()
+	resp, err := client.Get(serverURL + "/images?ref=" + url.QueryEscape(ref))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
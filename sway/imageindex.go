@@ -0,0 +1,493 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// fileSection is size bytes of the file at path from offset on, or the rest of it with
+// size -1: a whole file, a member of a tarball, or the content of a file in a layer.
+type fileSection struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// open returns the bytes of s and how many there are.
+func (s fileSection) open() (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := s.size
+	if size < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		size = info.Size() - s.offset
+	}
+	return readCloser{io.NewSectionReader(f, s.offset, size), f.Close}, size, nil
+}
+
+// openContent opens the content of f, which is either the whole file at LocalPath or,
+// with Offset set, Size bytes of the layer tarball at LocalPath.
+func openContent(f KeyValue) (io.ReadCloser, int64, error) {
+	if f.Offset == 0 {
+		return fileSection{f.LocalPath, 0, -1}.open()
+	}
+	return fileSection{f.LocalPath, f.Offset, f.Size}.open()
+}
+
+var (
+	_gzipMagic = []byte{0x1f, 0x8b}
+	_zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressed says whether data starting with magic is gzip or zstd compressed.
+func compressed(magic []byte) bool {
+	return bytes.HasPrefix(magic, _gzipMagic) || bytes.HasPrefix(magic, _zstdMagic)
+}
+
+// decompress returns r decompressed if it is gzip or zstd compressed, as registries
+// serve layers, and whether it was.
+func decompress(r io.Reader) (io.ReadCloser, bool, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, _gzipMagic):
+		gz, err := gzip.NewReader(br)
+		return gz, true, err
+	case bytes.Equal(magic, _zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, true, err
+		}
+		return zr.IOReadCloser(), true, nil
+	}
+	return io.NopCloser(br), false, nil
+}
+
+// readCloser is a reader with what closes what it reads from.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// countingReader counts the bytes read through it, which for a tar reader is where in
+// the tarball the content of the current file starts.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+const (
+	_whiteoutPrefix = ".wh."
+	_whiteoutOpaque = ".wh..wh..opq"
+)
+
+// imageIndex is what the layers indexed so far add up to. It keeps no content, only
+// the hash of every file and where its bytes are in which layer tarball, so an image
+// is exported without extracting it to disk.
+type imageIndex struct {
+	tempDir string                 // where layers that can't be read in place are spooled
+	cache   *hashCache             // layers indexed by earlier exports
+	entries map[string]*indexEntry // by path, without a leading slash
+	seq     int
+}
+
+type indexEntry struct {
+	kv   KeyValue
+	hard string // for a hard link, the path of what it links to
+	seq  int    // when the entry was added, which hard links are resolved in
+}
+
+// layerRecord is what one layer adds to the image: its entries in tar order and the
+// paths it deletes from the layers below. It is what the hash cache keeps of a layer.
+type layerRecord struct {
+	Entries    []layerEntry `json:"entries"`
+	Whiteouts  []string     `json:"whiteouts,omitempty"`
+	OpaqueDirs []string     `json:"opaque_dirs,omitempty"`
+}
+
+type layerEntry struct {
+	KeyValue
+	Hard   string `json:"hard,omitempty"`   // for a hard link, the path of what it links to
+	Start  int64  `json:"start,omitempty"`  // where the content of a regular file is in the uncompressed layer
+	Sparse bool   `json:"sparse,omitempty"` // the content was copied out of the layer, to LocalPath
+}
+
+func newImageIndex(tempDir string, cache *hashCache) *imageIndex {
+	return &imageIndex{tempDir: tempDir, cache: cache, entries: map[string]*indexEntry{}}
+}
+
+// indexLayers indexes the layer tarballs in order, and returns the files of the image
+// to upload. Layers may be gzip or zstd compressed. diffIDs are the layers' IDs from
+// the image config, under which they are looked up in and added to cache.
+func indexLayers(tempDir string, cache *hashCache, layers []fileSection, diffIDs []string) ([]KeyValue, error) {
+	ix := newImageIndex(tempDir, cache)
+	for i, layer := range layers {
+		logln("layer", layer.path, layer.offset)
+		diffID := ""
+		if i < len(diffIDs) {
+			diffID = diffIDs[i]
+		}
+		if ix.cachedLayer(diffID, &layer) {
+			continue
+		}
+		r, _, err := layer.open()
+		if err != nil {
+			return nil, fmt.Errorf("open layer: %w", err)
+		}
+		rec, err := ix.indexLayer(r, &layer, diffID)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read layer %s: %w", filepath.Base(layer.path), err)
+		}
+		ix.cache.saveLayer(diffID, rec)
+	}
+	return ix.files(), nil
+}
+
+// cachedLayer adds the layer with diffID as an earlier export recorded it, without
+// reading it, and says whether it could. That takes a record of the layer, and a place
+// to upload its content from: in, if it is an uncompressed tar, or none at all if the
+// fileserver has all of it already.
+func (ix *imageIndex) cachedLayer(diffID string, in *fileSection) bool {
+	rec, stored := ix.cache.layer(diffID)
+	if rec == nil {
+		return false
+	}
+	if stored {
+		logln("layer", diffID, "is cached and on the fileserver")
+		ix.apply(rec, nil, true)
+		return true
+	}
+	if in == nil || rec.sparse() {
+		return false
+	}
+	r, _, err := in.open()
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(r, magic)
+	if compressed(magic[:n]) {
+		return false
+	}
+	logln("layer", diffID, "is cached")
+	ix.apply(rec, in, false)
+	return true
+}
+
+// indexLayer reads one layer tar from r on top of the layers indexed so far, hashing
+// the content of its files as it goes, and returns its record for the cache. A sha256
+// diffID must match the uncompressed tar. in is where r comes from if it can be read
+// there again; a compressed layer, or one without in, is written decompressed to a
+// spool file in tempDir as it is read, and content is read back from the spool.
+func (ix *imageIndex) indexLayer(r io.Reader, in *fileSection, diffID string) (*layerRecord, error) {
+	dr, isCompressed, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	var src io.Reader = dr
+	var diffHash hash.Hash
+	if diffIDPattern.MatchString(diffID) {
+		diffHash = sha256.New()
+		src = io.TeeReader(src, diffHash)
+	}
+	var content fileSection
+	if in != nil && !isCompressed {
+		content = *in
+	} else {
+		spool, err := os.CreateTemp(ix.tempDir, "layer-*.tar")
+		if err != nil {
+			return nil, err
+		}
+		defer spool.Close()
+		src = io.TeeReader(src, spool)
+		content = fileSection{path: spool.Name()}
+	}
+
+	counter := &countingReader{r: src}
+	reader := tar.NewReader(counter)
+	rec := &layerRecord{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading tar: %v", err)
+		}
+
+		name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		base := filepath.Base(name)
+		if base == _whiteoutOpaque {
+			rec.OpaqueDirs = append(rec.OpaqueDirs, filepath.Dir(name))
+			continue
+		}
+		if strings.HasPrefix(base, _whiteoutPrefix) {
+			rec.Whiteouts = append(rec.Whiteouts, filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, _whiteoutPrefix)))
+			continue
+		}
+		if name == "" {
+			continue // the root directory
+		}
+
+		e := layerEntry{KeyValue: KeyValue{
+			Key:     name,
+			Name:    base,
+			Parent:  filepath.Dir(name),
+			Mode:    header.Mode & 07777,
+			Uid:     header.Uid,
+			Gid:     header.Gid,
+			ModTime: header.ModTime.Unix(),
+		}}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			e.IsDir = true
+		case tar.TypeReg:
+			if err := ix.hashContent(&e, header, reader, counter); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			e.LinkTarget = header.Linkname
+			e.Size = int64(len(header.Linkname))
+		case tar.TypeLink:
+			e.Hard = strings.TrimPrefix(filepath.Clean("/"+header.Linkname), "/")
+		default:
+			continue // devices and fifos are not part of the image
+		}
+		rec.Entries = append(rec.Entries, e)
+	}
+	// the spool must have the content of the last file even if the tar ends without
+	// its trailer
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return nil, err
+	}
+	if diffHash != nil {
+		if got := "sha256:" + hex.EncodeToString(diffHash.Sum(nil)); got != diffID {
+			return nil, fmt.Errorf("layer has diff ID %s, want %s", got, diffID)
+		}
+	}
+	ix.apply(rec, &content, false)
+	return rec, nil
+}
+
+// hashContent sets the hash of the regular file of header, whose content reader is at,
+// and where its bytes start in the layer. Sparse files are the exception that can't be
+// read back in place, and are copied to a file of their own.
+func (ix *imageIndex) hashContent(e *layerEntry, header *tar.Header, reader io.Reader, counter *countingReader) error {
+	h := sha1.New()
+	sparse := header.Typeflag == tar.TypeGNUSparse || header.PAXRecords["GNU.sparse.major"] != "" || header.PAXRecords["GNU.sparse.map"] != ""
+	if sparse {
+		f, err := os.CreateTemp(ix.tempDir, "sparse-*")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(io.MultiWriter(h, f), reader)
+		if err != nil {
+			return err
+		}
+		e.LocalPath, e.Size, e.Sparse = f.Name(), n, true
+		e.HashValue = hex.EncodeToString(h.Sum(nil))
+		return f.Close()
+	}
+
+	start := counter.n
+	n, err := io.Copy(h, reader)
+	if err != nil {
+		return err
+	}
+	if counter.n-start != n {
+		return fmt.Errorf("content is not stored contiguously in the layer")
+	}
+	e.Start, e.Size = start, n
+	e.HashValue = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// apply adds the layer rec on top of the layers indexed so far, with the content of
+// its regular files in content, the uncompressed layer tar. Without content, the
+// files are uploaded without it, which only works if stored says the fileserver has
+// it already.
+//
+// OCI whiteouts are honoured: ".wh.<name>" deletes <name> from the lower layers, and
+// ".wh..wh..opq" removes everything the lower layers put in its directory. Whiteouts
+// never apply to entries of their own layer, so they are applied once the whole layer
+// is added, whatever order the tar lists them in.
+func (ix *imageIndex) apply(rec *layerRecord, content *fileSection, stored bool) {
+	added := map[string]struct{}{} // paths this layer creates
+	for _, le := range rec.Entries {
+		e := &indexEntry{kv: le.KeyValue, hard: le.Hard}
+		e.kv.Stored = stored
+		if e.kv.HashValue != "" && !le.Sparse {
+			e.kv.LocalPath, e.kv.Offset = "", 0
+			if content != nil {
+				e.kv.LocalPath, e.kv.Offset = content.path, content.offset+le.Start
+			}
+		}
+		added[e.kv.Key] = struct{}{}
+		ix.put(e, added)
+	}
+
+	for _, path := range rec.Whiteouts {
+		if _, ok := added[path]; ok {
+			continue
+		}
+		logln("whiteout", path)
+		delete(ix.entries, path)
+		ix.removeUnder(path, added)
+	}
+	if len(rec.OpaqueDirs) > 0 {
+		// keep what this layer added, and the directories leading to it
+		keep := map[string]struct{}{}
+		for path := range added {
+			for p := path; p != "."; p = filepath.Dir(p) {
+				keep[p] = struct{}{}
+			}
+		}
+		for _, dir := range rec.OpaqueDirs {
+			logln("opaque", dir)
+			ix.removeUnder(dir, keep)
+		}
+	}
+}
+
+// sparse says whether some content of the layer was copied out of it, so it can't be
+// uploaded from the layer tar alone.
+func (rec *layerRecord) sparse() bool {
+	for _, e := range rec.Entries {
+		if e.Sparse {
+			return true
+		}
+	}
+	return false
+}
+
+// put adds e on top of what the lower layers have at its path. Anything but a
+// directory replaces a lower directory along with everything in it.
+func (ix *imageIndex) put(e *indexEntry, added map[string]struct{}) {
+	if old, ok := ix.entries[e.kv.Key]; ok && old.kv.IsDir && !e.kv.IsDir {
+		ix.removeUnder(e.kv.Key, added)
+	}
+	ix.seq++
+	e.seq = ix.seq
+	ix.entries[e.kv.Key] = e
+}
+
+// removeUnder removes everything under dir that is not in keep.
+func (ix *imageIndex) removeUnder(dir string, keep map[string]struct{}) {
+	for path := range ix.entries {
+		if _, ok := keep[path]; ok || !underAny(path, []string{dir}, false) {
+			continue
+		}
+		delete(ix.entries, path)
+	}
+}
+
+// files returns the files of the merged tree to upload, under app/. Hard links get
+// the content of the file they link to: every path of a group gets the key of that
+// file in HardLink, the size of the group in Nlink, and the file's metadata.
+func (ix *imageIndex) files() []KeyValue {
+	// directories no layer has a header for, like usr/ of a layer with only usr/bin/env
+	now := time.Now().Unix()
+	for name := range ix.entries {
+		for p := filepath.Dir(name); p != "."; p = filepath.Dir(p) {
+			if _, ok := ix.entries[p]; ok {
+				break
+			}
+			ix.entries[p] = &indexEntry{kv: KeyValue{
+				Key:     p,
+				Name:    filepath.Base(p),
+				Parent:  filepath.Dir(p),
+				IsDir:   true,
+				Mode:    0755,
+				ModTime: now,
+			}}
+		}
+	}
+
+	links := []*indexEntry{}
+	for _, e := range ix.entries {
+		if e.hard != "" {
+			links = append(links, e)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].seq < links[j].seq })
+	symlinks := make([]Symlink, len(links))
+	for i, e := range links {
+		symlinks[i] = Symlink{Name: e.kv.Key, Linkname: e.hard, Hard: true}
+	}
+	groups := hardLinkGroups(symlinks)
+	for _, e := range links {
+		target, ok := ix.entries[groups[e.kv.Key]]
+		if !ok || target.kv.HashValue == "" {
+			delete(ix.entries, e.kv.Key) // links to nothing, or to a directory
+		}
+	}
+	nlink := map[string]int{}
+	for name := range ix.entries {
+		if group, ok := groups[name]; ok {
+			nlink[group]++
+		}
+	}
+
+	out := make([]KeyValue, 0, len(ix.entries))
+	for name, e := range ix.entries {
+		file := e.kv
+		if group, ok := groups[name]; ok {
+			target := ix.entries[group].kv
+			file.HardLink = group
+			file.Nlink = nlink[group]
+			file.Mode, file.Uid, file.Gid, file.ModTime = target.Mode, target.Uid, target.Gid, target.ModTime
+			if e.hard != "" {
+				file.HashValue, file.Size = target.HashValue, target.Size
+				file.LocalPath, file.Offset, file.Stored = target.LocalPath, target.Offset, target.Stored
+			}
+		}
+
+		if !strings.HasPrefix(file.Key, "app/") && file.Key != "app" {
+			file.Key = "app/" + file.Key
+			if file.HardLink != "" {
+				file.HardLink = "app/" + file.HardLink
+			}
+			if file.Parent == "." {
+				file.Parent = "app"
+			} else {
+				file.Parent = "app/" + file.Parent
+			}
+		}
+		out = append(out, file)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a tar header and the content of a regular file.
+type tarEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func regEntry(name, content string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}, content}
+}
+
+func dirEntry(name string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func linkEntry(name, target string, typ byte) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Typeflag: typ, Linkname: target, Mode: 0777}}
+}
+
+// writeLayer writes an uncompressed layer of entries, in order, to a new file.
+func writeLayer(t *testing.T, entries ...tarEntry) fileSection {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "layer-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(buf.Bytes())
+	return fileSection{f.Name(), 0, -1}
+}
+
+func Test_indexLayers(t *testing.T) {
+	base := writeLayer(t,
+		dirEntry("etc/"),
+		regEntry("etc/passwd", "root"),
+		regEntry("etc/hosts", "localhost"),
+		dirEntry("opt/"),
+		regEntry("opt/a", "a"),
+		regEntry("opt/b", "b"),
+		regEntry("usr/bin/python3", "#!python"), // no headers for usr/ and usr/bin/
+		linkEntry("usr/bin/python", "python3", tar.TypeSymlink),
+		linkEntry("usr/bin/py", "usr/bin/python3", tar.TypeLink),
+		dirEntry("var/cache/"),
+		regEntry("var/cache/x", "x"),
+	)
+	top := writeLayer(t,
+		regEntry("etc/.wh.hosts", ""),
+		regEntry("opt/.wh..wh..opq", ""),
+		regEntry("opt/c", "c"),
+		regEntry("var/cache", "now a file"),
+		regEntry("etc/passwd", "root:x"),
+	)
+	tempDir := t.TempDir()
+	files, err := indexLayers(tempDir, nil, []fileSection{base, top}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byKey := map[string]KeyValue{}
+	for _, f := range files {
+		byKey[f.Key] = f
+	}
+	for _, key := range []string{"app/etc/hosts", "app/opt/a", "app/opt/b", "app/var/cache/x"} {
+		if _, ok := byKey[key]; ok {
+			t.Errorf("%s should be gone", key)
+		}
+	}
+	contents := map[string]string{
+		"app/etc/passwd":      "root:x",
+		"app/opt/c":           "c",
+		"app/var/cache":       "now a file",
+		"app/usr/bin/python3": "#!python",
+		"app/usr/bin/py":      "#!python",
+	}
+	for key, want := range contents {
+		f, ok := byKey[key]
+		if !ok {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		if f.HashValue == "" || f.Offset == 0 {
+			t.Errorf("%s has no hash or offset: %+v", key, f)
+		}
+		data, err := readContent(f)
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", key, data, err, want)
+		}
+		// read where it is, not from a copy
+		if f.LocalPath != base.path && f.LocalPath != top.path {
+			t.Errorf("%s is read from %s", key, f.LocalPath)
+		}
+	}
+	if f := byKey["app/usr/bin/python"]; f.LinkTarget != "python3" {
+		t.Errorf("symlink %+v", f)
+	}
+	if py, py3 := byKey["app/usr/bin/py"], byKey["app/usr/bin/python3"]; py.HardLink != "app/usr/bin/python3" || py.Nlink != 2 || py3.Nlink != 2 || py.HashValue != py3.HashValue {
+		t.Errorf("hard link group %+v %+v", py, py3)
+	}
+	for _, key := range []string{"app/usr", "app/usr/bin"} {
+		if f := byKey[key]; !f.IsDir || f.Mode != 0755 {
+			t.Errorf("implied directory %s: %+v", key, f)
+		}
+	}
+	if f := byKey["app/etc/passwd"]; f.Parent != "app/etc" || f.Name != "passwd" || f.Mode != 0644 {
+		t.Errorf("metadata %+v", f)
+	}
+	if des, _ := os.ReadDir(tempDir); len(des) != 0 {
+		t.Errorf("uncompressed layers were copied to %s", tempDir)
+	}
+}
+
+func Test_indexLayer_spool(t *testing.T) {
+	// a layer that can't be read again where it came from is spooled while indexing
+	layer := layerTar(t, true, map[string]string{"srv/": "", "srv/train.py": "print(1)", "srv/big": strings.Repeat("x", 1<<20)})
+	tempDir := t.TempDir()
+	ix := newImageIndex(tempDir, nil)
+	if _, err := ix.indexLayer(bytes.NewReader(layer), nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range ix.files() {
+		if f.IsDir {
+			continue
+		}
+		if filepath.Dir(f.LocalPath) != tempDir {
+			t.Errorf("%s is read from %s", f.Key, f.LocalPath)
+		}
+		data, err := readContent(f)
+		if err != nil || computeHash(f) != f.HashValue || len(data) != int(f.Size) {
+			t.Errorf("%s: content doesn't match its hash: %v", f.Key, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageArchive is a docker image save or an OCI image layout, as a directory or as a
+// tarball, whose files are read where they are.
+type imageArchive struct {
+	dir     string                 // for a directory
+	members map[string]fileSection // for a tarball, its regular files
+}
+
+// openImageArchive opens the image at path. An uncompressed tarball is only scanned
+// for where its files are; a compressed one has to be extracted to tempDir.
+func openImageArchive(path, tempDir string) (*imageArchive, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &imageArchive{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, compressed, err := decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("open tarfile: %w", err)
+	}
+	defer r.Close()
+	if compressed {
+		dir := filepath.Join(tempDir, "image")
+		if err := untar(r, dir); err != nil {
+			return nil, fmt.Errorf("read tarfile: %w", err)
+		}
+		return &imageArchive{dir: dir}, nil
+	}
+
+	// read the file directly, so the tar reader seeks over content instead of reading it
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	a := &imageArchive{members: map[string]fileSection{}}
+	reader := tar.NewReader(f)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tarfile: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		a.members[filepath.Clean(header.Name)] = fileSection{path, offset, header.Size}
+	}
+	return a, nil
+}
+
+// untar extracts the regular files of the tar r to dir.
+func untar(r io.Reader, dir string) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(filepath.Clean("/"+header.Name), "/")
+		if header.Typeflag != tar.TypeReg || name == "" {
+			continue
+		}
+		target := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, reader)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// section returns where the file name of the archive is.
+func (a *imageArchive) section(name string) (fileSection, error) {
+	if a.members == nil {
+		path := filepath.Join(a.dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return fileSection{}, err
+		}
+		return fileSection{path, 0, -1}, nil
+	}
+	s, ok := a.members[filepath.Clean(name)]
+	if !ok {
+		return fileSection{}, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return s, nil
+}
+
+func (a *imageArchive) readFile(name string) ([]byte, error) {
+	s, err := a.section(name)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (a *imageArchive) has(name string) bool {
+	_, err := a.section(name)
+	return err == nil
+}
+
+// loadImage indexes the image at path into a list of files to upload, and returns the
+// image digest used to name it on the fileserver and its config. path is a docker image
+// save tarball, an OCI image layout directory, or a tarball of one, and may be gzip or
+// zstd compressed like its layers. Content is read straight from path on upload, so it
+// must stay until then; only what is compressed is written to tempDir, decompressed.
+// Layers are looked up in and added to cache. The caller must call os.RemoveAll on the
+// returned tempDir when done.
+func loadImage(path string, cache *hashCache) ([]KeyValue, string, string, ImageConfig, error) {
+	tempDir, err := os.MkdirTemp("", "image-index-")
+	if err != nil {
+		return nil, "", "", ImageConfig{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	fail := func(err error) ([]KeyValue, string, string, ImageConfig, error) {
+		os.RemoveAll(tempDir)
+		return nil, "", "", ImageConfig{}, err
+	}
+
+	a, err := openImageArchive(path, tempDir)
+	if err != nil {
+		return fail(err)
+	}
+	var files []KeyValue
+	var digest string
+	var config ImageConfig
+	// docker image save writes manifest.json, and since Docker 25 an OCI layout beside it
+	switch {
+	case a.has("manifest.json"):
+		files, digest, config, err = indexDockerImage(a, tempDir, cache)
+	case a.has("index.json"):
+		files, digest, config, err = indexLayoutImage(a, tempDir, cache)
+	default:
+		err = fmt.Errorf("%s is neither a docker image save tarball nor an OCI image layout", path)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return files, digest, tempDir, config, nil
+}
+
+// indexDockerImage indexes the image described by manifest.json in a, as written by
+// docker image save.
+func indexDockerImage(a *imageArchive, tempDir string, cache *hashCache) ([]KeyValue, string, ImageConfig, error) {
+	manifestData, err := a.readFile("manifest.json")
+	if err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("read manifest: %w", err)
+	}
+	var manifests []Manifest
+	if err := json.Unmarshal(manifestData, &manifests); err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("cannot unmarshal manifest: %w", err)
+	}
+	if len(manifests) == 0 || manifests[0].Config == "" {
+		return nil, "", ImageConfig{}, fmt.Errorf("manifest.json names no image config")
+	}
+
+	data, err := a.readFile(manifests[0].Config)
+	if err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("read image config: %w", err)
+	}
+	config, err := parseImageConfig(data)
+	if err != nil {
+		return nil, "", ImageConfig{}, err
+	}
+
+	logln(manifests[0].Layers)
+	layers := make([]fileSection, len(manifests[0].Layers))
+	for i, layer := range manifests[0].Layers {
+		if layers[i], err = a.section(layer); err != nil {
+			return nil, "", ImageConfig{}, fmt.Errorf("read layer: %w", err)
+		}
+	}
+	files, err := indexLayers(tempDir, cache, layers, layerDiffIDs(data, len(layers)))
+	if err != nil {
+		return nil, "", ImageConfig{}, err
+	}
+	return files, imageDigest(manifests[0]), config, nil
+}
+
+// indexLayoutImage indexes the image of the OCI image layout in a. If index.json
+// lists several platforms, linux/amd64 is taken.
+func indexLayoutImage(a *imageArchive, tempDir string, cache *hashCache) ([]KeyValue, string, ImageConfig, error) {
+	data, err := a.readFile("index.json")
+	if err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("read index: %w", err)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("cannot unmarshal index.json: %w", err)
+	}
+	// an index may point at another index, e.g. of a multi-platform build
+	for depth := 0; len(m.Manifests) > 0; depth++ {
+		d, err := pickPlatform(m)
+		if err != nil {
+			return nil, "", ImageConfig{}, err
+		}
+		if depth == 8 {
+			return nil, "", ImageConfig{}, fmt.Errorf("index.json nests indexes too deep")
+		}
+		if data, err = a.readFile(layoutBlob(d.Digest)); err != nil {
+			return nil, "", ImageConfig{}, fmt.Errorf("read manifest: %w", err)
+		}
+		m = ociManifest{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, "", ImageConfig{}, fmt.Errorf("cannot unmarshal manifest %s: %w", d.Digest, err)
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, "", ImageConfig{}, fmt.Errorf("manifest names no image config")
+	}
+
+	data, err = a.readFile(layoutBlob(m.Config.Digest))
+	if err != nil {
+		return nil, "", ImageConfig{}, fmt.Errorf("read image config: %w", err)
+	}
+	config, err := parseImageConfig(data)
+	if err != nil {
+		return nil, "", ImageConfig{}, err
+	}
+	layers := make([]fileSection, len(m.Layers))
+	for i, layer := range m.Layers {
+		if strings.Contains(layer.MediaType, "foreign") || strings.Contains(layer.MediaType, "nondistributable") {
+			return nil, "", ImageConfig{}, fmt.Errorf("unsupported layer type %s", layer.MediaType)
+		}
+		if layers[i], err = a.section(layoutBlob(layer.Digest)); err != nil {
+			return nil, "", ImageConfig{}, fmt.Errorf("read layer: %w", err)
+		}
+	}
+	files, err := indexLayers(tempDir, cache, layers, layerDiffIDs(data, len(layers)))
+	if err != nil {
+		return nil, "", ImageConfig{}, err
+	}
+	return files, configDigest(m.Config), config, nil
+}
+
+// layoutBlob is where an OCI image layout keeps the blob with digest.
+func layoutBlob(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join("blobs", algorithm, hex)
+}
+
+// configDigest is the short digest of the image with config d, the same docker image
+// save names the config with.
+func configDigest(d ociDescriptor) string {
+	_, hex, _ := strings.Cut(d.Digest, ":")
+	return imageDigest(Manifest{Config: hex})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeLayout writes an OCI image layout of one image to dir, whose two layers are
+// compressed with gzip and zstd, and returns the digest of its config.
+func writeLayout(t *testing.T, dir string) string {
+	blob := func(data []byte) ociDescriptor {
+		sum := sha256.Sum256(data)
+		path := filepath.Join(dir, "blobs", "sha256", fmt.Sprintf("%x", sum))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return ociDescriptor{Digest: fmt.Sprintf("sha256:%x", sum), Size: int64(len(data))}
+	}
+	write := func(name string, v any) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "" {
+			if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return data
+	}
+
+	baseFiles := map[string]string{"usr/": "", "usr/bin/": "", "usr/bin/python3": "#!python"}
+	topTar := layerTar(t, false, map[string]string{"srv/": "", "srv/train.py": "print(1)"})
+	var zstdLayer bytes.Buffer
+	zw, err := zstd.NewWriter(&zstdLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(topTar)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := blob([]byte(fmt.Sprintf(`{"config":{"WorkingDir":"/srv"},"rootfs":{"type":"layers","diff_ids":["sha256:%x","sha256:%x"]}}`,
+		sha256.Sum256(layerTar(t, false, baseFiles)), sha256.Sum256(topTar))))
+	base := blob(layerTar(t, true, baseFiles))
+	base.MediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	top := blob(zstdLayer.Bytes())
+	top.MediaType = "application/vnd.oci.image.layer.v1.tar+zstd"
+	manifest := blob(write("", ociManifest{MediaType: _mediaTypeOCIManifest, Config: config, Layers: []ociDescriptor{base, top}}))
+	manifest.MediaType = _mediaTypeOCIManifest
+
+	write("oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"})
+	write("index.json", ociManifest{MediaType: _mediaTypeOCIIndex, Manifests: []ociDescriptor{manifest}})
+	return config.Digest
+}
+
+// tarDir writes the files under dir to a tarball at path, gzipped with compress.
+func tarDir(t *testing.T, dir, path string, compress bool) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if info.IsDir() {
+			files[rel+"/"] = ""
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		files[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, layerTar(t, compress, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_loadImage(t *testing.T) {
+	layout := t.TempDir()
+	configDigest := writeLayout(t, layout)
+	layoutTar := filepath.Join(t.TempDir(), "layout.tar")
+	tarDir(t, layout, layoutTar, false)
+
+	// docker image save output of the same image, gzipped as people ship it
+	save := t.TempDir()
+	var index, manifest ociManifest
+	data, _ := os.ReadFile(filepath.Join(layout, "index.json"))
+	json.Unmarshal(data, &index)
+	data, _ = os.ReadFile(filepath.Join(layout, layoutBlob(index.Manifests[0].Digest)))
+	json.Unmarshal(data, &manifest)
+	legacy := []Manifest{{Config: "blobs/sha256/" + strings.TrimPrefix(configDigest, "sha256:")}}
+	for _, d := range append([]ociDescriptor{manifest.Config}, manifest.Layers...) {
+		data, _ := os.ReadFile(filepath.Join(layout, layoutBlob(d.Digest)))
+		os.MkdirAll(filepath.Dir(filepath.Join(save, layoutBlob(d.Digest))), 0755)
+		os.WriteFile(filepath.Join(save, layoutBlob(d.Digest)), data, 0644)
+		if d.Digest != configDigest {
+			legacy[0].Layers = append(legacy[0].Layers, "blobs/sha256/"+strings.TrimPrefix(d.Digest, "sha256:"))
+		}
+	}
+	data, _ = json.Marshal(legacy)
+	os.WriteFile(filepath.Join(save, "manifest.json"), data, 0644)
+	saveTar := filepath.Join(t.TempDir(), "image.tar.gz")
+	tarDir(t, save, saveTar, true)
+
+	want := map[string]string{
+		"app/usr/bin/python3": "#!python",
+		"app/srv/train.py":    "print(1)",
+	}
+	for _, tc := range []struct{ name, path string }{
+		{"an OCI image layout directory", layout},
+		{"a tarball of an OCI image layout", layoutTar},
+		{"a gzipped docker image save tarball", saveTar},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			files, digest, tempDir, config, err := loadImage(tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+			if want := strings.TrimPrefix(configDigest, "sha256:")[:12]; digest != want {
+				t.Errorf("digest %q, want %q", digest, want)
+			}
+			if config.WorkingDir != "/srv" {
+				t.Errorf("config %+v", config)
+			}
+			contents := map[string]string{}
+			for _, f := range files {
+				if f.IsDir {
+					continue
+				}
+				data, err := readContent(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents[f.Key] = string(data)
+			}
+			if fmt.Sprint(contents) != fmt.Sprint(want) {
+				t.Errorf("files %v, want %v", contents, want)
+			}
+		})
+	}
+
+	t.Run("something else", func(t *testing.T) {
+		_, _, _, _, err := loadImage(t.TempDir(), nil)
+		if err == nil || !strings.Contains(err.Error(), "neither") {
+			t.Errorf("got %v", err)
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const _ignoreFile = ".swayignore"
+
+// _defaultIgnores are left out of every project, whatever .swayignore says.
+var _defaultIgnores = []string{".git/", "__pycache__/", _imageTar}
+
+// ignoreRule is one line of a .swayignore.
+type ignoreRule struct {
+	pattern  string
+	negate   bool // "!pattern" brings back paths an earlier rule ignored
+	dirOnly  bool // "pattern/" only matches directories
+	anchored bool // patterns with a slash match the whole path from the project root, others match any base name
+}
+
+// ignoreRules decides which paths of a project are not uploaded. Later rules win.
+type ignoreRules []ignoreRule
+
+// parseIgnore parses .swayignore lines. The syntax is a subset of .gitignore: blank
+// lines and # comments are skipped, and patterns are matched with path.Match.
+func parseIgnore(lines []string) ignoreRules {
+	var rules ignoreRules
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// readIgnore reads the .swayignore in dir, on top of the default ignores.
+func readIgnore(dir string) (ignoreRules, error) {
+	lines := append([]string(nil), _defaultIgnores...)
+	f, err := os.Open(filepath.Join(dir, _ignoreFile))
+	if os.IsNotExist(err) {
+		return parseIgnore(lines), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return parseIgnore(lines), scanner.Err()
+}
+
+// ignored reports whether relPath, a slash-separated path from the project root, is
+// left out.
+func (rules ignoreRules) ignored(relPath string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		name := path.Base(relPath)
+		if r.anchored {
+			name = relPath
+		}
+		if ok, _ := path.Match(r.pattern, name); ok {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// walkProject lists the files and directories of the project in dir that are not
+// ignored, keyed under the app directory. Ignored directories are not descended into.
+func walkProject(dir string, rules ignoreRules) ([]KeyValue, error) {
+	result := []KeyValue{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if rules.ignored(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			logln("skipping", relPath, err)
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		kv := KeyValue{
+			Key:     _appDir + "/" + relPath,
+			Name:    path.Base(relPath),
+			Parent:  path.Join(_appDir, path.Dir(relPath)),
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: info.ModTime().Unix(),
+		}
+		if !info.IsDir() {
+			kv.LocalPath = p
+		}
+		result = append(result, kv)
+		return nil
+	})
+	return result, err
+}
+
+// projectDigest identifies a project by the paths, modes and content hashes of its
+// files, so an unchanged project maps to the same image. HashValue must be set.
+func projectDigest(files []KeyValue) string {
+	lines := make([]string, len(files))
+	for i, f := range files {
+		lines[i] = fmt.Sprintf("%s %o %s", f.Key, f.Mode, f.HashValue)
+	}
+	sort.Strings(lines)
+	h := sha1.New()
+	for _, line := range lines {
+		h.Write([]byte(line + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+var imageNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// projectImageName is the image a user's project in dir is uploaded as.
+func projectImageName(username, dir string) string {
+	return imageNameUnsafe.ReplaceAllString("project-"+username+"-"+filepath.Base(dir), "-")
+}
+
+// uploadProject uploads the project in dir as an image of its own and returns its
+// reference, or "" for an empty project. Only content the fileserver doesn't have yet
+// is sent, and nothing at all if the same project was uploaded before.
+func uploadProject(serverURL, username, dir string) (string, error) {
+	rules, err := readIgnore(dir)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", _ignoreFile, err)
+	}
+	files, err := walkProject(dir, rules)
+	if err != nil {
+		return "", fmt.Errorf("walk project: %w", err)
+	}
+
+	// a file unchanged since the last upload keeps its hash
+	cache := openHashCache(serverURL)
+	known := cache.projectHashes(dir)
+	since := time.Now().Unix()
+	hashed := files[:0]
+	for _, f := range files {
+		if h, ok := known[f.LocalPath]; ok && f.LocalPath != "" && h.Size == f.Size && h.ModTime == f.ModTime {
+			f.HashValue = h.Hash
+		} else {
+			f.HashValue = computeHash(f)
+		}
+		if f.HashValue == "" {
+			logln("skipping unreadable file", f.LocalPath)
+			continue
+		}
+		hashed = append(hashed, f)
+	}
+	files = hashed
+	cache.saveProjectHashes(dir, files, since)
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	ref := projectImageName(username, dir) + "@" + projectDigest(files)
+	if imageCommitted(serverURL, ref) {
+		return ref, nil
+	}
+
+	toUpload, err := syncNewFiles(files, serverURL, ref)
+	if err != nil {
+		return "", err
+	}
+	if err := uploadFiles(toUpload, serverURL, ref, nil); err != nil {
+		return "", err
+	}
+	if err := commitImage(serverURL, ref, nil); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Media types of manifests and layers the registry client understands. Docker's are the
+// older names of the OCI ones.
+const (
+	_mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	_mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	_mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	_mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// _dockerHub is where references without a registry, like python:3.10, are pulled from.
+const _dockerHub = "registry-1.docker.io"
+
+// imageReference is a parsed image reference like registry.local:5000/team/ml:1.4.
+type imageReference struct {
+	registry   string // host and port
+	repository string // e.g. team/ml, or library/python on Docker Hub
+	reference  string // tag, or digest like sha256:...
+}
+
+// parseImageReference parses references the way docker pull does: the first path
+// component is the registry if it looks like a host, the tag defaults to latest.
+func parseImageReference(s string) (imageReference, error) {
+	ref := imageReference{registry: _dockerHub}
+	rest := s
+	if host, path, ok := strings.Cut(s, "/"); ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		ref.registry, rest = host, path
+	}
+	if name, digest, ok := strings.Cut(rest, "@"); ok {
+		rest, ref.reference = name, digest
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 {
+		rest, ref.reference = rest[:i], rest[i+1:]
+	} else {
+		ref.reference = "latest"
+	}
+	if ref.registry == _dockerHub && rest != "" && !strings.Contains(rest, "/") {
+		rest = "library/" + rest
+	}
+	if rest == "" || ref.reference == "" || strings.ToLower(rest) != rest {
+		return imageReference{}, fmt.Errorf("invalid image reference %q, want e.g. registry.local:5000/team/ml:1.4", s)
+	}
+	ref.repository = rest
+	return ref, nil
+}
+
+func (ref imageReference) String() string {
+	sep := ":"
+	if strings.Contains(ref.reference, ":") {
+		sep = "@"
+	}
+	return ref.registry + "/" + ref.repository + sep + ref.reference
+}
+
+// ociDescriptor points at a blob or manifest by digest.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an image manifest, or with Manifests set an index of the manifests of
+// one image for several platforms.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// registryClient pulls from one repository of a registry over the OCI distribution
+// protocol.
+type registryClient struct {
+	base       string // scheme and host
+	repository string
+	client     *http.Client
+	username   string
+	password   string
+	auth       string // Authorization header, once a challenge was answered
+}
+
+// newRegistryClient talks HTTPS to the registry of ref, or plain HTTP with plainHTTP and
+// to registries on this machine, like docker does.
+func newRegistryClient(ref imageReference, plainHTTP bool) *registryClient {
+	scheme := "https"
+	host, _, err := net.SplitHostPort(ref.registry)
+	if err != nil {
+		host = ref.registry
+	}
+	if ip := net.ParseIP(host); plainHTTP || host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	c := &registryClient{
+		base:       scheme + "://" + ref.registry,
+		repository: ref.repository,
+		client:     &http.Client{},
+	}
+	c.username, c.password = registryCredentials(ref.registry)
+	return c
+}
+
+// registryCredentials returns the username and password for registry, from
+// SWAY_REGISTRY_USERNAME and SWAY_REGISTRY_PASSWORD, or else from what docker login
+// saved in ~/.docker/config.json. Credential helpers are not supported.
+func registryCredentials(registry string) (string, string) {
+	if username := os.Getenv("SWAY_REGISTRY_USERNAME"); username != "" {
+		return username, os.Getenv("SWAY_REGISTRY_PASSWORD")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", ""
+	}
+	data, err := os.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if err != nil {
+		return "", ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(data, &config) != nil {
+		return "", ""
+	}
+	key := registry
+	if registry == _dockerHub {
+		key = "https://index.docker.io/v1/"
+	}
+	for _, k := range []string{key, "https://" + key, "http://" + key} {
+		if auth, ok := config.Auths[k]; ok {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", ""
+			}
+			username, password, _ := strings.Cut(string(decoded), ":")
+			return username, password
+		}
+	}
+	return "", ""
+}
+
+// get fetches path of the repository, answering an authentication challenge once.
+func (c *registryClient) get(path string, accept ...string) (*http.Response, error) {
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", c.base+"/v2/"+c.repository+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		return c.client.Do(req)
+	}
+	resp, err := do()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.auth != "" {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authorize(challenge); err != nil {
+		return nil, err
+	}
+	return do()
+}
+
+// authorize answers a WWW-Authenticate challenge: with basic auth directly, or with a
+// token from the registry's token service for bearer auth.
+func (c *registryClient) authorize(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry wants a login, set SWAY_REGISTRY_USERNAME and SWAY_REGISTRY_PASSWORD or run docker login")
+		}
+		c.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry asks for unsupported authentication %q", challenge)
+	}
+
+	values := parseChallenge(params)
+	realm, err := url.Parse(values["realm"])
+	if err != nil || values["realm"] == "" {
+		return fmt.Errorf("registry sent a bad challenge %q", challenge)
+	}
+	query := realm.Query()
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + c.repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("getting registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("getting registry token: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("getting registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.auth = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses the key="value" pairs of a WWW-Authenticate challenge. Values
+// may contain commas, e.g. scope="repository:team/ml:pull,push".
+func parseChallenge(params string) map[string]string {
+	values := map[string]string{}
+	for params != "" {
+		key, rest, ok := strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:end+1], rest[end+2:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return values
+}
+
+// manifest fetches the image manifest for reference. An index is resolved to its
+// linux/amd64 image.
+func (c *registryClient) manifest(reference string) (ociManifest, error) {
+	resp, err := c.get("/manifests/"+reference, _mediaTypeOCIIndex, _mediaTypeDockerList, _mediaTypeOCIManifest, _mediaTypeDockerManifest)
+	if err != nil {
+		return ociManifest{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ociManifest{}, fmt.Errorf("image not found in the registry")
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return ociManifest{}, fmt.Errorf("fetching manifest: status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var m ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return ociManifest{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	if m.MediaType != _mediaTypeOCIIndex && m.MediaType != _mediaTypeDockerList && len(m.Manifests) == 0 {
+		return m, nil
+	}
+	d, err := pickPlatform(m)
+	if err != nil {
+		return ociManifest{}, err
+	}
+	return c.manifest(d.Digest)
+}
+
+// pickPlatform returns the linux/amd64 manifest of index, the platform sway export
+// builds for, or its only one.
+func pickPlatform(index ociManifest) (ociDescriptor, error) {
+	if len(index.Manifests) == 1 {
+		return index.Manifests[0], nil
+	}
+	platforms := []string{}
+	for _, d := range index.Manifests {
+		if d.Platform == nil {
+			continue
+		}
+		if d.Platform.OS == "linux" && d.Platform.Architecture == "amd64" {
+			return d, nil
+		}
+		platforms = append(platforms, d.Platform.OS+"/"+d.Platform.Architecture)
+	}
+	return ociDescriptor{}, fmt.Errorf("image has no linux/amd64 variant, only %s", strings.Join(platforms, ", "))
+}
+
+// fetchBlob streams the blob d to read, and checks it against its digest once read
+// returns. Nothing read may be trusted until fetchBlob returns without an error.
+func (c *registryClient) fetchBlob(d ociDescriptor, read func(io.Reader) error) error {
+	algorithm, want, ok := strings.Cut(d.Digest, ":")
+	if !ok || algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest %q", d.Digest)
+	}
+	resp, err := c.get("/blobs/" + d.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("fetching %s: status %d: %s", d.Digest, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+	readErr := read(body)
+	// a blob that isn't what was asked for explains a read error best
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("fetching %s: %w", d.Digest, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("fetching %s: content has digest sha256:%s", d.Digest, got)
+	}
+	if readErr != nil {
+		return fmt.Errorf("fetching %s: %w", d.Digest, readErr)
+	}
+	return nil
+}
+
+// pullImage streams the layers of the image s from its registry into an index like
+// loadImage, calling onProgress after each layer. Layers are kept decompressed in a
+// temp directory for the upload to read from, except layers cache says the fileserver
+// has, which aren't downloaded at all. It also returns the image config.
+// The caller must call os.RemoveAll on the returned tempDir when done.
+func pullImage(s string, plainHTTP bool, cache *hashCache, onProgress ProgressFunc) ([]KeyValue, string, string, ImageConfig, error) {
+	ref, err := parseImageReference(s)
+	if err != nil {
+		return nil, "", "", ImageConfig{}, err
+	}
+	c := newRegistryClient(ref, plainHTTP)
+	m, err := c.manifest(ref.reference)
+	if err != nil {
+		return nil, "", "", ImageConfig{}, fmt.Errorf("pull %s: %w", ref, err)
+	}
+	for _, layer := range m.Layers {
+		if strings.Contains(layer.MediaType, "foreign") || strings.Contains(layer.MediaType, "nondistributable") {
+			return nil, "", "", ImageConfig{}, fmt.Errorf("pull %s: unsupported layer type %s", ref, layer.MediaType)
+		}
+	}
+
+	var data []byte
+	err = c.fetchBlob(m.Config, func(r io.Reader) error {
+		data, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		return nil, "", "", ImageConfig{}, fmt.Errorf("pull %s: %w", ref, err)
+	}
+	config, err := parseImageConfig(data)
+	if err != nil {
+		return nil, "", "", ImageConfig{}, fmt.Errorf("pull %s: %w", ref, err)
+	}
+
+	tempDir, err := os.MkdirTemp("", "image-pull-")
+	if err != nil {
+		return nil, "", "", ImageConfig{}, fmt.Errorf("create temp dir: %w", err)
+	}
+	ix := newImageIndex(tempDir, cache)
+	diffIDs := layerDiffIDs(data, len(m.Layers))
+	if onProgress != nil {
+		onProgress(0, len(m.Layers))
+	}
+	for i, layer := range m.Layers {
+		diffID := ""
+		if diffIDs != nil {
+			diffID = diffIDs[i]
+		}
+		var err error
+		if !ix.cachedLayer(diffID, nil) {
+			var rec *layerRecord
+			err = c.fetchBlob(layer, func(r io.Reader) (err error) {
+				rec, err = ix.indexLayer(r, nil, diffID)
+				return err
+			})
+			// only a layer that matched its digest is worth remembering
+			if err == nil {
+				ix.cache.saveLayer(diffID, rec)
+			}
+		}
+		if err != nil {
+			os.RemoveAll(tempDir)
+			return nil, "", "", ImageConfig{}, fmt.Errorf("pull %s: %w", ref, err)
+		}
+		if onProgress != nil {
+			onProgress(i+1, len(m.Layers))
+		}
+	}
+	return ix.files(), configDigest(m.Config), tempDir, config, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_parseImageReference(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want imageReference
+	}{
+		{"python:3.10", imageReference{_dockerHub, "library/python", "3.10"}},
+		{"python", imageReference{_dockerHub, "library/python", "latest"}},
+		{"someone/tool:1", imageReference{_dockerHub, "someone/tool", "1"}},
+		{"registry.local:5000/team/ml:1.4", imageReference{"registry.local:5000", "team/ml", "1.4"}},
+		{"localhost/ml", imageReference{"localhost", "ml", "latest"}},
+		{"ghcr.io/org/img@sha256:abc", imageReference{"ghcr.io", "org/img", "sha256:abc"}},
+	} {
+		got, err := parseImageReference(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"", "Team/ML", "registry.local:5000/team/ml@"} {
+		if _, err := parseImageReference(in); err == nil {
+			t.Errorf("%q: want an error", in)
+		}
+	}
+}
+
+func Test_parseChallenge(t *testing.T) {
+	got := parseChallenge(`realm="https://auth.example/token",service="registry.example",scope="repository:team/ml:pull,push"`)
+	want := map[string]string{
+		"realm":   "https://auth.example/token",
+		"service": "registry.example",
+		"scope":   "repository:team/ml:pull,push",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// fakeRegistry is a stand-in for a registry:2 with token auth, serving one repository.
+type fakeRegistry struct {
+	*httptest.Server
+	blobs     map[string][]byte
+	manifests map[string][]byte // by tag and by digest
+}
+
+func newFakeRegistry(t *testing.T, repository string) *fakeRegistry {
+	r := &fakeRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		username, password, _ := req.BasicAuth()
+		if username != "ci" || password != "secret" || req.URL.Query().Get("scope") != "repository:"+repository+":pull" {
+			http.Error(w, "denied", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "good-token"})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer good-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, r.URL, repository))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path, ok := strings.CutPrefix(req.URL.Path, "/v2/"+repository+"/")
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if reference, ok := strings.CutPrefix(path, "manifests/"); ok {
+			data, ok := r.manifests[reference]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		if digest, ok := strings.CutPrefix(path, "blobs/"); ok {
+			data, ok := r.blobs[digest]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		http.NotFound(w, req)
+	})
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+// push stores data as a blob and returns its descriptor.
+func (r *fakeRegistry) push(mediaType string, data []byte) ociDescriptor {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.blobs[digest] = data
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+}
+
+// tag stores m under tag and its digest, and returns its digest.
+func (r *fakeRegistry) tag(t *testing.T, tag string, m any) string {
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	r.manifests[digest] = data
+	if tag != "" {
+		r.manifests[tag] = data
+	}
+	return digest
+}
+
+// layerTar returns a layer with files, gzipped with compress.
+func layerTar(t *testing.T, compress bool, files map[string]string) []byte {
+	var buf bytes.Buffer
+	var tw *tar.Writer
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(&buf)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(files[name]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gz != nil {
+		gz.Close()
+	}
+	return buf.Bytes()
+}
+
+func Test_pullImage(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SWAY_REGISTRY_USERNAME", "ci")
+	t.Setenv("SWAY_REGISTRY_PASSWORD", "secret")
+	registry := newFakeRegistry(t, "team/ml")
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	config := registry.push("application/vnd.oci.image.config.v1+json",
+		[]byte(`{"config":{"Env":["PATH=/usr/bin"],"WorkingDir":"/srv","Cmd":["python3"]}}`))
+	base := registry.push("application/vnd.oci.image.layer.v1.tar+gzip", layerTar(t, true, map[string]string{
+		"etc/":             "",
+		"etc/hello":        "hello",
+		"usr/":             "",
+		"usr/bin/":         "",
+		"usr/bin/python3":  "#!python",
+		"srv/":             "",
+		"srv/requirements": "numpy",
+	}))
+	top := registry.push("application/vnd.oci.image.layer.v1.tar", layerTar(t, false, map[string]string{
+		"etc/":          "",
+		"etc/.wh.hello": "",
+		"srv/":          "",
+		"srv/train.py":  "print(1)",
+	}))
+	amd64 := registry.tag(t, "", ociManifest{MediaType: _mediaTypeOCIManifest, Config: config, Layers: []ociDescriptor{base, top}})
+	arm64 := registry.tag(t, "", ociManifest{MediaType: _mediaTypeOCIManifest, Config: config})
+	index := ociManifest{MediaType: _mediaTypeOCIIndex}
+	for _, m := range []struct{ digest, arch string }{{arm64, "arm64"}, {amd64, "amd64"}} {
+		d := ociDescriptor{MediaType: _mediaTypeOCIManifest, Digest: m.digest}
+		d.Platform = &struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		}{"linux", m.arch}
+		index.Manifests = append(index.Manifests, d)
+	}
+	registry.tag(t, "1.4", index)
+	registry.tag(t, "single", ociManifest{MediaType: _mediaTypeOCIManifest, Config: config, Layers: []ociDescriptor{base}})
+
+	t.Run("an index resolves to linux/amd64, behind token auth", func(t *testing.T) {
+		var progress []string
+		files, digest, tempDir, imageConfig, err := pullImage(host+"/team/ml:1.4", false, nil, func(pulled, total int) {
+			progress = append(progress, fmt.Sprintf("%d/%d", pulled, total))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+
+		if want := strings.TrimPrefix(config.Digest, "sha256:")[:12]; digest != want {
+			t.Errorf("digest %q, want %q", digest, want)
+		}
+		if imageConfig.WorkingDir != "/srv" || len(imageConfig.Cmd) != 1 {
+			t.Errorf("config %+v", imageConfig)
+		}
+		if got := strings.Join(progress, " "); got != "0/2 1/2 2/2" {
+			t.Errorf("progress %q", got)
+		}
+
+		contents := map[string]string{}
+		for _, f := range files {
+			if f.IsDir {
+				continue
+			}
+			data, err := readContent(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[f.Key] = string(data)
+		}
+		want := map[string]string{
+			"app/usr/bin/python3":  "#!python",
+			"app/srv/requirements": "numpy",
+			"app/srv/train.py":     "print(1)",
+		}
+		if fmt.Sprint(contents) != fmt.Sprint(want) {
+			t.Errorf("files %v, want %v", contents, want)
+		}
+	})
+
+	t.Run("a plain manifest", func(t *testing.T) {
+		files, _, tempDir, _, err := pullImage(host+"/team/ml:single", false, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+		found := false
+		for _, f := range files {
+			found = found || f.Key == "app/etc/hello"
+		}
+		if !found {
+			t.Error("app/etc/hello missing")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, tc := range []struct{ name, ref, want string }{
+			{"unknown tag", host + "/team/ml:nope", "not found"},
+			{"unknown repository", host + "/team/other:1.4", "not found"},
+		} {
+			_, _, _, _, err := pullImage(tc.ref, false, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+			}
+		}
+
+		t.Setenv("SWAY_REGISTRY_PASSWORD", "wrong")
+		if _, _, _, _, err := pullImage(host+"/team/ml:1.4", false, nil, nil); err == nil || !strings.Contains(err.Error(), "registry token") {
+			t.Errorf("wrong password: got %v", err)
+		}
+		t.Setenv("SWAY_REGISTRY_PASSWORD", "secret")
+
+		registry.blobs[top.Digest] = []byte("tampered")
+		if _, _, _, _, err := pullImage(host+"/team/ml:1.4", false, nil, nil); err == nil || !strings.Contains(err.Error(), "content has digest") {
+			t.Errorf("tampered layer: got %v", err)
+		}
+	})
+}
+
+// readContent returns the content of f, wherever the index says it is.
+func readContent(f KeyValue) ([]byte, error) {
+	r, _, err := openContent(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -8,62 +8,176 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/briandowns/spinner"
 	"github.com/fatih/color"
 )
 
-func run(scriptPath, username string) error {
+// runOptions are the settings of `sway run` besides the script itself.
+type runOptions struct {
+	image      string
+	keepRootfs bool
+	args       []string // passed to the script after its path
+	env        []string // KEY=VAL
+	entrypoint []string // replaces /usr/bin/env python3 when set
+	resources  RunResources
+	detach     bool // start the run and return its ID without waiting for it
+}
+
+// parseEnv turns -e flags into KEY=VAL entries. A bare KEY takes its value from the
+// local environment, like docker run -e.
+func parseEnv(flags []string) ([]string, error) {
+	env := make([]string, 0, len(flags))
+	for _, f := range flags {
+		key, _, ok := strings.Cut(f, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid -e %q, want KEY=VAL", f)
+		}
+		if !ok {
+			f = key + "=" + os.Getenv(key)
+		}
+		env = append(env, f)
+	}
+	return env, nil
+}
+
+var _byteUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseBytes parses sizes like 512M or 8G, in powers of 1024 like docker run --memory.
+// KB, KiB and K are all the same. The worker and sway each have a copy; both are
+// tested against testdata/sizes.json, so sway refuses what the worker would.
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	number, unit := s[:i], s[i:]
+	if strings.HasSuffix(unit, "IB") {
+		unit = strings.TrimSuffix(unit, "IB")
+	} else if len(unit) > 1 {
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	multiplier, ok := _byteUnits[unit]
+	n, err := strconv.ParseFloat(number, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q, want e.g. 512M or 8G", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// describeResources lists the limits res asks for, or "" if it takes the defaults.
+func describeResources(res RunResources) string {
+	var parts []string
+	if res.Memory > 0 {
+		parts = append(parts, fmt.Sprintf("%.1fG memory", float64(res.Memory)/(1<<30)))
+	}
+	if res.CPUs > 0 {
+		parts = append(parts, fmt.Sprintf("%g CPUs", res.CPUs))
+	}
+	if res.Pids > 0 {
+		parts = append(parts, fmt.Sprintf("%d pids", res.Pids))
+	}
+	if res.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("%s timeout", res.Timeout))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// run runs scriptPath in the cloud container. With no script, the image's own
+// command runs instead.
+func run(scriptPath, username string, opts runOptions) error {
 	green := color.New(color.FgGreen).SprintFunc()
 	red := color.New(color.FgRed).SprintFunc()
 
-	stat, err := os.Stat(scriptPath)
-	if err != nil {
-		fmt.Printf("%s File not found: %s\n", red("✗"), scriptPath)
-		return fmt.Errorf("file not found %s", scriptPath)
+	var stat os.FileInfo
+	if scriptPath != "" {
+		var err error
+		stat, err = os.Stat(scriptPath)
+		if err != nil {
+			fmt.Printf("%s File not found: %s\n", red("✗"), scriptPath)
+			return fmt.Errorf("file not found %s", scriptPath)
+		}
+		if stat.IsDir() {
+			fmt.Printf("%s Path is a directory: %s\n", red("✗"), scriptPath)
+			return fmt.Errorf("this is a directory %s", scriptPath)
+		}
 	}
-	if stat.IsDir() {
-		fmt.Printf("%s Path is a directory: %s\n", red("✗"), scriptPath)
-		return fmt.Errorf("this is a directory %s", scriptPath)
+
+	ref, err := resolveImage(fileServerURL, opts.image)
+	if err != nil {
+		fmt.Printf("%s %v\n", red("✗"), err)
+		return err
 	}
 
-	scriptName := path.Base(scriptPath)
+	scriptName := "image command"
+	if scriptPath != "" {
+		scriptName = path.Base(scriptPath)
+	}
 	fmt.Printf("%s Initialized. Running %s as %s\n", green("✓"), scriptName, username)
 
 	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
-	s.Suffix = " Uploading script to fileserver..."
+	s.Suffix = " Syncing project directory with fileserver..."
 	s.Start()
-
-	file, err := os.ReadFile(scriptPath)
+	cwd, err := os.Getwd()
 	if err != nil {
 		s.Stop()
-		fmt.Printf("%s Could not read file\n", red("✗"))
-		return fmt.Errorf("could not read file")
+		return fmt.Errorf("could not get working directory: %w", err)
 	}
-	withUsername := fmt.Sprintf("%s_app.py", username)
-	keyval := KeyValue{
-		Key:     fmt.Sprintf("%s/%s", _appDir, withUsername),
-		Value:   file,
-		Name:    withUsername,
-		Parent:  _appDir,
-		Size:    stat.Size(),
-		Mode:    int64(stat.Mode().Perm()),
-		ModTime: stat.ModTime().Unix(),
+	scriptRel := ""
+	if scriptPath != "" {
+		scriptRel, err = projectPath(cwd, scriptPath)
+		if err != nil {
+			s.Stop()
+			fmt.Printf("%s %v\n", red("✗"), err)
+			return err
+		}
 	}
-	sendFileBatch([]KeyValue{keyval}, fileServerURL)
-
+	project, err := uploadProject(fileServerURL, username, cwd)
 	s.Stop()
-	fmt.Printf("%s Uploaded script to fileserver\n", green("✓"))
+	if err != nil {
+		fmt.Printf("%s Could not upload project: %v\n", red("✗"), err)
+		return err
+	}
+	fmt.Printf("%s Synced project directory\n", green("✓"))
+	imageLabel := ref
+	if imageLabel == "" {
+		imageLabel = "default"
+	}
 	fmt.Printf("├── 📦 Script: %s\n", scriptName)
+	fmt.Printf("├── 🖼  Image: %s\n", imageLabel)
+	if limits := describeResources(opts.resources); limits != "" {
+		fmt.Printf("├── ⚙️  Limits: %s\n", limits)
+	}
+	if project != "" {
+		fmt.Printf("├── 📁 Project: %s\n", project)
+	}
 	fmt.Printf("└── 👤 User: %s\n", username)
 
 	s.Suffix = " Running in cloud container..."
 	s.Start()
 
 	runRequest := RunRequest{
-		FileName: withUsername,
-		Username: username,
+		FileName:   scriptRel,
+		Project:    project,
+		Username:   username,
+		Image:      ref,
+		KeepRootfs: opts.keepRootfs,
+		Args:       opts.args,
+		Env:        opts.env,
+		Entrypoint: opts.entrypoint,
+		Resources:  opts.resources,
 	}
 	marshalled, err := json.Marshal(runRequest)
 	if err != nil {
@@ -71,14 +185,19 @@ func run(scriptPath, username string) error {
 		return err
 	}
 
+	if opts.detach {
+		return submitRun(marshalled, s)
+	}
+
 	request, err := http.NewRequest("POST", workerURL+"/run", bytes.NewBuffer(marshalled))
 	if err != nil {
 		s.Stop()
 		return err
 	}
+	// ask the worker to stream output as it is produced
+	request.Header.Set("Accept", "application/x-ndjson")
 
-	response := RunResponse{}
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := workerClient().Do(request)
 	if err != nil {
 		s.Stop()
 		fmt.Printf("%s Failed to connect to container service\n", red("✗"))
@@ -86,44 +205,148 @@ func run(scriptPath, username string) error {
 	}
 	defer resp.Body.Close()
 
-	bodybytes, err := io.ReadAll(resp.Body)
-	if err != nil {
+	if resp.StatusCode != http.StatusOK {
 		s.Stop()
+		fmt.Printf("%s Worker rejected the run (status %d)\n", red("✗"), resp.StatusCode)
+		return workerError(resp)
+	}
+
+	final, err := printRunEvents(resp.Body, s)
+	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(bodybytes, &response); err != nil {
-		s.Stop()
-		return fmt.Errorf("invalid response from worker: %w\nbody: %s", err, string(bodybytes))
+	if final.UpperDir != "" {
+		fmt.Printf("\n%s Files written by the run were kept on the worker at %s\n", green("✓"), final.UpperDir)
 	}
 
-	s.Stop()
-
-	if response.Error != "" || response.ExitCode != 0 {
-		fmt.Printf("%s Container execution failed (exit code %d)\n", red("✗"), response.ExitCode)
-		if response.RunId > 0 {
-			fmt.Printf("  View failed run at %s/run/%d\n", workerURL, response.RunId)
-		}
-		if response.Stdout != "" {
-			fmt.Printf("\n%s\n", response.Stdout)
+	if final.Error != "" || final.ExitCode != 0 {
+		fmt.Printf("\n%s Container execution failed (exit code %d)\n", red("✗"), final.ExitCode)
+		if final.Error != "" {
+			fmt.Printf("  %s\n", final.Error)
 		}
-		if response.Stderr != "" {
-			fmt.Printf("\n%s\n", response.Stderr)
+		if final.RunId > 0 {
+			fmt.Printf("  View failed run at %s/run/%d\n", workerURL, final.RunId)
 		}
-		return fmt.Errorf("script execution failed with exit code %d", response.ExitCode)
+		return fmt.Errorf("script execution failed with exit code %d", final.ExitCode)
 	}
 
-	fmt.Printf("%s Container execution complete\n", green("✓"))
+	fmt.Printf("\n%s Container execution complete\n", green("✓"))
 
-	if response.Stdout != "" {
-		fmt.Printf("\n%s\n", response.Stdout)
+	if final.RunId > 0 {
+		fmt.Printf("\nView run at %s/run/%d\n", workerURL, final.RunId)
 	}
-	if response.Stderr != "" {
-		fmt.Printf("\n%s\n", response.Stderr)
+
+	return nil
+}
+
+// submitRun starts a run without waiting for it and prints its ID.
+func submitRun(marshalled []byte, s *spinner.Spinner) error {
+	green := color.New(color.FgGreen).SprintFunc()
+	red := color.New(color.FgRed).SprintFunc()
+
+	resp, err := workerClient().Post(workerURL+"/runs", "application/json", bytes.NewBuffer(marshalled))
+	s.Stop()
+	if err != nil {
+		fmt.Printf("%s Failed to connect to container service\n", red("✗"))
+		return err
 	}
+	defer resp.Body.Close()
 
-	if response.RunId > 0 {
-		fmt.Printf("\nView run at %s/run/%d\n", workerURL, response.RunId)
+	if resp.StatusCode != http.StatusAccepted {
+		fmt.Printf("%s Worker rejected the run (status %d)\n", red("✗"), resp.StatusCode)
+		return workerError(resp)
+	}
+	var started RunStatus
+	if err := json.NewDecoder(resp.Body).Decode(&started); err != nil {
+		return fmt.Errorf("invalid response from worker: %w", err)
 	}
 
+	if started.QueuePosition > 0 {
+		fmt.Printf("\n%s Queued run %d (position %d)\n", green("✓"), started.RunId, started.QueuePosition)
+	} else {
+		fmt.Printf("\n%s Started run %d\n", green("✓"), started.RunId)
+	}
+	fmt.Printf("  Follow it with: sway logs -f %d\n", started.RunId)
+	fmt.Printf("  Check on it with: sway status %d\n", started.RunId)
+	fmt.Printf("  Stop it with: sway cancel %d\n", started.RunId)
 	return nil
 }
+
+// printRunEvents copies streamed container output to stdout/stderr as it arrives and
+// returns the final event. The spinner, if any, is stopped as soon as the first output
+// shows up.
+func printRunEvents(body io.Reader, s *spinner.Spinner) (RunEvent, error) {
+	stop := func() {
+		if s != nil {
+			s.Stop()
+		}
+	}
+	setStatus := func(suffix string) {
+		if s == nil {
+			fmt.Fprintln(os.Stderr, strings.TrimSuffix(strings.TrimSpace(suffix), "..."))
+			return
+		}
+		s.Lock()
+		s.Suffix = suffix
+		s.Unlock()
+	}
+	dec := json.NewDecoder(body)
+	started := false
+	runID := 0
+	for {
+		var ev RunEvent
+		if err := dec.Decode(&ev); err != nil {
+			stop()
+			if err == io.EOF {
+				if runID > 0 {
+					// the run goes on without us
+					return RunEvent{}, fmt.Errorf("connection to worker closed before the run finished; follow it with: sway logs -f %d", runID)
+				}
+				return RunEvent{}, fmt.Errorf("connection to worker closed before the run finished")
+			}
+			return RunEvent{}, fmt.Errorf("invalid response from worker: %w", err)
+		}
+		if ev.Done {
+			stop()
+			return ev, nil
+		}
+		// the worker names the run before any output, and says where it is in the queue
+		// until it starts
+		if ev.Stream == "" {
+			if ev.RunId > 0 {
+				runID = ev.RunId
+			}
+			switch ev.Status {
+			case "queued":
+				setStatus(fmt.Sprintf(" Waiting for a free container slot (position %d in queue)...", ev.QueuePosition))
+			case "running":
+				setStatus(" Running in cloud container...")
+			}
+			continue
+		}
+		if !started {
+			stop()
+			fmt.Println()
+			started = true
+		}
+		if ev.Stream == "stderr" {
+			fmt.Fprint(os.Stderr, ev.Data)
+		} else {
+			fmt.Print(ev.Data)
+		}
+	}
+}
+
+// projectPath returns the path of scriptPath inside the project directory dir, with
+// slashes.
+func projectPath(dir, scriptPath string) (string, error) {
+	abs, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the current directory, which is uploaded as the project", scriptPath)
+	}
+	return filepath.ToSlash(rel), nil
+}
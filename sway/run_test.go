@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// Test_parseBytes reads its cases from the repository's testdata, which the worker's
+// copy of parseBytes is tested against too, so sway accepts exactly the sizes the
+// worker does.
+func Test_parseBytes(t *testing.T) {
+	data, err := os.ReadFile("../testdata/sizes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases struct {
+		Valid   map[string]int64
+		Invalid []string
+	}
+	if err := json.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+	if len(cases.Valid) == 0 {
+		t.Fatal("no cases")
+	}
+
+	for in, want := range cases.Valid {
+		if got, err := parseBytes(in); err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range cases.Invalid {
+		if _, err := parseBytes(in); err == nil {
+			t.Errorf("parseBytes(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// runURL is the worker's URL for run id, checking that id is a run ID.
+func runURL(id string) (string, error) {
+	if n, err := strconv.Atoi(id); err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid run ID %q, want the number sway run printed", id)
+	}
+	return workerURL + "/runs/" + id, nil
+}
+
+// workerError turns a response the worker answered with an error into one.
+func workerError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	bodybytes, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("worker error (status %d): %s", resp.StatusCode, strings.TrimSpace(string(bodybytes)))
+}
+
+// logs prints the output of run id so far, or with follow everything until the run is
+// done.
+func logs(id string, follow bool) error {
+	url, err := runURL(id)
+	if err != nil {
+		return err
+	}
+	if !follow {
+		resp, err := workerClient().Get(url + "/logs")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return workerError(resp)
+		}
+		var out RunLogs
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return fmt.Errorf("invalid response from worker: %w", err)
+		}
+		fmt.Print(out.Stdout)
+		fmt.Fprint(os.Stderr, out.Stderr)
+		return nil
+	}
+
+	request, err := http.NewRequest("GET", url+"/logs?follow=true", nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/x-ndjson")
+	resp, err := workerClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return workerError(resp)
+	}
+
+	final, err := printRunEvents(resp.Body, nil)
+	if err != nil {
+		return err
+	}
+	if final.Error != "" {
+		return fmt.Errorf("run %s failed: %s", id, final.Error)
+	}
+	if final.ExitCode != 0 {
+		return fmt.Errorf("run %s failed with exit code %d", id, final.ExitCode)
+	}
+	return nil
+}
+
+// status prints whether run id is still queued or running and how it ended.
+func status(id string) error {
+	url, err := runURL(id)
+	if err != nil {
+		return err
+	}
+	resp, err := workerClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return workerError(resp)
+	}
+	var st RunStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return fmt.Errorf("invalid response from worker: %w", err)
+	}
+
+	bold := color.New(color.Bold).SprintFunc()
+	fmt.Printf("Run %d: %s\n", st.RunId, bold(st.Status))
+	if st.QueuePosition > 0 {
+		fmt.Printf("├── ⏳ Queue position: %d\n", st.QueuePosition)
+	}
+	fmt.Printf("├── 📦 Script: %s\n", st.Filename)
+	started := "Started"
+	if st.Status == "queued" {
+		started = "Queued"
+	}
+	fmt.Printf("├── 🕒 %s: %s\n", started, st.StartedAt.Local().Format(time.DateTime))
+	fmt.Printf("├── ⏱  Duration: %s\n", (time.Duration(st.DurationMs) * time.Millisecond).Round(100*time.Millisecond))
+	if st.Error != "" {
+		fmt.Printf("├── ⚠️  Error: %s\n", st.Error)
+	}
+	fmt.Printf("└── Exit code: %d\n", st.ExitCode)
+	return nil
+}
+
+// cancel stops run id.
+func cancel(id string) error {
+	green := color.New(color.FgGreen).SprintFunc()
+
+	url, err := runURL(id)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := workerClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("run %s already finished", id)
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return workerError(resp)
+	}
+	fmt.Printf("%s Cancelled run %s\n", green("✓"), id)
+	return nil
+}
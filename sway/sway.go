@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
@@ -11,7 +12,7 @@ import (
 )
 
 var fileServerURL = getEnv("FILESERVER_URL", "https://46.101.149.241:8443")
-var workerURL = getEnv("WORKER_URL", "http://167.71.54.99:8444")
+var workerURL = getEnv("WORKER_URL", "https://167.71.54.99:8444")
 
 const _appDir = "app"
 
@@ -22,28 +23,77 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-type RunResponse struct {
-	RunId    int    `json:"run_id"`
-	Stdout   string `json:"stdout"`
-	Stderr   string `json:"stderr"`
-	ExitCode int    `json:"exit_code"`
-	Error    string `json:"error,omitempty"`
+// RunEvent is one line of the worker's streamed response to /run. Output events carry
+// Stream and Data; the final event has Done set. The others name the run or carry a
+// change of Status.
+type RunEvent struct {
+	Stream        string `json:"stream,omitempty"` // "stdout" or "stderr"
+	Data          string `json:"data,omitempty"`
+	Status        string `json:"status,omitempty"`         // "queued" or "running"
+	QueuePosition int    `json:"queue_position,omitempty"` // with Status queued, from 1
+	Done          bool   `json:"done,omitempty"`
+	ExitCode      int    `json:"exit_code"`
+	RunId         int    `json:"run_id,omitempty"`
+	Error         string `json:"error,omitempty"`
+	UpperDir      string `json:"upper_dir,omitempty"` // where the writable layer was kept, with KeepRootfs
+}
+
+// RunStatus is the worker's answer to POST /runs, GET /runs/{id} and DELETE /runs/{id}.
+type RunStatus struct {
+	RunId         int       `json:"run_id"`
+	Status        string    `json:"status"` // queued, running, succeeded, failed or cancelled
+	QueuePosition int       `json:"queue_position,omitempty"`
+	Filename      string    `json:"filename"`
+	StartedAt     time.Time `json:"started_at"`
+	DurationMs    int64     `json:"duration_ms"`
+	ExitCode      int       `json:"exit_code"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// RunLogs is the worker's answer to GET /runs/{id}/logs.
+type RunLogs struct {
+	RunId  int    `json:"run_id"`
+	Status string `json:"status"`
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
 }
 
 type RunRequest struct {
-	FileName string
-	Username string
+	FileName   string // with Project, the script's path inside the project
+	Project    string // image holding the project directory, mounted at the working directory
+	Username   string
+	Image      string   // name@digest reference; empty runs against the default image
+	KeepRootfs bool     // keep the run's writable layer on the worker instead of deleting it
+	Args       []string // passed to the script after its path
+	Env        []string // KEY=VAL, added to the default environment
+	Entrypoint []string // runs the script instead of /usr/bin/env python3
+	Resources  RunResources
+}
+
+// RunResources are the limits a run asks for. Zero fields take the worker's defaults.
+type RunResources struct {
+	Memory  int64         // bytes
+	CPUs    float64       // cores, may be fractional
+	Pids    int64         // processes and threads
+	Timeout time.Duration // wall clock, from when the container starts
 }
 
 func main() {
 	app := &cli.App{
 		Name:  "sway",
 		Usage: "run a container in the cloud",
+		// -e values may contain commas
+		DisableSliceFlagSeparator: true,
 		Action: func(*cli.Context) error {
-			fmt.Println("sway - run containers in the cloud\n")
+			fmt.Print("sway - run containers in the cloud\n\n")
 			fmt.Println("Commands:")
 			fmt.Println("  export    Build and upload container image to fileserver")
 			fmt.Println("  run       Execute a script in the cloud container")
+			fmt.Println("  logs      Show the output of a run")
+			fmt.Println("  status    Show whether a run is still queued or running and how it ended")
+			fmt.Println("  cancel    Stop a queued or running run")
+			fmt.Println("  login     Save the API token to use the servers with")
+			fmt.Println("  tls       Trust the fileserver's certificate, or make one for a private deployment")
 			return nil
 		},
 	}
@@ -57,10 +107,29 @@ func main() {
 					Aliases: []string{"v"},
 					Usage:   "enable verbose logging",
 				},
+				&cli.StringFlag{
+					Name:  "image",
+					Usage: "pull this image from its registry instead of building the Dockerfile, e.g. registry.local:5000/team/ml:1.4",
+				},
+				&cli.BoolFlag{
+					Name:  "plain-http",
+					Usage: "talk to the registry over HTTP instead of HTTPS",
+				},
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "export a docker image save tarball or an OCI image layout directory instead of building the Dockerfile",
+				},
 			},
 			Action: func(ctx *cli.Context) error {
+				if ctx.IsSet("image") && ctx.IsSet("from") {
+					return fmt.Errorf("use either --image or --from")
+				}
 				start := time.Now()
-				err := export(ctx.Bool("verbose"))
+				err := export(ctx.Bool("verbose"), exportOptions{
+					image:     ctx.String("image"),
+					plainHTTP: ctx.Bool("plain-http"),
+					from:      ctx.String("from"),
+				})
 				if err != nil {
 					return err
 				}
@@ -73,21 +142,81 @@ func main() {
 		},
 		{
 			Name: "run",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "image",
+					Usage: "image to run against, as name or name@digest (default: the image exported from this directory)",
+				},
+				&cli.BoolFlag{
+					Name:  "keep-rootfs",
+					Usage: "keep the files the run wrote on the worker instead of deleting them",
+				},
+				&cli.StringSliceFlag{
+					Name:    "env",
+					Aliases: []string{"e"},
+					Usage:   "set an environment variable in the container, as KEY=VAL or KEY to pass on the local value",
+				},
+				&cli.StringFlag{
+					Name:  "entrypoint",
+					Usage: "command that runs the script, e.g. \"bash\" (default: /usr/bin/env python3), or that replaces the image's ENTRYPOINT with no script",
+				},
+				&cli.StringFlag{
+					Name:  "memory",
+					Usage: "memory limit, e.g. 512M or 8G (default: the worker's, 1G)",
+				},
+				&cli.Float64Flag{
+					Name:  "cpus",
+					Usage: "number of CPUs, may be fractional (default: the worker's, 1)",
+				},
+				&cli.Int64Flag{
+					Name:  "pids",
+					Usage: "maximum number of processes and threads (default: the worker's, 128)",
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "stop the run after this long, e.g. 90s or 2h (default: the worker's, 30m)",
+				},
+				&cli.BoolFlag{
+					Name:    "detach",
+					Aliases: []string{"d"},
+					Usage:   "start the run and print its ID instead of waiting for it",
+				},
+			},
+			Usage:     "run a script, or the image's own command if no script is given",
+			ArgsUsage: "[SCRIPT [ARGS...]]",
 			Action: func(ctx *cli.Context) error {
-				username := os.Getenv("SWAY_USERNAME")
-				if username == "" {
-					return fmt.Errorf("SWAY_USERNAME not set. Run:\n\n  export SWAY_USERNAME=yourname\n")
-				}
-				if ctx.Args().Len() < 1 {
-					return fmt.Errorf("no script given")
+				username, err := currentUser()
+				if err != nil {
+					return err
 				}
-
 				start := time.Now()
 				scriptPath := ctx.Args().First()
-				err := run(scriptPath, username)
+				env, err := parseEnv(ctx.StringSlice("env"))
 				if err != nil {
 					return err
 				}
+				resources := RunResources{
+					CPUs:    ctx.Float64("cpus"),
+					Pids:    ctx.Int64("pids"),
+					Timeout: ctx.Duration("timeout"),
+				}
+				if ctx.IsSet("memory") {
+					if resources.Memory, err = parseBytes(ctx.String("memory")); err != nil {
+						return fmt.Errorf("--memory: %w", err)
+					}
+				}
+				err = run(scriptPath, username, runOptions{
+					image:      ctx.String("image"),
+					keepRootfs: ctx.Bool("keep-rootfs"),
+					args:       ctx.Args().Tail(),
+					env:        env,
+					entrypoint: strings.Fields(ctx.String("entrypoint")),
+					resources:  resources,
+					detach:     ctx.Bool("detach"),
+				})
+				if err != nil || ctx.Bool("detach") {
+					return err
+				}
 
 				bold := color.New(color.Bold).SprintFunc()
 				green := color.New(color.FgGreen).SprintFunc()
@@ -97,6 +226,94 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:      "logs",
+			Usage:     "show the output of a run",
+			ArgsUsage: "RUN_ID",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:    "follow",
+					Aliases: []string{"f"},
+					Usage:   "keep printing output until the run is done",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				return logs(ctx.Args().First(), ctx.Bool("follow"))
+			},
+		},
+		{
+			Name:      "status",
+			Usage:     "show whether a run is still queued or running and how it ended",
+			ArgsUsage: "RUN_ID",
+			Action: func(ctx *cli.Context) error {
+				return status(ctx.Args().First())
+			},
+		},
+		{
+			Name:      "cancel",
+			Usage:     "stop a queued or running run",
+			ArgsUsage: "RUN_ID",
+			Action: func(ctx *cli.Context) error {
+				return cancel(ctx.Args().First())
+			},
+		},
+		{
+			Name:      "login",
+			Usage:     "save the API token to use the servers with",
+			ArgsUsage: "TOKEN",
+			Action: func(ctx *cli.Context) error {
+				return login(ctx.Args().First())
+			},
+		},
+		{
+			Name:  "tls",
+			Usage: "trust the fileserver's and the worker's certificates, or make them for a private deployment",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "init",
+					Usage: "make a CA and fileserver and worker certificates signed by it, and trust the CA",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{
+							Name:  "host",
+							Usage: "DNS name or IP address the fileserver is reached at (default: the host of FILESERVER_URL)",
+						},
+						&cli.StringSliceFlag{
+							Name:  "worker-host",
+							Usage: "DNS name or IP address the worker is reached at (default: the host of WORKER_URL)",
+						},
+						&cli.StringFlag{
+							Name:  "dir",
+							Value: "sway-tls",
+							Usage: "directory to write ca.crt, ca.key, server.crt, server.key, worker.crt and worker.key to",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						return tlsInit(ctx.String("dir"), ctx.StringSlice("host"), ctx.StringSlice("worker-host"))
+					},
+				},
+				{
+					Name:  "trust",
+					Usage: "trust the fileserver's and the worker's certificates by their CA or their fingerprints",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "ca",
+							Usage: "PEM bundle of CAs the fileserver's and the worker's certificates must chain to",
+						},
+						&cli.StringFlag{
+							Name:  "fingerprint",
+							Usage: "SHA-256 of the fileserver's certificate, as it logs at startup",
+						},
+						&cli.StringFlag{
+							Name:  "worker-fingerprint",
+							Usage: "SHA-256 of the worker's certificate, as it logs at startup",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						return trust(ctx.String("ca"), ctx.String("fingerprint"), ctx.String("worker-fingerprint"))
+					},
+				},
+			},
+		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
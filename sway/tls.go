@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// parseFingerprint accepts a certificate's SHA-256 in hex, with or without colons and
+// a "sha256:" prefix, as the fileserver logs it at startup.
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	sum, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %q, want the SHA-256 of the certificate in hex", s)
+	}
+	return sum, nil
+}
+
+// clientTLSConfig trusts certificates that chain to the CAs in caFile, and with a
+// fingerprint only the certificate that has it. With only a fingerprint the chain
+// isn't checked, which is what makes pinning a self-signed certificate work.
+func clientTLSConfig(caFile, fingerprint string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if fingerprint == "" {
+		return config, nil
+	}
+
+	pin, err := parseFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if caFile == "" {
+		// the pin replaces the chain, so skip Go's check, which would reject a
+		// self-signed certificate, and do it in VerifyConnection instead
+		config.InsecureSkipVerify = true
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("server certificate sha256:%x doesn't match the pinned fingerprint", sum)
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// _untrustedHint says what to do when the fileserver's or the worker's certificate
+// isn't trusted.
+const _untrustedHint = "Trust the CA that signed it with:\n\n  sway tls trust --ca <ca.crt>\n\nor pin the certificate with the fingerprint the fileserver or worker logs at startup:\n\n  sway tls trust --fingerprint <sha256>\n  sway tls trust --worker-fingerprint <sha256>\n"
+
+// trust makes the fileserver's certificate trusted by the CAs in caFile or by its
+// fingerprint from now on, and the worker's by the same CAs or by workerFingerprint.
+func trust(caFile, fingerprint, workerFingerprint string) error {
+	if caFile == "" && fingerprint == "" && workerFingerprint == "" {
+		return fmt.Errorf("usage: sway tls trust --ca <file> | --fingerprint <sha256> | --worker-fingerprint <sha256>")
+	}
+	if caFile != "" {
+		abs, err := filepath.Abs(caFile)
+		if err != nil {
+			return err
+		}
+		caFile = abs
+	}
+	if _, err := clientTLSConfig(caFile, fingerprint); err != nil {
+		return err
+	}
+	if _, err := clientTLSConfig("", workerFingerprint); err != nil {
+		return err
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if caFile != "" || fingerprint != "" {
+		config.CACert = caFile
+		config.Fingerprint = fingerprint
+	}
+	if workerFingerprint != "" {
+		config.WorkerFingerprint = workerFingerprint
+	}
+	path, err := saveConfig(config)
+	if err != nil {
+		return err
+	}
+	green := color.New(color.FgGreen).SprintFunc()
+	fmt.Printf("%s Saved to %s\n", green("✓"), path)
+	return nil
+}
+
+// hostOf is the host of serverURL, for a certificate of the server behind it. what
+// says where serverURL came from.
+func hostOf(serverURL, what string) ([]string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("%s %q has no host", what, serverURL)
+	}
+	return []string{u.Hostname()}, nil
+}
+
+// tlsInit makes a CA and certificates it signs for the fileserver at hosts and the
+// worker at workerHosts, writes them to dir and trusts the CA. For private
+// deployments without public certificates.
+func tlsInit(dir string, hosts, workerHosts []string) error {
+	var err error
+	if len(hosts) == 0 {
+		if hosts, err = hostOf(fileServerURL, "no --host given and FILESERVER_URL"); err != nil {
+			return err
+		}
+	}
+	if len(workerHosts) == 0 {
+		if workerHosts, err = hostOf(workerURL, "no --worker-host given and WORKER_URL"); err != nil {
+			return err
+		}
+	}
+	caPath := filepath.Join(dir, "ca.crt")
+	if _, err := os.Stat(caPath); !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s already exists, remove it or pick another --dir", caPath)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "sway CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return err
+	}
+	serverDER, serverKeyDER, err := issueServerCert(caTemplate, caKey, big.NewInt(now.UnixNano()+1), hosts)
+	if err != nil {
+		return err
+	}
+	workerDER, workerKeyDER, err := issueServerCert(caTemplate, caKey, big.NewInt(now.UnixNano()+2), workerHosts)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name, block string
+		der         []byte
+		mode        os.FileMode
+	}{
+		{"ca.crt", "CERTIFICATE", caDER, 0644},
+		{"ca.key", "EC PRIVATE KEY", caKeyDER, 0600},
+		{"server.crt", "CERTIFICATE", serverDER, 0644},
+		{"server.key", "EC PRIVATE KEY", serverKeyDER, 0600},
+		{"worker.crt", "CERTIFICATE", workerDER, 0644},
+		{"worker.key", "EC PRIVATE KEY", workerKeyDER, 0600},
+	} {
+		data := pem.EncodeToMemory(&pem.Block{Type: f.block, Bytes: f.der})
+		if err := os.WriteFile(filepath.Join(dir, f.name), data, f.mode); err != nil {
+			return err
+		}
+	}
+
+	if err := trust(caPath, "", ""); err != nil {
+		return err
+	}
+	bold := color.New(color.Bold).SprintFunc()
+	fmt.Printf("\nMade a CA and certificates for the fileserver at %s and the worker at %s in %s. Next:\n\n",
+		strings.Join(hosts, ", "), strings.Join(workerHosts, ", "), dir)
+	fmt.Printf("  %s copy server.crt and server.key to the fileserver and start it with\n", bold("1."))
+	fmt.Printf("       fileserver -cert server.crt -key server.key\n")
+	fmt.Printf("  %s copy ca.crt, worker.crt and worker.key to the worker and start it with\n", bold("2."))
+	fmt.Printf("       -ca ca.crt -cert worker.crt -key worker.key\n")
+	fmt.Printf("  %s give ca.crt to the other users, who run sway tls trust --ca ca.crt\n", bold("3."))
+	fmt.Printf("\nKeep ca.key offline; it is only needed to make new certificates.\n")
+	return nil
+}
+
+// issueServerCert makes a key and a certificate for a server reached at hosts, signed
+// by the CA, and returns both in DER.
+func issueServerCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial *big.Int, hosts []string) (cert, key []byte, err error) {
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    ca.NotBefore,
+		NotAfter:     ca.NotBefore.AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if cert, err = x509.CreateCertificate(rand.Reader, template, ca, &serverKey.PublicKey, caKey); err != nil {
+		return nil, nil, err
+	}
+	if key, err = x509.MarshalECPrivateKey(serverKey); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
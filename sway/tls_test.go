@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func Test_tlsInit(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_CA_CERT", "")
+	t.Setenv("SWAY_FINGERPRINT", "")
+	t.Setenv("SWAY_WORKER_FINGERPRINT", "")
+	t.Setenv("SWAY_TOKEN", "")
+	dir := filepath.Join(t.TempDir(), "tls")
+	if err := tlsInit(dir, []string{"127.0.0.1"}, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	// serve starts a server with the certificate in dir named name
+	serve := func(name string) *httptest.Server {
+		cert, err := tls.LoadX509KeyPair(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	for name, client := range map[string]*http.Client{"server": fileserverClient(), "worker": workerClient()} {
+		resp, err := client.Get(serve(name).URL)
+		if err != nil {
+			t.Errorf("%s certificate isn't trusted: %v", name, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+
+	// a worker certificate nothing trusts is turned down
+	t.Setenv("SWAY_WORKER_FINGERPRINT", "sha256:"+fmt.Sprintf("%064x", 0))
+	if _, err := workerClient().Get(serve("worker").URL); err == nil {
+		t.Error("a worker certificate that doesn't match the pinned fingerprint was trusted")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads are split into batches of about _batchBytes of content, or _batchFiles
+// files when they are small, and _uploadWorkers batches are sent at once. A request
+// that fails for a reason that may pass is tried _uploadAttempts times, waiting
+// _retryDelay before the first retry and twice as long before each next one.
+const (
+	_batchBytes     = 32 << 20
+	_batchFiles     = 500
+	_uploadWorkers  = 4
+	_uploadAttempts = 5
+	_retryDelay     = 500 * time.Millisecond
+)
+
+// statusError is a request the fileserver answered with an error status.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.body)
+}
+
+// retryable says whether a failed request may succeed if tried again: the connection
+// broke, or the server was overloaded or had an internal error.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	var pe *fs.PathError
+	return !errors.As(err, &pe) && !errors.Is(err, errUnauthorized) && !errors.Is(err, context.Canceled)
+}
+
+// withRetry calls fn until it succeeds, fails for good or _uploadAttempts are used up,
+// backing off exponentially between attempts.
+func withRetry(ctx context.Context, what string, fn func() error) error {
+	delay := _retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt == _uploadAttempts || !retryable(err) {
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		wait := delay + time.Duration(rand.Int63n(int64(delay/2)))
+		logf("%s failed, retrying in %s: %v\n", what, wait.Round(time.Millisecond), err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", what, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// batchFiles splits files into upload batches by the size of their content.
+func batchFiles(files []KeyValue) [][]KeyValue {
+	var batches [][]KeyValue
+	var batch []KeyValue
+	var size int64
+	for _, f := range files {
+		batch = append(batch, f)
+		if f.LocalPath != "" && !f.IsDir {
+			size += f.Size
+		}
+		if size >= _batchBytes || len(batch) >= _batchFiles {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// uploadFiles uploads files into the image ref, several batches at a time, calling
+// onProgress after each batch. Every batch the server accepts is recorded in the
+// checkpoint of ref, so a rerun after a failure picks up where this one stopped.
+func uploadFiles(files []KeyValue, serverURL, ref string, onProgress ProgressFunc) error {
+	client := fileserverClient()
+	checkpoint, err := openCheckpoint(serverURL, ref)
+	if err != nil {
+		log.Printf("Warning: uploads can't be resumed: %v", err)
+	}
+	defer checkpoint.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := batchFiles(files)
+	work := make(chan []KeyValue)
+	var mu sync.Mutex
+	var firstErr error
+	sent := 0
+	if onProgress != nil {
+		onProgress(0, len(files))
+	}
+
+	var wg sync.WaitGroup
+	for range min(_uploadWorkers, len(batches)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range work {
+				err := sendFileBatch(ctx, client, batch, serverURL, ref)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				if err == nil {
+					checkpoint.add(batch)
+					sent += len(batch)
+					if onProgress != nil {
+						onProgress(sent, len(files))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, batch := range batches {
+		select {
+		case work <- batch:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// sendFileBatch uploads files into image ref. An empty ref is the default image.
+// The content of every file with a LocalPath is streamed to /blobs/<hash> first, then
+// the metadata of the whole batch is sent in one request. HashValue must be set.
+func sendFileBatch(ctx context.Context, client *http.Client, files []KeyValue, serverURL, ref string) error {
+	for _, f := range files {
+		if f.LocalPath != "" && !f.IsDir {
+			// a file that can't be read fails the upload, so the image is never
+			// committed without it
+			err := withRetry(ctx, "uploading "+f.Key, func() error {
+				return uploadBlob(ctx, client, serverURL, f)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.Marshal(files)
+	if err != nil {
+		return fmt.Errorf("marshalling batch files: %w", err)
+	}
+	uploadURL := serverURL + "/batch-upload?image=" + url.QueryEscape(ref)
+	return withRetry(ctx, "uploading metadata", func() error {
+		req, err := http.NewRequestWithContext(ctx, "PUT", uploadURL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		logln("sending to", uploadURL)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		logln("response status:", resp.StatusCode, "body:", string(body))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return errUnauthorized
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &statusError{resp.StatusCode, strings.TrimSpace(string(body))}
+		}
+		return nil
+	})
+}
+
+// uploadBlob streams the content of f from disk to the fileserver as raw bytes, from
+// its own file or straight from the layer tarball it is in.
+func uploadBlob(ctx context.Context, client *http.Client, serverURL string, f KeyValue) error {
+	if f.HashValue == "" {
+		return fmt.Errorf("no hash")
+	}
+	content, size, err := openContent(f)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", serverURL+"/blobs/"+f.HashValue, content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// checkpointEntry is a file the fileserver accepted into an image being uploaded.
+type checkpointEntry struct {
+	Key  string `json:"key"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// uploadCheckpoint records the files of an image the fileserver has accepted, one JSON
+// line per file, until the image is committed. An image reference names its content,
+// so a rerun exporting the same reference can take their hashes from it instead of
+// reading the files again. A nil checkpoint records nothing.
+type uploadCheckpoint struct {
+	f *os.File
+}
+
+// checkpointPath is where the checkpoint of ref on serverURL is kept.
+func checkpointPath(serverURL, ref string) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(serverURL + "\n" + ref))
+	return filepath.Join(dir, "uploads", hex.EncodeToString(sum[:16])+".jsonl"), nil
+}
+
+// readCheckpoint returns the files of ref recorded by earlier uploads, by key.
+func readCheckpoint(serverURL, ref string) map[string]checkpointEntry {
+	done := map[string]checkpointEntry{}
+	path, err := checkpointPath(serverURL, ref)
+	if err != nil {
+		return done
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return done
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry checkpointEntry
+		// a line cut off by a crash is skipped; that file is just hashed again
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Hash != "" {
+			done[entry.Key] = entry
+		}
+	}
+	return done
+}
+
+// openCheckpoint opens the checkpoint of ref for adding to.
+func openCheckpoint(serverURL, ref string) (*uploadCheckpoint, error) {
+	path, err := checkpointPath(serverURL, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadCheckpoint{f: f}, nil
+}
+
+// add records files as accepted by the server.
+func (c *uploadCheckpoint) add(files []KeyValue) {
+	if c == nil {
+		return
+	}
+	var buf bytes.Buffer
+	for _, f := range files {
+		line, _ := json.Marshal(checkpointEntry{Key: f.Key, Hash: f.HashValue, Size: f.Size})
+		buf.Write(append(line, '\n'))
+	}
+	if _, err := c.f.Write(buf.Bytes()); err != nil {
+		logln("writing upload checkpoint:", err)
+	}
+}
+
+func (c *uploadCheckpoint) Close() {
+	if c != nil {
+		c.f.Close()
+	}
+}
+
+// removeCheckpoint forgets the upload of ref once it is committed.
+func removeCheckpoint(serverURL, ref string) {
+	if path, err := checkpointPath(serverURL, ref); err == nil {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_batchFiles(t *testing.T) {
+	files := []KeyValue{
+		{Key: "a", LocalPath: "a", Size: _batchBytes / 2},
+		{Key: "b", LocalPath: "b", Size: _batchBytes / 2},
+		{Key: "c", LocalPath: "c", Size: _batchBytes * 3},
+		{Key: "d", Size: _batchBytes * 3}, // metadata only, no content to send
+		{Key: "e", LocalPath: "e", Size: 1},
+	}
+	var got []string
+	for _, batch := range batchFiles(files) {
+		keys := []string{}
+		for _, f := range batch {
+			keys = append(keys, f.Key)
+		}
+		got = append(got, strings.Join(keys, ""))
+	}
+	if strings.Join(got, " ") != "ab c de" {
+		t.Errorf("batches %v, want [ab c de]", got)
+	}
+
+	var small []KeyValue
+	for i := 0; i < _batchFiles*2+1; i++ {
+		small = append(small, KeyValue{Key: fmt.Sprint(i), LocalPath: "x", Size: 1})
+	}
+	if n := len(batchFiles(small)); n != 3 {
+		t.Errorf("%d batches of small files, want 3", n)
+	}
+}
+
+// flakyFileserver is a stand-in for the fileserver that fails the first sync and the
+// first request for every blob with 503, and drops the connection of the first
+// metadata batch.
+type flakyFileserver struct {
+	*httptest.Server
+	mu          sync.Mutex
+	blobs       map[string]string
+	keys        map[string]string // key to hash
+	attempts    map[string]int
+	reject      string // a key whose batch is refused for good
+	rejectAfter int    // once the server has this many keys
+}
+
+func newFlakyFileserver(t *testing.T) *flakyFileserver {
+	s := &flakyFileserver{blobs: map[string]string{}, keys: map[string]string{}, attempts: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.attempts[r.URL.Path]++
+		if r.URL.Path == "/sync" {
+			if s.attempts[r.URL.Path] == 1 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			var entries []SyncEntry
+			json.NewDecoder(r.Body).Decode(&entries)
+			resp := SyncResponse{NeedUpload: []string{}, NeedMetadata: []string{}}
+			for _, e := range entries {
+				if _, stored := s.blobs[e.Hash]; s.keys[e.Key] == e.Hash {
+					continue
+				} else if stored {
+					resp.NeedMetadata = append(resp.NeedMetadata, e.Key)
+				} else {
+					resp.NeedUpload = append(resp.NeedUpload, e.Key)
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		if hash, ok := strings.CutPrefix(r.URL.Path, "/blobs/"); ok {
+			if s.attempts[r.URL.Path] == 1 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			s.blobs[hash] = string(data)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		if s.attempts[r.URL.Path] == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		var entries []KeyValue
+		json.NewDecoder(r.Body).Decode(&entries)
+		for _, e := range entries {
+			if e.Key != s.reject {
+				continue
+			}
+			if len(s.keys) < s.rejectAfter {
+				// refuse for good only once the other batches are in
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "missing content for "+e.Key, http.StatusBadRequest)
+			return
+		}
+		for _, e := range entries {
+			s.keys[e.Key] = e.HashValue
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func Test_uploadFiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_TOKEN", "")
+	dir := t.TempDir()
+	var files []KeyValue
+	for i := 0; i < 6; i++ {
+		path := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.WriteFile(path, []byte(fmt.Sprint("content ", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// big enough on paper that every two files make a batch
+		files = append(files, KeyValue{Key: fmt.Sprintf("app/%d", i), LocalPath: path, Size: _batchBytes / 2, HashValue: fmt.Sprintf("hash%d", i)})
+	}
+
+	t.Run("failed requests are retried", func(t *testing.T) {
+		server := newFlakyFileserver(t)
+		var progress []int
+		err := uploadFiles(files, server.URL, "sway-x@1", func(sent, total int) {
+			progress = append(progress, sent)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(server.keys) != len(files) || len(server.blobs) != len(files) {
+			t.Fatalf("server has %d keys and %d blobs, want %d", len(server.keys), len(server.blobs), len(files))
+		}
+		if server.blobs["hash3"] != "content 3" {
+			t.Errorf("blob hash3 = %q", server.blobs["hash3"])
+		}
+		if fmt.Sprint(progress) != "[0 2 4 6]" {
+			t.Errorf("progress %v", progress)
+		}
+		if done := readCheckpoint(server.URL, "sway-x@1"); len(done) != len(files) {
+			t.Errorf("checkpoint has %d files, want %d", len(done), len(files))
+		}
+		removeCheckpoint(server.URL, "sway-x@1")
+		if done := readCheckpoint(server.URL, "sway-x@1"); len(done) != 0 {
+			t.Errorf("checkpoint has %d files after removing it", len(done))
+		}
+	})
+
+	t.Run("a file that can't be read fails the upload", func(t *testing.T) {
+		server := newFlakyFileserver(t)
+		missing := []KeyValue{{Key: "app/gone", LocalPath: filepath.Join(dir, "gone"), Size: 1, HashValue: "gone"}}
+		err := uploadFiles(missing, server.URL, "sway-x@3", nil)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("got %v, want the file's error", err)
+		}
+		if len(server.keys) != 0 {
+			t.Errorf("server has keys %v", server.keys)
+		}
+		if done := readCheckpoint(server.URL, "sway-x@3"); len(done) != 0 {
+			t.Errorf("checkpoint has %v", done)
+		}
+	})
+
+	t.Run("a rerun resumes from the checkpoint", func(t *testing.T) {
+		server := newFlakyFileserver(t)
+		server.reject = "app/5"
+		server.rejectAfter = 4
+		err := uploadFiles(files, server.URL, "sway-x@2", nil)
+		if err == nil || !strings.Contains(err.Error(), "status 400") {
+			t.Fatalf("got %v, want the refused batch's error", err)
+		}
+		done := readCheckpoint(server.URL, "sway-x@2")
+		if _, ok := done["app/5"]; ok || len(done) != 4 {
+			t.Fatalf("checkpoint %v", done)
+		}
+		for key, entry := range done {
+			if server.keys[key] != entry.Hash {
+				t.Errorf("checkpoint has %s, which the server didn't accept", key)
+			}
+		}
+
+		// the rerun takes the hashes of what was sent from the checkpoint, and the
+		// server says what is left
+		rerun := make([]KeyValue, len(files))
+		copy(rerun, files)
+		for i := range rerun {
+			rerun[i].HashValue = ""
+		}
+		server.mu.Lock()
+		server.reject = ""
+		server.mu.Unlock()
+		toUpload, err := syncNewFiles(rerun, server.URL, "sway-x@2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range rerun {
+			if entry, ok := done[f.Key]; ok && f.HashValue != entry.Hash {
+				t.Errorf("%s was hashed again", f.Key)
+			}
+		}
+		if len(toUpload) != len(files)-len(done) {
+			t.Errorf("%d files left to upload, want %d", len(toUpload), len(files)-len(done))
+		}
+		if err := uploadFiles(toUpload, server.URL, "sway-x@2", nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(server.keys) != len(files) {
+			t.Errorf("server has %d keys, want %d", len(server.keys), len(files))
+		}
+	})
+}
+
+func Test_syncNewFiles_error(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SWAY_TOKEN", "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad image", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	files := []KeyValue{{Key: "app/x", HashValue: "hash", Size: 1, LocalPath: "x"}}
+	if _, err := syncNewFiles(files, server.URL, "sway-x@1"); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("got %v, want the sync's error", err)
+	}
+}
@@ -22,12 +22,26 @@ function getRunIdFromPath() {
     return match ? parseInt(match[1], 10) : null;
 }
 
+// runState is how a run's status is shown. Runs from before statuses existed only
+// have an exit code.
+function runState(r) {
+    const status = r.status || (Number(r.exit_code) === 0 ? "succeeded" : "failed");
+    switch (status) {
+        case "queued":
+            return { dot: "bg-amber-400", pill: "border-amber-200 bg-amber-50 text-amber-700", label: "Queued" };
+        case "running":
+            return { dot: "bg-blue-500", pill: "border-blue-200 bg-blue-50 text-blue-700", label: "Running" };
+        case "cancelled":
+            return { dot: "bg-slate-400", pill: "border-slate-200 bg-slate-50 text-slate-700", label: "Cancelled" };
+        case "succeeded":
+            return { dot: "bg-emerald-500", pill: "border-emerald-200 bg-emerald-50 text-emerald-700", label: `Succeeded · exit ${esc(r.exit_code)}` };
+        default:
+            return { dot: "bg-red-500", pill: "border-red-200 bg-red-50 text-red-700", label: `Failed · exit ${esc(r.exit_code)}` };
+    }
+}
+
 function detailHTML(r) {
-    const ok = Number(r.exit_code) === 0;
-    const dot = ok ? "bg-emerald-500" : "bg-red-500";
-    const pill = ok
-        ? "border-emerald-200 bg-emerald-50 text-emerald-700"
-        : "border-red-200 bg-red-50 text-red-700";
+    const { dot, pill, label } = runState(r);
 
     const startedAbs = new Date(r.started_at).toLocaleString();
     const startedRel = rel(r.started_at);
@@ -47,7 +61,7 @@ function detailHTML(r) {
 
       <div class="flex flex-wrap items-center gap-2 mb-4">
         <span class="rounded-full border px-2.5 py-1 text-xs ${pill}">
-          ${ok ? "Succeeded" : "Failed"} · exit ${esc(r.exit_code)}
+          ${label}
         </span>
         <span class="rounded-full border border-slate-200 bg-slate-50 px-2.5 py-1 text-xs">
           ${esc(fmtDur(r.duration_ms))}
@@ -82,11 +96,7 @@ function detailHTML(r) {
 }
 
 function rowHTML(r) {
-    const ok = Number(r.exit_code) === 0;
-    const dot = ok ? "bg-emerald-500" : "bg-red-500";
-    const pill = ok
-        ? "border-emerald-200 bg-emerald-50 text-emerald-700"
-        : "border-red-200 bg-red-50 text-red-700";
+    const { dot, pill, label } = runState(r);
 
     const startedAbs = new Date(r.started_at).toLocaleString();
     const startedRel = rel(r.started_at);
@@ -109,7 +119,7 @@ function rowHTML(r) {
 
         <div class="flex flex-wrap items-center gap-2">
           <span class="rounded-full border px-2.5 py-1 text-xs ${pill}">
-            ${ok ? "Succeeded" : "Failed"} · exit ${esc(r.exit_code)}
+            ${label}
           </span>
           <span class="rounded-full border border-slate-200 bg-slate-50 px-2.5 py-1 text-xs">
             ${esc(fmtDur(r.duration_ms))}
@@ -133,7 +143,7 @@ function rowHTML(r) {
 function render() {
     const q = $("q").value.trim().toLowerCase();
     const filtered = rows
-        .filter((r) => `${r.id} ${r.filename} ${r.exit_code}`.toLowerCase().includes(q))
+        .filter((r) => `${r.id} ${r.filename} ${r.exit_code} ${r.status || ""}`.toLowerCase().includes(q))
         .sort((a, b) => new Date(b.started_at) - new Date(a.started_at));
 
     $("count").textContent = `${filtered.length} run${filtered.length === 1 ? "" : "s"}`;
@@ -157,14 +167,28 @@ function renderDetail(runId) {
     $("list").innerHTML = detailHTML(r);
 }
 
+// The worker only lists a user's own runs, or every run for admins, so the page
+// asks for the API token sway login was given and keeps it in this browser.
+const TOKEN_KEY = "swayToken";
+
+async function fetchRuns() {
+    const headers = { "content-type": "application/json" };
+    const token = localStorage.getItem(TOKEN_KEY);
+    if (token) headers["authorization"] = `Bearer ${token}`;
+    return fetch(ENDPOINT, { method: "POST", headers, body: "[]" });
+}
+
 async function load() {
     $("status").textContent = "Loading…";
     try {
-        const res = await fetch(ENDPOINT, {
-            method: "POST",
-            headers: { "content-type": "application/json" },
-            body: "[]",
-        });
+        let res = await fetchRuns();
+        if (res.status === 401) {
+            const token = prompt("API token (the one you gave sway login)");
+            if (token) {
+                localStorage.setItem(TOKEN_KEY, token.trim());
+                res = await fetchRuns();
+            }
+        }
         if (!res.ok) throw new Error(`HTTP ${res.status}`);
         rows = await res.json();
         $("status").textContent = "Updated just now";